@@ -8,14 +8,19 @@ import (
 	"github.com/go-playground/validator/v10"
 	"github.com/jmoiron/sqlx"
 	"github.com/practice-sem-2/auth-tools"
+	"github.com/practice-sem-2/user-service/internal/broker"
 	"github.com/practice-sem-2/user-service/internal/pb/chats"
 	"github.com/practice-sem-2/user-service/internal/server"
 	storage "github.com/practice-sem-2/user-service/internal/storages"
 	usecase "github.com/practice-sem-2/user-service/internal/usecases"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"google.golang.org/grpc"
 	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"strings"
@@ -23,6 +28,13 @@ import (
 	"time"
 )
 
+// updatesBufferSize is how many updates may wait for a slow
+// SubscribeUpdates client before its stream is dropped
+const updatesBufferSize = 256
+
+// shutdownTimeout is how long in-flight requests are waited on shutdown
+const shutdownTimeout = 10 * time.Second
+
 func initLogger(level string) *logrus.Logger {
 
 	logger := logrus.New()
@@ -71,12 +83,39 @@ func initServer(address string, c *usecase.ChatsUsecase, a *auth.VerifierService
 		logger.Fatalf("can't listen to address: %s", err.Error())
 	}
 
-	grpcServer := grpc.NewServer()
-	chats.RegisterChatServer(grpcServer, server.NewChatServer(c, a, v))
+	interceptors := server.NewInterceptors(a, logger)
+	grpcServer := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(interceptors.Unary()),
+		grpc.ChainStreamInterceptor(interceptors.Stream()),
+	)
+	chats.RegisterChatServer(grpcServer, server.NewChatServer(c, v))
 
 	return grpcServer, listener
 }
 
+// initMetricsServer exposes prometheus metrics, db pool stats
+// are registered here since they need the connection
+func initMetricsServer(address string, db *sqlx.DB, logger *logrus.Logger) *http.Server {
+	prometheus.MustRegister(collectors.NewDBStatsCollector(db.DB, "chats"))
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	srv := &http.Server{
+		Addr:              address,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		logger.Infof("metrics are served on %s", address)
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			logger.Fatalf("metrics serving error: %s", err.Error())
+		}
+	}()
+
+	return srv
+}
+
 func initProducer(logger *logrus.Logger) sarama.SyncProducer {
 	brokers := viper.GetString("KAFKA_BROKERS")
 	if len(brokers) == 0 {
@@ -100,6 +139,42 @@ func initProducer(logger *logrus.Logger) sarama.SyncProducer {
 	return producer
 }
 
+func initRelay(db *sqlx.DB, p sarama.SyncProducer, logger *logrus.Logger) *storage.UpdatesRelay {
+	// Default applies only if OUTBOX_RETENTION is not set, explicit zero
+	// keeps sent updates forever
+	viper.SetDefault("OUTBOX_RETENTION", 7*24*time.Hour)
+	cfg := &storage.UpdatesRelayConfig{
+		PollInterval: viper.GetDuration("OUTBOX_POLL_INTERVAL"),
+		BatchSize:    viper.GetUint64("OUTBOX_BATCH_SIZE"),
+		Retention:    viper.GetDuration("OUTBOX_RETENTION"),
+	}
+
+	if cfg.PollInterval <= 0 {
+		cfg.PollInterval = time.Second
+	}
+
+	if cfg.BatchSize == 0 {
+		cfg.BatchSize = 100
+	}
+
+	return storage.NewUpdatesRelay(db, p, cfg, logger)
+}
+
+// defaultReactions are allowed if REACTIONS is not set
+var defaultReactions = []string{"👍", "👎", "❤️", "🔥", "😂", "😮", "😢", "🙏"}
+
+func initChatsConfig() *usecase.ChatsConfig {
+	cfg := &usecase.ChatsConfig{
+		AllowedReactions: defaultReactions,
+	}
+
+	if reactions := viper.GetString("REACTIONS"); len(reactions) > 0 {
+		cfg.AllowedReactions = strings.Split(reactions, ",")
+	}
+
+	return cfg
+}
+
 func main() {
 	viper.AutomaticEnv()
 	ctx := context.Background()
@@ -108,10 +183,12 @@ func main() {
 	var host string
 	var port int
 	var logLevel string
+	var metricsAddress string
 
 	flag.IntVar(&port, "port", 80, "port on which server will be started")
 	flag.StringVar(&host, "host", "0.0.0.0", "host on which server will be started")
 	flag.StringVar(&logLevel, "log", "info", "log level")
+	flag.StringVar(&metricsAddress, "metrics", "", "address of prometheus metrics listener, disabled if empty")
 
 	flag.Parse()
 
@@ -125,13 +202,33 @@ func main() {
 		}
 	}(db)
 
+	var metricsSrv *http.Server
+	if len(metricsAddress) > 0 {
+		metricsSrv = initMetricsServer(metricsAddress, db, logger)
+	}
+
 	producer := initProducer(logger)
+	defer func(producer sarama.SyncProducer) {
+		err := producer.Close()
+		if err != nil {
+			logger.Errorf("during producer close an error occurred: %s", err.Error())
+		}
+	}(producer)
 
-	store := storage.NewRegistry(db, producer, &storage.UpdatesStoreConfig{
+	updatesBroker := broker.NewBroker(updatesBufferSize)
+	store := storage.NewRegistry(db, &storage.UpdatesStoreConfig{
 		UpdatesTopic: viper.GetString("UPDATES_TOPIC"),
-	})
+	}, updatesBroker)
+
+	relayCtx, stopRelay := context.WithCancel(ctx)
+	relayDone := make(chan struct{})
+	relay := initRelay(db, producer, logger)
+	go func() {
+		relay.Run(relayCtx)
+		close(relayDone)
+	}()
 
-	chatsUsecase := usecase.NewChatsUsecase(store)
+	chatsUsecase := usecase.NewChatsUsecase(store, updatesBroker, initChatsConfig())
 	verifier, err := auth.NewVerifierFromFile(viper.GetString("JWT_PUBLIC_KEY_PATH"))
 
 	if err != nil {
@@ -151,8 +248,16 @@ func main() {
 	go func(ctx context.Context) {
 		select {
 		case sig := <-osSignal:
-			srv.GracefulStop()
 			logger.Infof("%s caught. Gracefully shutdown", sig.String())
+			// SubscribeUpdates streams last until client disconnects,
+			// so they are ended first to let GracefulStop return
+			updatesBroker.Close()
+			stopped := time.AfterFunc(shutdownTimeout, func() {
+				logger.Warning("graceful shutdown timed out, closing connections")
+				srv.Stop()
+			})
+			srv.GracefulStop()
+			stopped.Stop()
 		case <-ctx.Done():
 			return
 		}
@@ -162,4 +267,14 @@ func main() {
 	if err != nil {
 		logger.Fatalf("grpc serving error: %s", err.Error())
 	}
+
+	// Lets relay finish publishing current batch before producer is closed
+	stopRelay()
+	<-relayDone
+
+	if metricsSrv != nil {
+		if err = metricsSrv.Shutdown(ctx); err != nil {
+			logger.Errorf("during metrics server shutdown an error occurred: %s", err.Error())
+		}
+	}
 }
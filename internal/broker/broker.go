@@ -0,0 +1,134 @@
+package broker
+
+import (
+	"errors"
+	"github.com/practice-sem-2/user-service/internal/pb/chats/updates"
+	"sync"
+)
+
+var (
+	ErrSubscriptionDropped = errors.New("subscriber can't keep up with updates")
+	ErrBrokerClosed        = errors.New("broker is closed")
+)
+
+// Broker delivers committed updates to subscribers of this process.
+// Each update is delivered to every subscription of its audience members
+type Broker struct {
+	mu          sync.RWMutex
+	subscribers map[string]map[*Subscription]struct{}
+	bufferSize  int
+	closed      bool
+}
+
+// Subscription receives user's updates until it is unsubscribed.
+// If subscriber can't keep up and its buffer is full, subscription is
+// dropped and the updates channel is closed, so client has to resync
+type Subscription struct {
+	username string
+	updates  chan *updates.Update
+	// err is a reason of subscription end, it is set before
+	// updates channel is closed
+	err error
+}
+
+func NewBroker(bufferSize int) *Broker {
+	return &Broker{
+		subscribers: make(map[string]map[*Subscription]struct{}),
+		bufferSize:  bufferSize,
+	}
+}
+
+func (s *Subscription) Updates() <-chan *updates.Update {
+	return s.updates
+}
+
+// Err returns why the subscription was ended by broker, it may be called
+// once updates channel is closed. It is nil if subscriber unsubscribed
+func (s *Subscription) Err() error {
+	return s.err
+}
+
+func (b *Broker) Subscribe(username string) *Subscription {
+	sub := &Subscription{
+		username: username,
+		updates:  make(chan *updates.Update, b.bufferSize),
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		sub.err = ErrBrokerClosed
+		close(sub.updates)
+		return sub
+	}
+
+	if _, ok := b.subscribers[username]; !ok {
+		b.subscribers[username] = make(map[*Subscription]struct{})
+	}
+	b.subscribers[username][sub] = struct{}{}
+
+	return sub
+}
+
+func (b *Broker) Unsubscribe(sub *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.remove(sub, nil)
+}
+
+// Close ends all subscriptions, so their streams can be finished
+// on shutdown. Following subscriptions are ended immediately
+func (b *Broker) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for _, subs := range b.subscribers {
+		for sub := range subs {
+			b.remove(sub, ErrBrokerClosed)
+		}
+	}
+}
+
+// remove must be called with write lock held
+func (b *Broker) remove(sub *Subscription, reason error) {
+	subs, ok := b.subscribers[sub.username]
+	if !ok {
+		return
+	}
+
+	if _, ok = subs[sub]; !ok {
+		return
+	}
+
+	delete(subs, sub)
+	sub.err = reason
+	close(sub.updates)
+
+	if len(subs) == 0 {
+		delete(b.subscribers, sub.username)
+	}
+}
+
+func (b *Broker) Publish(update *updates.Update) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	seen := make(map[string]bool)
+	for _, username := range update.GetMeta().GetAudience() {
+		if seen[username] {
+			continue
+		}
+		seen[username] = true
+
+		for sub := range b.subscribers[username] {
+			select {
+			case sub.updates <- update:
+			default:
+				b.remove(sub, ErrSubscriptionDropped)
+			}
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package broker
+
+import (
+	"github.com/practice-sem-2/user-service/internal/pb/chats/updates"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+)
+
+func newUpdate(audience ...string) *updates.Update {
+	return &updates.Update{
+		Meta: &updates.UpdateMeta{Audience: audience},
+	}
+}
+
+func TestBroker_PublishToAudienceOnly(t *testing.T) {
+	b := NewBroker(10)
+	alice := b.Subscribe("alice")
+	bob := b.Subscribe("bob")
+
+	update := newUpdate("alice", "alice")
+	b.Publish(update)
+
+	require.Len(t, alice.Updates(), 1, "update should be delivered to audience member once")
+	assert.Same(t, update, <-alice.Updates())
+	assert.Len(t, bob.Updates(), 0, "update should not be delivered to others")
+}
+
+func TestBroker_PublishToAllUserSubscriptions(t *testing.T) {
+	b := NewBroker(10)
+	first := b.Subscribe("alice")
+	second := b.Subscribe("alice")
+
+	b.Publish(newUpdate("alice"))
+
+	assert.Len(t, first.Updates(), 1, "update should be delivered to every subscription")
+	assert.Len(t, second.Updates(), 1, "update should be delivered to every subscription")
+}
+
+func TestBroker_Unsubscribe(t *testing.T) {
+	b := NewBroker(10)
+	sub := b.Subscribe("alice")
+
+	b.Unsubscribe(sub)
+	b.Unsubscribe(sub)
+	b.Publish(newUpdate("alice"))
+
+	_, ok := <-sub.Updates()
+	assert.False(t, ok, "updates channel should be closed")
+}
+
+func TestBroker_DropsSlowSubscription(t *testing.T) {
+	b := NewBroker(1)
+	sub := b.Subscribe("alice")
+
+	b.Publish(newUpdate("alice"))
+	b.Publish(newUpdate("alice"))
+
+	_, ok := <-sub.Updates()
+	assert.True(t, ok, "buffered update should be delivered")
+	_, ok = <-sub.Updates()
+	assert.False(t, ok, "overflowed subscription should be closed")
+	assert.ErrorIs(t, sub.Err(), ErrSubscriptionDropped)
+
+	b.Unsubscribe(sub)
+}
+
+func TestBroker_Close(t *testing.T) {
+	b := NewBroker(10)
+	sub := b.Subscribe("alice")
+
+	b.Close()
+
+	_, ok := <-sub.Updates()
+	assert.False(t, ok, "updates channel should be closed")
+	assert.ErrorIs(t, sub.Err(), ErrBrokerClosed)
+
+	late := b.Subscribe("alice")
+	_, ok = <-late.Updates()
+	assert.False(t, ok, "subscription after close should be ended immediately")
+	assert.ErrorIs(t, late.Err(), ErrBrokerClosed)
+}
@@ -0,0 +1,75 @@
+package metrics
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+const namespace = "chats"
+
+var (
+	RPCRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "grpc",
+		Name:      "requests_total",
+		Help:      "Count of handled rpc calls by method and status code.",
+	}, []string{"method", "code"})
+
+	RPCDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "grpc",
+		Name:      "request_duration_seconds",
+		Help:      "Latency of rpc calls by method and status code. Streams are observed when closed.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method", "code"})
+
+	TransactionDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "db",
+		Name:      "transaction_duration_seconds",
+		Help:      "Duration of Registry.Atomic transactions including commit or rollback.",
+		Buckets:   prometheus.DefBuckets,
+	})
+
+	TransactionRollbacks = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "db",
+		Name:      "transaction_rollbacks_total",
+		Help:      "Count of Registry.Atomic transactions rolled back.",
+	})
+
+	UpdatePublishDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "updates",
+		Name:      "publish_duration_seconds",
+		Help:      "Latency of publishing an update from the outbox to kafka by update type.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"type"})
+
+	UpdatePublishFailures = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "updates",
+		Name:      "publish_failures_total",
+		Help:      "Count of updates failed to be published to kafka by update type.",
+	}, []string{"type"})
+
+	MessagesSent = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "messages_sent_total",
+		Help:      "Count of sent messages, forwarded copies included.",
+	})
+
+	ChatsCreated = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "chats_created_total",
+		Help:      "Count of created chats by kind.",
+	}, []string{"kind"})
+)
+
+// ChatKind is a label value of ChatsCreated
+func ChatKind(isDirect bool) string {
+	if isDirect {
+		return "direct"
+	}
+	return "group"
+}
@@ -1,28 +1,81 @@
 package models
 
+import "time"
+
+// ChatInfo is a group chat metadata. Direct chats have no title
+type ChatInfo struct {
+	Title        *string `json:"title" validate:"omitempty,max=128" db:"title"`
+	Description  *string `json:"description" validate:"omitempty,max=1024" db:"description"`
+	AvatarFileID *string `json:"avatar_file_id" validate:"omitempty,uuid" db:"avatar_file_id"`
+}
+
 type Chat struct {
 	ChatID       string `json:"chat_id" db:"chat_id"`
 	MembersCount int    `json:"members_count" db:"members_count"`
 	IsDirect     bool   `json:"is_direct" db:"is_direct"`
+	ChatInfo
+	CreatedAt time.Time `json:"created_at" db:"created_at"`
+	CreatedBy *string   `json:"created_by" db:"created_by"`
+	// ReadReceipts shows whether members can see who read messages
+	ReadReceipts bool `json:"read_receipts" db:"read_receipts"`
 }
 
 type ChatCreate struct {
 	ChatID   string   `json:"chat_id" validate:"required,uuid" db:"chat_id"`
 	IsDirect bool     `json:"is_direct" validate:"required" db:"is_direct"`
 	Members  []string `json:"members" validate:"required,uuid"`
+	ChatInfo
 }
 
+// ChatInfoUpdate changes only provided fields, empty values clear them
+type ChatInfoUpdate struct {
+	ChatID string `validate:"required,uuid"`
+	ChatInfo
+}
+
+type ChatRole string
+
+const (
+	RoleOwner  ChatRole = "owner"
+	RoleAdmin  ChatRole = "admin"
+	RoleMember ChatRole = "member"
+)
+
 type ChatMember struct {
-	UserID string `json:"user_id" db:"user_id"`
+	UserID string   `json:"user_id" db:"user_id"`
+	Role   ChatRole `json:"role" db:"role"`
 }
 
 type ChatWithMembers struct {
 	Chat
 	Members []ChatMember `json:"members"`
+	// LastPin is the most recently pinned message, nil if there are no pins
+	LastPin *Pin `json:"last_pin"`
+}
+
+type Pin struct {
+	ChatID    string    `json:"chat_id" db:"chat_id"`
+	MessageID string    `json:"message_id" db:"message_id"`
+	PinnedBy  string    `json:"pinned_by" db:"pinned_by"`
+	PinnedAt  time.Time `json:"pinned_at" db:"pinned_at"`
+}
+
+type PinnedMessage struct {
+	Pin
+	Message Message `json:"message"`
+}
+
+type PinChange struct {
+	ChatID    string `validate:"required,uuid"`
+	MessageID string `validate:"required,uuid"`
 }
 
 type RichChat struct {
-	ChatID      string   `json:"chat_id" db:"chat_id"`
-	IsDirect    bool     `json:"is_direct" db:"is_direct"`
+	ChatID   string `json:"chat_id" db:"chat_id"`
+	IsDirect bool   `json:"is_direct" db:"is_direct"`
+	ChatInfo
 	LastMessage *Message `json:"last_message"`
+	// UnreadCount is a number of messages from other members
+	// placed after user's read marker
+	UnreadCount int64 `json:"unread_count" db:"unread_count"`
 }
@@ -12,17 +12,95 @@ type MessageSend struct {
 	ChatID      string           `validate:"required,uuid"`
 	Text        string           `validate:"max=2048,required_without=Attachments"`
 	ReplyTo     *string          `validate:"omitempty,uuid"`
-	Attachments []FileAttachment `validate:"required_without=Text"`
+	Attachments []FileAttachment `validate:"required_without=Text,dive"`
 }
 
 type Message struct {
-	MessageID   string    `db:"message_id"`
-	FromUser    string    `db:"from_user"`
-	ChatID      string    `db:"chat_id"`
-	SendingTime time.Time `db:"sending_time"`
-	Text        string    `db:"text"`
-	ReplyTo     *string   `db:"reply_to"`
+	MessageID   string     `db:"message_id"`
+	FromUser    string     `db:"from_user"`
+	ChatID      string     `db:"chat_id"`
+	SendingTime time.Time  `db:"sending_time"`
+	Text        string     `db:"text"`
+	ReplyTo     *string    `db:"reply_to"`
+	EditedAt    *time.Time `db:"edited_at"`
+	DeletedAt   *time.Time `db:"deleted_at"`
+	ForwardOrigin
+	// ThreadRootID is the first message of reply chain, NULL for roots
+	ThreadRootID *string `db:"thread_root_id"`
+	ThreadStats
 	Attachments []FileAttachment
+	Reactions   []Reaction
+	// ReplyPreview is resolved only for a message returned to its sender
+	ReplyPreview *ReplyPreview
+}
+
+// ReplyPreview briefly describes the message which is replied to
+type ReplyPreview struct {
+	MessageID string
+	FromUser  string
+	Text      string
+	Deleted   bool
+}
+
+// ThreadStats describes replies to a thread root message
+type ThreadStats struct {
+	ReplyCount  int64      `db:"reply_count"`
+	LastReplyAt *time.Time `db:"last_reply_at"`
+}
+
+// ForwardOrigin points to the original message of a forwarded one. Chat and
+// message are NULL if they were deleted, all fields are NULL if message
+// is not forwarded
+type ForwardOrigin struct {
+	ForwardedFromChat    *string    `db:"forwarded_from_chat"`
+	ForwardedFromMessage *string    `db:"forwarded_from_message"`
+	ForwardedFromUser    *string    `db:"forwarded_from_user"`
+	ForwardedSendingTime *time.Time `db:"forwarded_sending_time"`
+}
+
+type MessagesForward struct {
+	FromChatID string   `validate:"required,uuid"`
+	ToChatID   string   `validate:"required,uuid"`
+	MessageIDs []string `validate:"required,min=1,max=100,unique,dive,uuid"`
+}
+
+// Reaction is an aggregate of all users' reactions of the same kind
+type Reaction struct {
+	Reaction string `db:"reaction"`
+	Count    int64  `db:"count"`
+	// Reacted shows whether the user who requested messages has this reaction
+	Reacted bool `db:"reacted"`
+}
+
+type ReactionChange struct {
+	MessageID string `validate:"required,uuid"`
+	Reaction  string `validate:"required,max=32"`
+}
+
+type DeletionScope int
+
+const (
+	// DeleteForMe hides messages only from the user who deleted them
+	DeleteForMe DeletionScope = iota
+	// DeleteForEveryone replaces messages with tombstones for all chat members
+	DeleteForEveryone
+)
+
+type MessagesDelete struct {
+	ChatID     string   `validate:"required,uuid"`
+	MessageIDs []string `validate:"required,min=1,max=100,unique,dive,uuid"`
+	Scope      DeletionScope
+}
+
+type MessageEdit struct {
+	MessageID string `validate:"required,uuid"`
+	Text      string `validate:"max=2048"`
+}
+
+type MessageRevision struct {
+	MessageID string    `db:"message_id"`
+	Text      string    `db:"text"`
+	RevisedAt time.Time `db:"revised_at"`
 }
 
 type MessagesSelect struct {
@@ -30,4 +108,75 @@ type MessagesSelect struct {
 	Count  *int       `validate:"omitempty,min=0,max=512"`
 	Since  *time.Time `validate:"omitempty"`
 	Until  *time.Time `validate:"omitempty"`
+	// Before, After and Around are mutually exclusive anchors of the page.
+	// Before and After are cursors, Around is a message id
+	Before *string `validate:"omitempty,excluded_with=After Around"`
+	After  *string `validate:"omitempty,excluded_with=Before Around"`
+	Around *string `validate:"omitempty,uuid,excluded_with=Before After"`
+	// RootsOnly excludes thread replies from the main timeline
+	RootsOnly bool
+}
+
+type ThreadSelect struct {
+	RootID string  `validate:"required,uuid"`
+	Count  *int    `validate:"omitempty,min=0,max=512"`
+	Before *string `validate:"omitempty,excluded_with=After"`
+	After  *string `validate:"omitempty,excluded_with=Before"`
+}
+
+type ThreadPage struct {
+	Root Message
+	MessagesPage
+}
+
+// MessageCursor is a position of a message in chat history. Messages are
+// ordered by sending time and then by id, so position is always unique
+type MessageCursor struct {
+	SendingTime time.Time
+	MessageID   string
+}
+
+type MessagesPage struct {
+	Messages []Message
+	// PrevCursor points to the first message and is used to fetch older ones
+	PrevCursor *string
+	// NextCursor points to the last message and is used to fetch newer ones
+	NextCursor *string
+}
+
+type ReadMark struct {
+	ChatID    string `validate:"required,uuid"`
+	MessageID string `validate:"required,uuid"`
+}
+
+type MessagesSearch struct {
+	Query          string     `validate:"required,max=256"`
+	ChatID         *string    `validate:"omitempty,uuid"`
+	FromUser       *string    `validate:"omitempty"`
+	Since          *time.Time `validate:"omitempty"`
+	Until          *time.Time `validate:"omitempty"`
+	HasAttachments *bool
+	Count          *int    `validate:"omitempty,min=1,max=100"`
+	After          *string `validate:"omitempty"`
+}
+
+// SearchCursor is a position of a message in search results which
+// are ordered by rank and then by message position
+type SearchCursor struct {
+	Rank float32
+	MessageCursor
+}
+
+type SearchResult struct {
+	Message
+	Rank float32 `db:"rank"`
+	// Snippet is a part of HTML escaped message text with matches
+	// wrapped in <b> tags
+	Snippet string `db:"snippet"`
+}
+
+type SearchPage struct {
+	Results []SearchResult
+	// NextCursor points to the last result and is used to fetch the next page
+	NextCursor *string
 }
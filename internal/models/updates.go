@@ -15,6 +15,70 @@ type MessageSent struct {
 	Text        string  `validate:"required_without=Attachments"`
 	ReplyTo     *string `validate:"uuid"`
 	Attachments []FileAttachment
+	ForwardOrigin
+	ThreadRootID *string
+}
+
+type MessageEdited struct {
+	UpdateMeta
+	MessageID string `validate:"required,uuid"`
+	ChatID    string `validate:"required,uuid"`
+	Text      string
+	EditedAt  time.Time
+}
+
+type MessageDeleted struct {
+	UpdateMeta
+	ChatID     string `validate:"required,uuid"`
+	MessageIDs []string
+}
+
+type ReadMarkerUpdated struct {
+	UpdateMeta
+	ChatID    string `validate:"required,uuid"`
+	MessageID string `validate:"required,uuid"`
+}
+
+// MessagesRead tells other chat members that user has read
+// all messages up to MessageID
+type MessagesRead struct {
+	UpdateMeta
+	ChatID    string `validate:"required,uuid"`
+	Username  string `validate:"required"`
+	MessageID string `validate:"required,uuid"`
+}
+
+// ReactionChanged is sent when user adds or removes a reaction,
+// Count is the number of such reactions after the change
+type ReactionChanged struct {
+	UpdateMeta
+	ChatID    string `validate:"required,uuid"`
+	MessageID string `validate:"required,uuid"`
+	Username  string `validate:"required"`
+	Reaction  string `validate:"required"`
+	Added     bool
+	Count     int64
+}
+
+type MessagePinned struct {
+	UpdateMeta
+	ChatID    string `validate:"required,uuid"`
+	MessageID string `validate:"required,uuid"`
+	PinnedBy  string `validate:"required"`
+}
+
+type MessageUnpinned struct {
+	UpdateMeta
+	ChatID     string `validate:"required,uuid"`
+	MessageID  string `validate:"required,uuid"`
+	UnpinnedBy string `validate:"required"`
+}
+
+type ThreadUpdated struct {
+	UpdateMeta
+	ChatID string `validate:"required,uuid"`
+	RootID string `validate:"required,uuid"`
+	ThreadStats
 }
 
 type ChatCreated struct {
@@ -22,16 +86,83 @@ type ChatCreated struct {
 	ChatID   string `validate:"required,uuid"`
 	IsDirect bool   `validate:"required"`
 	Members  []string
+	ChatInfo
 }
 
+type ChatInfoUpdated struct {
+	UpdateMeta
+	ChatID    string `validate:"required,uuid"`
+	UpdatedBy string `validate:"required"`
+	ChatInfo
+}
+
+// MemberAdded is sent when a single user is added to chat,
+// Actor is the user who added them
 type MemberAdded struct {
 	UpdateMeta
 	ChatID   string `validate:"required,uuid"`
 	Username string `validate:"required"`
+	Actor    string `validate:"required"`
+}
+
+// MembersAdded is a batch form of MemberAdded
+type MembersAdded struct {
+	UpdateMeta
+	ChatID    string   `validate:"required,uuid"`
+	Usernames []string `validate:"required,min=1"`
+	Actor     string   `validate:"required"`
+}
+
+type MemberRoleChanged struct {
+	UpdateMeta
+	ChatID   string `validate:"required,uuid"`
+	Username string `validate:"required"`
+	Role     ChatRole
 }
 
+// MemberRemoved is sent when a single user is removed from chat,
+// Actor is the same as Username if the user left the chat
 type MemberRemoved struct {
 	UpdateMeta
 	ChatID   string `validate:"required,uuid"`
 	Username string `validate:"required"`
+	Actor    string `validate:"required"`
+}
+
+// MembersRemoved is a batch form of MemberRemoved
+type MembersRemoved struct {
+	UpdateMeta
+	ChatID    string   `validate:"required,uuid"`
+	Usernames []string `validate:"required,min=1"`
+	Actor     string   `validate:"required"`
+}
+
+type ChatDeleted struct {
+	UpdateMeta
+	ChatID string `validate:"required,uuid"`
+}
+
+// UserUpdate is an update delivered to a particular user with the user's
+// sequence number. Payload is a serialized update
+type UserUpdate struct {
+	Pts     int64  `db:"pts"`
+	Payload []byte `db:"payload"`
+}
+
+type DifferenceSelect struct {
+	FromPts int64 `validate:"min=0"`
+	Limit   *int  `validate:"omitempty,min=1,max=512"`
+}
+
+type Difference struct {
+	Updates []UserUpdate
+	// Pts is the current user's sequence number. If HasMore is set, it is
+	// the sequence number of the last returned update instead, so client
+	// requests the rest of the gap from Pts
+	Pts int64
+	// TooLong is set if the gap is too large, so client must refetch
+	// its state and continue from Pts
+	TooLong bool
+	// HasMore is set if the gap is larger than the limit
+	HasMore bool
 }
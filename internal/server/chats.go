@@ -4,7 +4,7 @@ import (
 	"context"
 	"errors"
 	"github.com/go-playground/validator/v10"
-	"github.com/practice-sem-2/auth-tools"
+	"github.com/practice-sem-2/user-service/internal/broker"
 	"github.com/practice-sem-2/user-service/internal/models"
 	"github.com/practice-sem-2/user-service/internal/pb/chats"
 	storage "github.com/practice-sem-2/user-service/internal/storages"
@@ -12,7 +12,6 @@ import (
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/emptypb"
-	"time"
 )
 
 var (
@@ -22,71 +21,51 @@ var (
 type ChatServer struct {
 	chats.UnimplementedChatServer
 	chats    *usecase.ChatsUsecase
-	auth     *auth.VerifierService
 	validate *validator.Validate
 }
 
-func NewChatServer(c *usecase.ChatsUsecase, a *auth.VerifierService, v *validator.Validate) *ChatServer {
+// NewChatServer creates server which expects Interceptors to authenticate
+// users and to map returned errors
+func NewChatServer(c *usecase.ChatsUsecase, v *validator.Validate) *ChatServer {
 	return &ChatServer{
 		chats:    c,
-		auth:     a,
 		validate: v,
 	}
 }
 
 func (s *ChatServer) GetUserChats(ctx context.Context, r *chats.GetChatsRequest) (*chats.GetChatsResponse, error) {
-	claims, err := s.auth.GetUser(ctx)
-
-	if err != nil {
-		return nil, wrapError(err)
-	}
+	claims := UserFromContext(ctx)
 
 	userChats, err := s.chats.GetUsersChats(ctx, claims)
 
 	if err != nil {
-		return nil, wrapError(err)
+		return nil, err
 	}
 
 	res := &chats.GetChatsResponse{
 		Chats: make([]*chats.RichChat, len(userChats)),
 	}
-	// TODO: handle attachments
 	for i, chat := range userChats {
 		res.Chats[i] = &chats.RichChat{
-			ChatId:   chat.ChatID,
-			IsDirect: chat.IsDirect,
-			LastMessage: &chats.Message{
-				MessageId:   chat.LastMessage.MessageID,
-				FromUser:    chat.LastMessage.FromUser,
-				ChatId:      chat.LastMessage.ChatID,
-				Timestamp:   chat.LastMessage.SendingTime.UTC().Unix(),
-				Text:        chat.LastMessage.Text,
-				ReplyTo:     chat.LastMessage.ReplyTo,
-				Attachments: nil,
-			},
+			ChatId:       chat.ChatID,
+			IsDirect:     chat.IsDirect,
+			Title:        chat.Title,
+			Description:  chat.Description,
+			AvatarFileId: chat.AvatarFileID,
+			LastMessage:  MessageFromModel(chat.LastMessage),
+			UnreadCount:  chat.UnreadCount,
 		}
 	}
 	return res, nil
 }
 
 func (s *ChatServer) GetMessages(ctx context.Context, r *chats.GetMessagesRequest) (*chats.GetMessagesResponse, error) {
-	claims, err := s.auth.GetUser(ctx)
-
-	if err != nil {
-		return nil, wrapError(err)
-	}
+	claims := UserFromContext(ctx)
 
 	sel := &models.MessagesSelect{ChatID: r.ChatId}
 
-	if r.Since != nil {
-		sel.Since = new(time.Time)
-		*sel.Since = time.Unix(*r.Since, 0).UTC()
-	}
-
-	if r.Until != nil {
-		sel.Until = new(time.Time)
-		*sel.Until = time.Unix(*r.Until, 0).UTC()
-	}
+	sel.Since = TimeFromProtobuf(r.Since, r.SinceMs)
+	sel.Until = TimeFromProtobuf(r.Until, r.UntilMs)
 
 	if r.Count != nil {
 		count := new(int)
@@ -94,138 +73,632 @@ func (s *ChatServer) GetMessages(ctx context.Context, r *chats.GetMessagesReques
 		sel.Count = count
 	}
 
-	messages, err := s.chats.GetMessages(ctx, claims, sel)
+	sel.Before = r.BeforeCursor
+	sel.After = r.AfterCursor
+	sel.Around = r.AroundMessageId
+	sel.RootsOnly = r.RootsOnly
+
+	err := s.validate.Struct(sel)
+
+	if err != nil {
+		return nil, err
+	}
+
+	page, err := s.chats.GetMessages(ctx, claims, sel)
 
 	if err != nil {
-		return nil, wrapError(err)
+		return nil, err
 	}
 
 	res := &chats.GetMessagesResponse{
-		Messages: make([]*chats.Message, len(messages)),
-	}
-
-	for i, msg := range messages {
-		res.Messages[i] = &chats.Message{
-			MessageId:   msg.MessageID,
-			FromUser:    msg.FromUser,
-			ChatId:      msg.ChatID,
-			Timestamp:   msg.SendingTime.Unix(),
-			Text:        msg.Text,
-			ReplyTo:     msg.ReplyTo,
-			Attachments: nil,
-		}
+		Messages:   make([]*chats.Message, len(page.Messages)),
+		PrevCursor: page.PrevCursor,
+		NextCursor: page.NextCursor,
+	}
+
+	for i := range page.Messages {
+		res.Messages[i] = MessageFromModel(&page.Messages[i])
 	}
 	return res, nil
 }
 
-func (s *ChatServer) CreateChat(ctx context.Context, r *chats.CreateChatRequest) (*emptypb.Empty, error) {
+func (s *ChatServer) CreateChat(ctx context.Context, r *chats.CreateChatRequest) (*chats.GetChatResponse, error) {
+
+	claims := UserFromContext(ctx)
 
-	claims, err := s.auth.GetUser(ctx)
+	err := s.validate.Var(r.ChatId, "uuid")
 
 	if err != nil {
-		return nil, wrapError(err)
+		return nil, err
 	}
 
-	err = s.validate.Var(r.ChatId, "uuid")
+	info := models.ChatInfo{
+		Title:        r.Title,
+		Description:  r.Description,
+		AvatarFileID: r.AvatarFileId,
+	}
+	err = s.validate.Struct(info)
 
 	if err != nil {
-		return nil, wrapError(err)
+		return nil, err
 	}
 
-	err = s.chats.CreateChat(ctx, claims, models.ChatCreate{
+	chat, err := s.chats.CreateChat(ctx, claims, models.ChatCreate{
 		ChatID:   r.ChatId,
 		IsDirect: r.IsDirect,
 		Members:  r.Members,
+		ChatInfo: info,
 	})
 
 	if err != nil {
-		return nil, wrapError(err)
+		return nil, err
 	}
 
-	return NoReturn, nil
+	return ChatFromModel(chat), nil
 }
 
-func (s *ChatServer) GetChat(ctx context.Context, r *chats.GetChatRequest) (*chats.GetChatResponse, error) {
-	claims, err := s.auth.GetUser(ctx)
+func (s *ChatServer) GetOrCreateDirectChat(ctx context.Context, r *chats.GetOrCreateDirectChatRequest) (*chats.GetOrCreateDirectChatResponse, error) {
+	claims := UserFromContext(ctx)
+
+	err := s.validate.Var(r.ChatId, "uuid")
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.validate.Var(r.Username, "required")
+
+	if err != nil {
+		return nil, err
+	}
+
+	chatId, created, err := s.chats.GetOrCreateDirectChat(ctx, claims, r.ChatId, r.Username)
 
 	if err != nil {
-		return nil, wrapError(err)
+		return nil, err
 	}
 
+	return &chats.GetOrCreateDirectChatResponse{
+		ChatId:  chatId,
+		Created: created,
+	}, nil
+}
+
+func (s *ChatServer) GetChat(ctx context.Context, r *chats.GetChatRequest) (*chats.GetChatResponse, error) {
+	claims := UserFromContext(ctx)
+
 	chat, err := s.chats.GetChatWithMembers(ctx, claims, r.ChatId)
 
 	if err != nil {
-		return nil, wrapError(err)
+		return nil, err
 	}
 
-	res := &chats.GetChatResponse{
-		ChatId:       chat.ChatID,
-		MembersCount: int32(chat.MembersCount),
-		Members:      make([]string, len(chat.Members)),
+	return ChatFromModel(chat), nil
+}
+
+func (s *ChatServer) UpdateChatInfo(ctx context.Context, r *chats.UpdateChatInfoRequest) (*emptypb.Empty, error) {
+	claims := UserFromContext(ctx)
+
+	update := models.ChatInfoUpdate{
+		ChatID: r.ChatId,
+		ChatInfo: models.ChatInfo{
+			Title:        r.Title,
+			Description:  r.Description,
+			AvatarFileID: r.AvatarFileId,
+		},
 	}
+	err := s.validate.Struct(update)
 
-	for i, member := range chat.Members {
-		res.Members[i] = member.UserID
+	if err != nil {
+		return nil, err
 	}
 
-	return res, nil
+	err = s.chats.UpdateChatInfo(ctx, claims, update)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return NoReturn, nil
 }
 
 func (s *ChatServer) DeleteChat(ctx context.Context, r *chats.DeleteChatRequest) (*emptypb.Empty, error) {
-	//TODO implement me
-	panic("implement me")
-}
+	claims := UserFromContext(ctx)
 
-func (s *ChatServer) AddChatMembers(ctx context.Context, r *chats.AddChatMembersRequest) (*emptypb.Empty, error) {
-	claims, err := s.auth.GetUser(ctx)
+	err := s.validate.Var(r.ChatId, "uuid")
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.chats.DeleteChat(ctx, claims, r.ChatId)
 
 	if err != nil {
-		return nil, wrapError(err)
+		return nil, err
 	}
 
-	err = s.chats.AddChatMembers(ctx, claims, r.ChatId, r.Members)
-	return NoReturn, wrapError(err)
+	return NoReturn, nil
 }
 
-func (s *ChatServer) DeleteChatMembers(ctx context.Context, r *chats.DeleteChatMembersRequest) (*emptypb.Empty, error) {
-	claims, err := s.auth.GetUser(ctx)
+func (s *ChatServer) LeaveChat(ctx context.Context, r *chats.LeaveChatRequest) (*emptypb.Empty, error) {
+	claims := UserFromContext(ctx)
+
+	err := s.validate.Var(r.ChatId, "uuid")
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.chats.LeaveChat(ctx, claims, r.ChatId)
 
 	if err != nil {
-		return nil, wrapError(err)
+		return nil, err
 	}
 
-	err = s.chats.DeleteChatMembers(ctx, claims, r.ChatId, r.Members)
-	return NoReturn, wrapError(err)
+	return NoReturn, nil
+}
+
+func (s *ChatServer) AddChatMembers(ctx context.Context, r *chats.AddChatMembersRequest) (*emptypb.Empty, error) {
+	claims := UserFromContext(ctx)
+
+	err := s.chats.AddChatMembers(ctx, claims, r.ChatId, r.Members)
+	return NoReturn, err
+}
+
+func (s *ChatServer) DeleteChatMembers(ctx context.Context, r *chats.DeleteChatMembersRequest) (*emptypb.Empty, error) {
+	claims := UserFromContext(ctx)
+
+	err := s.chats.DeleteChatMembers(ctx, claims, r.ChatId, r.Members)
+	return NoReturn, err
+}
+
+func (s *ChatServer) PromoteChatMember(ctx context.Context, r *chats.ChangeMemberRoleRequest) (*emptypb.Empty, error) {
+	return s.setMemberRole(ctx, r, models.RoleAdmin)
+}
+
+func (s *ChatServer) DemoteChatMember(ctx context.Context, r *chats.ChangeMemberRoleRequest) (*emptypb.Empty, error) {
+	return s.setMemberRole(ctx, r, models.RoleMember)
 }
 
-func (s *ChatServer) SendMessage(ctx context.Context, r *chats.SendMessageRequest) (*emptypb.Empty, error) {
-	// TODO: Handle attachments
+func (s *ChatServer) setMemberRole(ctx context.Context, r *chats.ChangeMemberRoleRequest, role models.ChatRole) (*emptypb.Empty, error) {
+	claims := UserFromContext(ctx)
+
+	err := s.validate.Var(r.ChatId, "uuid")
+
+	if err != nil {
+		return nil, err
+	}
 
-	user, err := s.auth.GetUser(ctx)
+	err = s.chats.SetMemberRole(ctx, claims, r.ChatId, r.Username, role)
 
 	if err != nil {
-		return nil, wrapError(err)
+		return nil, err
 	}
 
+	return NoReturn, nil
+}
+
+func (s *ChatServer) SendMessage(ctx context.Context, r *chats.SendMessageRequest) (*chats.Message, error) {
+	user := UserFromContext(ctx)
+
 	msg := models.MessageSend{
 		MessageID:   r.MessageId,
 		ChatID:      r.ChatId,
 		Text:        r.Text,
 		ReplyTo:     r.ReplyTo,
-		Attachments: nil,
+		Attachments: AttachmentsToModel(r.Attachments),
 	}
-	err = s.validate.Struct(msg)
+	err := s.validate.Struct(msg)
 
 	if err != nil {
-		return nil, wrapError(err)
+		return nil, err
 	}
 
-	err = s.chats.SendMessage(ctx, user, msg)
+	sent, err := s.chats.SendMessage(ctx, user, msg)
 
 	if err != nil {
-		return nil, wrapError(err)
+		return nil, err
+	}
+	return MessageFromModel(sent), nil
+}
+
+func (s *ChatServer) EditMessage(ctx context.Context, r *chats.EditMessageRequest) (*emptypb.Empty, error) {
+	user := UserFromContext(ctx)
+
+	edit := models.MessageEdit{
+		MessageID: r.MessageId,
+		Text:      r.Text,
+	}
+	err := s.validate.Struct(edit)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.chats.EditMessage(ctx, user, edit)
+
+	if err != nil {
+		return nil, err
+	}
+	return NoReturn, nil
+}
+
+func (s *ChatServer) DeleteMessages(ctx context.Context, r *chats.DeleteMessagesRequest) (*emptypb.Empty, error) {
+	user := UserFromContext(ctx)
+
+	del := models.MessagesDelete{
+		ChatID:     r.ChatId,
+		MessageIDs: r.MessageIds,
+		Scope:      DeletionScopeToModel(r.Scope),
+	}
+	err := s.validate.Struct(del)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.chats.DeleteMessages(ctx, user, del)
+
+	if err != nil {
+		return nil, err
+	}
+	return NoReturn, nil
+}
+
+func (s *ChatServer) AddReaction(ctx context.Context, r *chats.ReactionRequest) (*emptypb.Empty, error) {
+	return s.changeReaction(ctx, r, true)
+}
+
+func (s *ChatServer) RemoveReaction(ctx context.Context, r *chats.ReactionRequest) (*emptypb.Empty, error) {
+	return s.changeReaction(ctx, r, false)
+}
+
+func (s *ChatServer) changeReaction(ctx context.Context, r *chats.ReactionRequest, add bool) (*emptypb.Empty, error) {
+	user := UserFromContext(ctx)
+
+	reaction := models.ReactionChange{
+		MessageID: r.MessageId,
+		Reaction:  r.Reaction,
+	}
+	err := s.validate.Struct(reaction)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if add {
+		err = s.chats.AddReaction(ctx, user, reaction)
+	} else {
+		err = s.chats.RemoveReaction(ctx, user, reaction)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return NoReturn, nil
+}
+
+func (s *ChatServer) PinMessage(ctx context.Context, r *chats.PinMessageRequest) (*emptypb.Empty, error) {
+	return s.changePin(ctx, r, true)
+}
+
+func (s *ChatServer) UnpinMessage(ctx context.Context, r *chats.PinMessageRequest) (*emptypb.Empty, error) {
+	return s.changePin(ctx, r, false)
+}
+
+func (s *ChatServer) changePin(ctx context.Context, r *chats.PinMessageRequest, pin bool) (*emptypb.Empty, error) {
+	user := UserFromContext(ctx)
+
+	change := models.PinChange{
+		ChatID:    r.ChatId,
+		MessageID: r.MessageId,
+	}
+	err := s.validate.Struct(change)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if pin {
+		err = s.chats.PinMessage(ctx, user, change)
+	} else {
+		err = s.chats.UnpinMessage(ctx, user, change)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return NoReturn, nil
+}
+
+func (s *ChatServer) GetPinnedMessages(ctx context.Context, r *chats.GetPinnedMessagesRequest) (*chats.GetPinnedMessagesResponse, error) {
+	user := UserFromContext(ctx)
+
+	err := s.validate.Var(r.ChatId, "uuid")
+
+	if err != nil {
+		return nil, err
+	}
+
+	pinned, err := s.chats.GetPinnedMessages(ctx, user, r.ChatId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	res := &chats.GetPinnedMessagesResponse{
+		Pins: make([]*chats.PinnedMessage, len(pinned)),
+	}
+	for i := range pinned {
+		res.Pins[i] = &chats.PinnedMessage{
+			Pin:     PinFromModel(&pinned[i].Pin),
+			Message: MessageFromModel(&pinned[i].Message),
+		}
+	}
+	return res, nil
+}
+
+func (s *ChatServer) ForwardMessages(ctx context.Context, r *chats.ForwardMessagesRequest) (*chats.ForwardMessagesResponse, error) {
+	user := UserFromContext(ctx)
+
+	fwd := models.MessagesForward{
+		FromChatID: r.FromChatId,
+		ToChatID:   r.ToChatId,
+		MessageIDs: r.MessageIds,
+	}
+	err := s.validate.Struct(fwd)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := s.chats.ForwardMessages(ctx, user, fwd)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &chats.ForwardMessagesResponse{
+		MessageIds: ids,
+	}, nil
+}
+
+func (s *ChatServer) MarkRead(ctx context.Context, r *chats.MarkReadRequest) (*emptypb.Empty, error) {
+	user := UserFromContext(ctx)
+
+	mark := models.ReadMark{
+		ChatID:    r.ChatId,
+		MessageID: r.MessageId,
+	}
+	err := s.validate.Struct(mark)
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.chats.MarkRead(ctx, user, mark)
+
+	if err != nil {
+		return nil, err
+	}
+	return NoReturn, nil
+}
+
+func (s *ChatServer) GetThread(ctx context.Context, r *chats.GetThreadRequest) (*chats.GetThreadResponse, error) {
+	user := UserFromContext(ctx)
+
+	sel := &models.ThreadSelect{
+		RootID: r.RootMessageId,
+		Before: r.BeforeCursor,
+		After:  r.AfterCursor,
+	}
+
+	if r.Count != nil {
+		count := new(int)
+		*count = int(*r.Count)
+		sel.Count = count
+	}
+
+	err := s.validate.Struct(sel)
+
+	if err != nil {
+		return nil, err
+	}
+
+	page, err := s.chats.GetThread(ctx, user, sel)
+
+	if err != nil {
+		return nil, err
+	}
+
+	res := &chats.GetThreadResponse{
+		Root:       MessageFromModel(&page.Root),
+		Messages:   make([]*chats.Message, len(page.Messages)),
+		PrevCursor: page.PrevCursor,
+		NextCursor: page.NextCursor,
+	}
+
+	for i := range page.Messages {
+		res.Messages[i] = MessageFromModel(&page.Messages[i])
+	}
+	return res, nil
+}
+
+func (s *ChatServer) SearchMessages(ctx context.Context, r *chats.SearchMessagesRequest) (*chats.SearchMessagesResponse, error) {
+	user := UserFromContext(ctx)
+
+	search := &models.MessagesSearch{
+		Query:          r.Query,
+		ChatID:         r.ChatId,
+		FromUser:       r.FromUser,
+		HasAttachments: r.HasAttachments,
+		After:          r.Cursor,
+	}
+
+	search.Since = TimeFromProtobuf(r.Since, r.SinceMs)
+	search.Until = TimeFromProtobuf(r.Until, r.UntilMs)
+
+	if r.Count != nil {
+		count := new(int)
+		*count = int(*r.Count)
+		search.Count = count
+	}
+
+	err := s.validate.Struct(search)
+
+	if err != nil {
+		return nil, err
+	}
+
+	page, err := s.chats.SearchMessages(ctx, user, search)
+
+	if err != nil {
+		return nil, err
+	}
+
+	res := &chats.SearchMessagesResponse{
+		Results:    make([]*chats.SearchResult, len(page.Results)),
+		NextCursor: page.NextCursor,
+	}
+
+	for i := range page.Results {
+		res.Results[i] = &chats.SearchResult{
+			Message: MessageFromModel(&page.Results[i].Message),
+			Snippet: page.Results[i].Snippet,
+		}
+	}
+	return res, nil
+}
+
+func (s *ChatServer) GetMessageReadBy(ctx context.Context, r *chats.GetMessageReadByRequest) (*chats.GetMessageReadByResponse, error) {
+	user := UserFromContext(ctx)
+
+	err := s.validate.Var(r.MessageId, "uuid")
+
+	if err != nil {
+		return nil, err
+	}
+
+	readBy, err := s.chats.GetMessageReadBy(ctx, user, r.MessageId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &chats.GetMessageReadByResponse{
+		Usernames: readBy,
+	}, nil
+}
+
+func (s *ChatServer) SetReadReceipts(ctx context.Context, r *chats.SetReadReceiptsRequest) (*emptypb.Empty, error) {
+	user := UserFromContext(ctx)
+
+	err := s.validate.Var(r.ChatId, "uuid")
+
+	if err != nil {
+		return nil, err
+	}
+
+	err = s.chats.SetReadReceipts(ctx, user, r.ChatId, r.Enabled)
+
+	if err != nil {
+		return nil, err
+	}
+	return NoReturn, nil
+}
+
+func (s *ChatServer) GetMessageRevisions(ctx context.Context, r *chats.GetMessageRevisionsRequest) (*chats.GetMessageRevisionsResponse, error) {
+	user := UserFromContext(ctx)
+
+	err := s.validate.Var(r.MessageId, "uuid")
+
+	if err != nil {
+		return nil, err
+	}
+
+	revisions, err := s.chats.GetMessageRevisions(ctx, user, r.MessageId)
+
+	if err != nil {
+		return nil, err
+	}
+
+	res := &chats.GetMessageRevisionsResponse{
+		MessageId: r.MessageId,
+		Revisions: make([]*chats.MessageRevision, len(revisions)),
+	}
+
+	for i := range revisions {
+		res.Revisions[i] = RevisionFromModel(&revisions[i])
+	}
+	return res, nil
+}
+
+func (s *ChatServer) GetDifference(ctx context.Context, r *chats.GetDifferenceRequest) (*chats.GetDifferenceResponse, error) {
+	user := UserFromContext(ctx)
+
+	sel := &models.DifferenceSelect{FromPts: r.FromPts}
+
+	if r.Limit != nil {
+		limit := new(int)
+		*limit = int(*r.Limit)
+		sel.Limit = limit
+	}
+
+	err := s.validate.Struct(sel)
+
+	if err != nil {
+		return nil, err
+	}
+
+	diff, err := s.chats.GetDifference(ctx, user, sel)
+
+	if err != nil {
+		return nil, err
+	}
+
+	res := &chats.GetDifferenceResponse{
+		Updates: make([]*chats.DifferenceUpdate, len(diff.Updates)),
+		Pts:     diff.Pts,
+		TooLong: diff.TooLong,
+		HasMore: diff.HasMore,
+	}
+
+	for i := range diff.Updates {
+		res.Updates[i], err = UserUpdateFromModel(&diff.Updates[i])
+
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func (s *ChatServer) SubscribeUpdates(r *chats.SubscribeUpdatesRequest, stream chats.Chat_SubscribeUpdatesServer) error {
+	ctx := stream.Context()
+	user := UserFromContext(ctx)
+
+	sub, err := s.chats.SubscribeUpdates(ctx, user)
+
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case update, ok := <-sub.Updates():
+			if !ok && errors.Is(sub.Err(), broker.ErrBrokerClosed) {
+				return status.Error(codes.Unavailable, "server is shutting down, resubscribe and resync with GetDifference")
+			} else if !ok {
+				return status.Error(codes.Aborted, "updates stream is overflowed, resync with GetDifference")
+			}
+
+			if err = stream.Send(update); err != nil {
+				return err
+			}
+		}
 	}
-	return NoReturn, err
 }
 
 func wrapError(err error) error {
@@ -234,6 +707,10 @@ func wrapError(err error) error {
 		return nil
 	}
 
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
 	errorMapper := []struct {
 		from error
 		to   error
@@ -242,10 +719,50 @@ func wrapError(err error) error {
 			from: storage.ErrChatAlreadyExists,
 			to:   status.Error(codes.AlreadyExists, err.Error()),
 		},
+		{
+			from: storage.ErrMessageAlreadyExists,
+			to:   status.Error(codes.AlreadyExists, err.Error()),
+		},
+		{
+			from: storage.ErrDirectChatExists,
+			to:   status.Error(codes.AlreadyExists, err.Error()),
+		},
 		{
 			from: storage.ErrChatNotFound,
 			to:   status.Error(codes.NotFound, err.Error()),
 		},
+		{
+			from: storage.ErrMessageNotFound,
+			to:   status.Error(codes.NotFound, err.Error()),
+		},
+		{
+			from: storage.ErrRepliedMessageNotFound,
+			to:   status.Error(codes.NotFound, err.Error()),
+		},
+		{
+			from: usecase.ErrReactionNotAllowed,
+			to:   status.Error(codes.InvalidArgument, err.Error()),
+		},
+		{
+			from: usecase.ErrInvalidCursor,
+			to:   status.Error(codes.InvalidArgument, err.Error()),
+		},
+		{
+			from: storage.ErrNotMember,
+			to:   status.Error(codes.NotFound, err.Error()),
+		},
+		{
+			from: usecase.ErrAuthenticationRequired,
+			to:   status.Error(codes.Unauthenticated, err.Error()),
+		},
+		{
+			from: usecase.ErrPermissionDenied,
+			to:   status.Error(codes.PermissionDenied, err.Error()),
+		},
+		{
+			from: usecase.ErrBusinessLogicViolation,
+			to:   status.Error(codes.FailedPrecondition, err.Error()),
+		},
 	}
 
 	if validationErr, ok := err.(validator.ValidationErrors); ok {
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"fmt"
+	"github.com/practice-sem-2/user-service/internal/models"
+	"github.com/practice-sem-2/user-service/internal/pb/chats"
+	storage "github.com/practice-sem-2/user-service/internal/storages"
+	usecase "github.com/practice-sem-2/user-service/internal/usecases"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+func TestWrapError_MessageIdConflict(t *testing.T) {
+	err := wrapError(fmt.Errorf("send message: %w", usecase.ErrMessageIdConflict))
+	assert.Equal(t, codes.AlreadyExists, status.Code(err), "retry with different payload should be rejected as existing message")
+}
+
+func TestWrapError_RepliedMessageNotFound(t *testing.T) {
+	err := wrapError(fmt.Errorf("send message: %w", storage.ErrRepliedMessageNotFound))
+	assert.Equal(t, codes.NotFound, status.Code(err), "reply to a missing message should not be an internal error")
+}
+
+func TestTimeFromProtobuf(t *testing.T) {
+	seconds, millis := int64(1_700_000_000), int64(1_700_000_000_123)
+
+	assert.Nil(t, TimeFromProtobuf(nil, nil), "absent time should stay absent")
+
+	fromSeconds := TimeFromProtobuf(&seconds, nil)
+	require.NotNil(t, fromSeconds)
+	assert.Equal(t, time.Unix(seconds, 0).UTC(), *fromSeconds)
+
+	fromMillis := TimeFromProtobuf(&seconds, &millis)
+	require.NotNil(t, fromMillis)
+	assert.Equal(t, time.UnixMilli(millis).UTC(), *fromMillis, "milliseconds should be preferred")
+	assert.Equal(t, time.UTC, fromMillis.Location())
+}
+
+func TestMessageFromModel_SentMessage(t *testing.T) {
+	replyTo := "root"
+	sendingTime := time.Date(2023, 4, 1, 12, 30, 15, 123456000, time.UTC)
+	res := MessageFromModel(&models.Message{
+		MessageID:    "reply",
+		FromUser:     "alice",
+		ChatID:       "chat",
+		SendingTime:  sendingTime,
+		Text:         "fine",
+		ReplyTo:      &replyTo,
+		ThreadRootID: &replyTo,
+		Attachments:  []models.FileAttachment{{MimeType: "image/png", FileID: "file"}},
+		ReplyPreview: &models.ReplyPreview{MessageID: "root", FromUser: "bob", Text: "how are you?"},
+	})
+
+	assert.Equal(t, "reply", res.MessageId)
+	assert.Equal(t, sendingTime.Unix(), res.Timestamp)
+	assert.Equal(t, sendingTime.UnixMilli(), res.TimestampMs, "sending time should keep milliseconds")
+	assert.Equal(t, &replyTo, res.ThreadRootId)
+	require.Len(t, res.Attachments, 1)
+	assert.Equal(t, "image/png", res.Attachments[0].MimeType)
+	assert.Equal(t, "file", res.Attachments[0].FileId)
+	require.NotNil(t, res.ReplyPreview)
+	assert.Equal(t, "root", res.ReplyPreview.MessageId)
+	assert.Equal(t, "bob", res.ReplyPreview.FromUser)
+	assert.Equal(t, "how are you?", res.ReplyPreview.Text)
+	assert.False(t, res.ReplyPreview.Deleted)
+}
+
+func TestChatFromModel_Members(t *testing.T) {
+	creator := "alice"
+	res := ChatFromModel(&models.ChatWithMembers{
+		Chat: models.Chat{
+			ChatID:       "chat",
+			MembersCount: 2,
+			CreatedBy:    &creator,
+		},
+		Members: []models.ChatMember{
+			{UserID: "alice", Role: models.RoleOwner},
+			{UserID: "bob", Role: models.RoleMember},
+		},
+	})
+
+	assert.Equal(t, "chat", res.ChatId)
+	assert.Equal(t, int32(2), res.MembersCount)
+	assert.Equal(t, &creator, res.CreatedBy)
+	assert.Equal(t, []string{"alice", "bob"}, res.Members)
+	assert.Equal(t, map[string]chats.ChatRole{
+		"alice": chats.ChatRole_CHAT_ROLE_OWNER,
+		"bob":   chats.ChatRole_CHAT_ROLE_MEMBER,
+	}, res.Roles)
+}
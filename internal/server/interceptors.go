@@ -0,0 +1,177 @@
+package server
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/practice-sem-2/auth-tools"
+	"github.com/practice-sem-2/user-service/internal/metrics"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"runtime/debug"
+	"time"
+)
+
+// RequestIDHeader is taken from incoming metadata or generated,
+// it is sent back to the client in response headers
+const RequestIDHeader = "x-request-id"
+
+type claimsKey struct{}
+
+type requestIDKey struct{}
+
+// UserFromContext returns claims of the user authenticated by Interceptors
+func UserFromContext(ctx context.Context) *auth.UserClaims {
+	claims, _ := ctx.Value(claimsKey{}).(*auth.UserClaims)
+	return claims
+}
+
+// RequestIDFromContext returns id of the request being handled
+func RequestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// Authenticator extracts user's claims from request metadata,
+// it is implemented by auth.VerifierService
+type Authenticator interface {
+	GetUser(ctx context.Context) (*auth.UserClaims, error)
+}
+
+// Interceptors handle concerns common to all rpc methods. Every call is
+// logged, panics are recovered, user is authenticated before handler
+// is called and errors returned by handlers are mapped to grpc statuses
+type Interceptors struct {
+	auth   Authenticator
+	logger *logrus.Logger
+}
+
+func NewInterceptors(a Authenticator, logger *logrus.Logger) *Interceptors {
+	return &Interceptors{
+		auth:   a,
+		logger: logger,
+	}
+}
+
+func (i *Interceptors) Unary() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (res interface{}, err error) {
+		start := time.Now()
+		ctx = i.withRequestID(ctx)
+		defer func() {
+			if r := recover(); r != nil {
+				err = i.recovered(ctx, info.FullMethod, r)
+			}
+			i.log(ctx, info.FullMethod, start, err)
+		}()
+
+		ctx, err = i.authenticate(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		res, err = handler(ctx, req)
+		return res, wrapError(err)
+	}
+}
+
+func (i *Interceptors) Stream() grpc.StreamServerInterceptor {
+	return func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) (err error) {
+		start := time.Now()
+		ctx := i.withRequestID(ss.Context())
+		defer func() {
+			if r := recover(); r != nil {
+				err = i.recovered(ctx, info.FullMethod, r)
+			}
+			i.log(ctx, info.FullMethod, start, err)
+		}()
+
+		ctx, err = i.authenticate(ctx)
+		if err != nil {
+			return err
+		}
+
+		err = handler(srv, &serverStream{ServerStream: ss, ctx: ctx})
+		return wrapError(err)
+	}
+}
+
+// withRequestID propagates request id of the client or generates a new one
+func (i *Interceptors) withRequestID(ctx context.Context) context.Context {
+	var id string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if ids := md.Get(RequestIDHeader); len(ids) > 0 {
+			id = ids[0]
+		}
+	}
+
+	if len(id) == 0 {
+		id = uuid.NewString()
+	}
+
+	if err := grpc.SetHeader(ctx, metadata.Pairs(RequestIDHeader, id)); err != nil {
+		i.logger.WithError(err).Warning("can't set request id header")
+	}
+
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+func (i *Interceptors) authenticate(ctx context.Context) (context.Context, error) {
+	claims, err := i.auth.GetUser(ctx)
+	if err != nil {
+		if _, ok := status.FromError(err); !ok {
+			err = status.Error(codes.Unauthenticated, err.Error())
+		}
+		return ctx, err
+	}
+
+	return context.WithValue(ctx, claimsKey{}, claims), nil
+}
+
+func (i *Interceptors) recovered(ctx context.Context, method string, r interface{}) error {
+	i.logger.
+		WithField("method", method).
+		WithField("request_id", RequestIDFromContext(ctx)).
+		WithField("panic", r).
+		WithField("stack", string(debug.Stack())).
+		Error("panic during handling request")
+
+	return status.Error(codes.Internal, "internal error")
+}
+
+func (i *Interceptors) log(ctx context.Context, method string, start time.Time, err error) {
+	code := status.Code(err)
+	latency := time.Since(start)
+	metrics.RPCRequests.WithLabelValues(method, code.String()).Inc()
+	metrics.RPCDuration.WithLabelValues(method, code.String()).Observe(latency.Seconds())
+
+	entry := i.logger.
+		WithField("method", method).
+		WithField("request_id", RequestIDFromContext(ctx)).
+		WithField("latency", latency.String()).
+		WithField("code", code.String())
+
+	if claims := UserFromContext(ctx); claims != nil {
+		entry = entry.WithField("user", claims.Username)
+	}
+
+	switch code {
+	case codes.OK:
+		entry.Info("request handled")
+	case codes.Internal, codes.Unknown, codes.DataLoss, codes.Unavailable:
+		entry.WithError(err).Error("request failed")
+	default:
+		entry.WithError(err).Warning("request failed")
+	}
+}
+
+// serverStream replaces stream context with the authenticated one
+type serverStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStream) Context() context.Context {
+	return s.ctx
+}
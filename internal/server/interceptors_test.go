@@ -0,0 +1,199 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"github.com/practice-sem-2/auth-tools"
+	"github.com/practice-sem-2/user-service/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"io"
+	"testing"
+)
+
+const testMethod = "/chats.Chat/Test"
+
+type fakeAuthenticator struct {
+	claims *auth.UserClaims
+	err    error
+}
+
+func (a *fakeAuthenticator) GetUser(context.Context) (*auth.UserClaims, error) {
+	return a.claims, a.err
+}
+
+// transportStream records headers set by interceptors
+type transportStream struct {
+	header metadata.MD
+}
+
+func (s *transportStream) Method() string { return testMethod }
+
+func (s *transportStream) SetHeader(md metadata.MD) error {
+	s.header = metadata.Join(s.header, md)
+	return nil
+}
+
+func (s *transportStream) SendHeader(md metadata.MD) error { return s.SetHeader(md) }
+
+func (s *transportStream) SetTrailer(metadata.MD) error { return nil }
+
+func newTestInterceptors(a Authenticator) *Interceptors {
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	return NewInterceptors(a, logger)
+}
+
+func newTestContext(md metadata.MD) (context.Context, *transportStream) {
+	stream := &transportStream{}
+	ctx := grpc.NewContextWithServerTransportStream(context.Background(), stream)
+	return metadata.NewIncomingContext(ctx, md), stream
+}
+
+func TestInterceptors_Unary_RecoversPanic(t *testing.T) {
+	i := newTestInterceptors(&fakeAuthenticator{claims: &auth.UserClaims{Username: "alice"}})
+	ctx, _ := newTestContext(metadata.MD{})
+
+	res, err := i.Unary()(ctx, nil, &grpc.UnaryServerInfo{FullMethod: testMethod},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			panic("bang")
+		})
+
+	assert.Nil(t, res)
+	assert.Equal(t, codes.Internal, status.Code(err), "panic should be returned as internal error")
+}
+
+func TestInterceptors_Unary_PropagatesRequestID(t *testing.T) {
+	i := newTestInterceptors(&fakeAuthenticator{claims: &auth.UserClaims{Username: "alice"}})
+	ctx, stream := newTestContext(metadata.Pairs(RequestIDHeader, "request-1"))
+
+	var handled string
+	_, err := i.Unary()(ctx, nil, &grpc.UnaryServerInfo{FullMethod: testMethod},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			handled = RequestIDFromContext(ctx)
+			return nil, nil
+		})
+
+	require.NoError(t, err)
+	assert.Equal(t, "request-1", handled, "handler should see request id of the client")
+	assert.Equal(t, []string{"request-1"}, stream.header.Get(RequestIDHeader), "request id should be sent back")
+}
+
+func TestInterceptors_Unary_GeneratesRequestID(t *testing.T) {
+	i := newTestInterceptors(&fakeAuthenticator{claims: &auth.UserClaims{Username: "alice"}})
+	ctx, stream := newTestContext(metadata.MD{})
+
+	var handled string
+	_, err := i.Unary()(ctx, nil, &grpc.UnaryServerInfo{FullMethod: testMethod},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			handled = RequestIDFromContext(ctx)
+			return nil, nil
+		})
+
+	require.NoError(t, err)
+	assert.NotEmpty(t, handled, "request id should be generated")
+	assert.Equal(t, []string{handled}, stream.header.Get(RequestIDHeader), "generated request id should be sent back")
+}
+
+func TestInterceptors_Unary_Authenticates(t *testing.T) {
+	claims := &auth.UserClaims{Username: "alice"}
+	i := newTestInterceptors(&fakeAuthenticator{claims: claims})
+	ctx, _ := newTestContext(metadata.MD{})
+
+	var user *auth.UserClaims
+	_, err := i.Unary()(ctx, nil, &grpc.UnaryServerInfo{FullMethod: testMethod},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			user = UserFromContext(ctx)
+			return nil, nil
+		})
+
+	require.NoError(t, err)
+	assert.Same(t, claims, user, "handler should get authenticated user")
+}
+
+func TestInterceptors_Unary_RejectsUnauthenticated(t *testing.T) {
+	i := newTestInterceptors(&fakeAuthenticator{err: errors.New("token is expired")})
+	ctx, _ := newTestContext(metadata.MD{})
+
+	called := false
+	_, err := i.Unary()(ctx, nil, &grpc.UnaryServerInfo{FullMethod: testMethod},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			called = true
+			return nil, nil
+		})
+
+	assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	assert.False(t, called, "handler should not be called")
+}
+
+func TestInterceptors_Unary_MapsErrors(t *testing.T) {
+	i := newTestInterceptors(&fakeAuthenticator{claims: &auth.UserClaims{Username: "alice"}})
+	ctx, _ := newTestContext(metadata.MD{})
+
+	_, err := i.Unary()(ctx, nil, &grpc.UnaryServerInfo{FullMethod: testMethod},
+		func(ctx context.Context, req interface{}) (interface{}, error) {
+			return nil, errors.New("unexpected")
+		})
+
+	assert.Equal(t, codes.Internal, status.Code(err), "handler errors should be mapped to statuses")
+}
+
+type serverStreamStub struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *serverStreamStub) Context() context.Context {
+	return s.ctx
+}
+
+func TestInterceptors_Stream_RecoversPanicAndAuthenticates(t *testing.T) {
+	claims := &auth.UserClaims{Username: "alice"}
+	i := newTestInterceptors(&fakeAuthenticator{claims: claims})
+	ctx, _ := newTestContext(metadata.MD{})
+
+	err := i.Stream()(nil, &serverStreamStub{ctx: ctx}, &grpc.StreamServerInfo{FullMethod: testMethod},
+		func(srv interface{}, stream grpc.ServerStream) error {
+			assert.Same(t, claims, UserFromContext(stream.Context()), "stream context should be authenticated")
+			panic("bang")
+		})
+
+	assert.Equal(t, codes.Internal, status.Code(err), "panic should be returned as internal error")
+}
+
+func TestInterceptors_Unary_RecordsMetrics(t *testing.T) {
+	const method = "/chats.Chat/TestMetrics"
+	i := newTestInterceptors(&fakeAuthenticator{claims: &auth.UserClaims{Username: "alice"}})
+	ctx, _ := newTestContext(metadata.MD{})
+	info := &grpc.UnaryServerInfo{FullMethod: method}
+
+	_, err := i.Unary()(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, nil
+	})
+	require.NoError(t, err)
+
+	_, err = i.Unary()(ctx, nil, info, func(ctx context.Context, req interface{}) (interface{}, error) {
+		return nil, status.Error(codes.NotFound, "not found")
+	})
+	require.Error(t, err)
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.RPCRequests.WithLabelValues(method, codes.OK.String())))
+	assert.Equal(t, 1.0, testutil.ToFloat64(metrics.RPCRequests.WithLabelValues(method, codes.NotFound.String())))
+	assert.Equal(t, uint64(1), histogramCount(t, metrics.RPCDuration.WithLabelValues(method, codes.OK.String())))
+	assert.Equal(t, uint64(1), histogramCount(t, metrics.RPCDuration.WithLabelValues(method, codes.NotFound.String())))
+}
+
+// histogramCount returns how many values were observed by histogram
+func histogramCount(t *testing.T, o prometheus.Observer) uint64 {
+	m := &dto.Metric{}
+	require.NoError(t, o.(prometheus.Metric).Write(m))
+	return m.GetHistogram().GetSampleCount()
+}
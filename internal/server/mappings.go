@@ -3,6 +3,8 @@ package server
 import (
 	"github.com/practice-sem-2/user-service/internal/models"
 	"github.com/practice-sem-2/user-service/internal/pb/chats"
+	"github.com/practice-sem-2/user-service/internal/pb/chats/updates"
+	"google.golang.org/protobuf/proto"
 	"time"
 )
 
@@ -13,6 +15,194 @@ func AttachmentToModel(a *chats.FileAttachment) *models.FileAttachment {
 	}
 }
 
+func AttachmentsToModel(attachments []*chats.FileAttachment) []models.FileAttachment {
+	// nil is kept so that validation can tell a message without attachments
+	if len(attachments) == 0 {
+		return nil
+	}
+	res := make([]models.FileAttachment, len(attachments))
+	for i, att := range attachments {
+		res[i] = *AttachmentToModel(att)
+	}
+	return res
+}
+
+func AttachmentFromModel(a *models.FileAttachment) *chats.FileAttachment {
+	return &chats.FileAttachment{
+		MimeType: a.MimeType,
+		FileId:   a.FileID,
+	}
+}
+
+func AttachmentsFromModel(attachments []models.FileAttachment) []*chats.FileAttachment {
+	res := make([]*chats.FileAttachment, len(attachments))
+	for i := range attachments {
+		res[i] = AttachmentFromModel(&attachments[i])
+	}
+	return res
+}
+
+func ReactionsFromModel(reactions []models.Reaction) []*chats.Reaction {
+	res := make([]*chats.Reaction, len(reactions))
+	for i, r := range reactions {
+		res[i] = &chats.Reaction{
+			Reaction: r.Reaction,
+			Count:    r.Count,
+			Reacted:  r.Reacted,
+		}
+	}
+	return res
+}
+
+// TimeFromProtobuf prefers time in milliseconds, time in seconds
+// is still accepted from old clients
+func TimeFromProtobuf(seconds *int64, millis *int64) *time.Time {
+	var t time.Time
+	switch {
+	case millis != nil:
+		t = time.UnixMilli(*millis).UTC()
+	case seconds != nil:
+		t = time.Unix(*seconds, 0).UTC()
+	default:
+		return nil
+	}
+	return &t
+}
+
+func MessageFromModel(msg *models.Message) *chats.Message {
+	res := &chats.Message{
+		MessageId:   msg.MessageID,
+		FromUser:    msg.FromUser,
+		ChatId:      msg.ChatID,
+		Timestamp:   msg.SendingTime.UTC().Unix(),
+		TimestampMs: msg.SendingTime.UTC().UnixMilli(),
+		Text:        msg.Text,
+		ReplyTo:     msg.ReplyTo,
+		Attachments: AttachmentsFromModel(msg.Attachments),
+		Reactions:   ReactionsFromModel(msg.Reactions),
+
+		ThreadRootId: msg.ThreadRootID,
+		ReplyCount:   msg.ReplyCount,
+	}
+
+	if msg.LastReplyAt != nil {
+		res.LastReplyAt, res.LastReplyAtMs = timeToProtobuf(*msg.LastReplyAt)
+	}
+
+	if msg.ForwardedFromUser != nil {
+		res.ForwardedFrom = &chats.ForwardOrigin{
+			ChatId:    msg.ForwardedFromChat,
+			MessageId: msg.ForwardedFromMessage,
+			FromUser:  *msg.ForwardedFromUser,
+		}
+		if msg.ForwardedSendingTime != nil {
+			res.ForwardedFrom.SendingTime = msg.ForwardedSendingTime.UTC().Unix()
+			res.ForwardedFrom.SendingTimeMs = msg.ForwardedSendingTime.UTC().UnixMilli()
+		}
+	}
+
+	if msg.ReplyPreview != nil {
+		res.ReplyPreview = &chats.ReplyPreview{
+			MessageId: msg.ReplyPreview.MessageID,
+			FromUser:  msg.ReplyPreview.FromUser,
+			Text:      msg.ReplyPreview.Text,
+			Deleted:   msg.ReplyPreview.Deleted,
+		}
+	}
+
+	if msg.EditedAt != nil {
+		res.EditedAt, res.EditedAtMs = timeToProtobuf(*msg.EditedAt)
+	}
+
+	if msg.DeletedAt != nil {
+		res.DeletedAt, res.DeletedAtMs = timeToProtobuf(*msg.DeletedAt)
+	}
+
+	return res
+}
+
+// timeToProtobuf returns optional time in seconds for old clients
+// and in milliseconds
+func timeToProtobuf(t time.Time) (seconds *int64, millis *int64) {
+	s, ms := t.UTC().Unix(), t.UTC().UnixMilli()
+	return &s, &ms
+}
+
+func ChatFromModel(chat *models.ChatWithMembers) *chats.GetChatResponse {
+	res := &chats.GetChatResponse{
+		ChatId:       chat.ChatID,
+		MembersCount: int32(chat.MembersCount),
+		Members:      make([]string, len(chat.Members)),
+		Roles:        make(map[string]chats.ChatRole, len(chat.Members)),
+		IsDirect:     chat.IsDirect,
+		Title:        chat.Title,
+		Description:  chat.Description,
+		AvatarFileId: chat.AvatarFileID,
+		CreatedAt:    chat.CreatedAt.UTC().Unix(),
+		CreatedAtMs:  chat.CreatedAt.UTC().UnixMilli(),
+		CreatedBy:    chat.CreatedBy,
+		ReadReceipts: chat.ReadReceipts,
+		LastPin:      PinFromModel(chat.LastPin),
+	}
+
+	for i, member := range chat.Members {
+		res.Members[i] = member.UserID
+		res.Roles[member.UserID] = RoleFromModel(member.Role)
+	}
+
+	return res
+}
+
+func PinFromModel(pin *models.Pin) *chats.Pin {
+	if pin == nil {
+		return nil
+	}
+	return &chats.Pin{
+		MessageId:  pin.MessageID,
+		PinnedBy:   pin.PinnedBy,
+		PinnedAt:   pin.PinnedAt.UTC().Unix(),
+		PinnedAtMs: pin.PinnedAt.UTC().UnixMilli(),
+	}
+}
+
+func RevisionFromModel(rev *models.MessageRevision) *chats.MessageRevision {
+	return &chats.MessageRevision{
+		Text:        rev.Text,
+		RevisedAt:   rev.RevisedAt.UTC().Unix(),
+		RevisedAtMs: rev.RevisedAt.UTC().UnixMilli(),
+	}
+}
+
+func UserUpdateFromModel(upd *models.UserUpdate) (*chats.DifferenceUpdate, error) {
+	update := &updates.Update{}
+	if err := proto.Unmarshal(upd.Payload, update); err != nil {
+		return nil, err
+	}
+
+	return &chats.DifferenceUpdate{
+		Pts:    upd.Pts,
+		Update: update,
+	}, nil
+}
+
+func RoleFromModel(role models.ChatRole) chats.ChatRole {
+	switch role {
+	case models.RoleOwner:
+		return chats.ChatRole_CHAT_ROLE_OWNER
+	case models.RoleAdmin:
+		return chats.ChatRole_CHAT_ROLE_ADMIN
+	default:
+		return chats.ChatRole_CHAT_ROLE_MEMBER
+	}
+}
+
+func DeletionScopeToModel(scope chats.DeletionScope) models.DeletionScope {
+	if scope == chats.DeletionScope_DELETE_FOR_EVERYONE {
+		return models.DeleteForEveryone
+	}
+	return models.DeleteForMe
+}
+
 func SendMessageToModel(username string, time time.Time, message *chats.SendMessageRequest) *models.Message {
 	return &models.Message{
 		MessageID:   message.MessageId,
@@ -21,6 +211,6 @@ func SendMessageToModel(username string, time time.Time, message *chats.SendMess
 		SendingTime: time,
 		Text:        message.Text,
 		ReplyTo:     message.ReplyTo,
-		Attachments: nil,
+		Attachments: AttachmentsToModel(message.Attachments),
 	}
 }
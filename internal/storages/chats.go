@@ -4,8 +4,11 @@ import (
 	"context"
 	"database/sql"
 	"errors"
+	"fmt"
 	sq "github.com/Masterminds/squirrel"
 	"github.com/practice-sem-2/user-service/internal/models"
+	"html"
+	"strings"
 	"time"
 )
 
@@ -17,6 +20,7 @@ var (
 	ErrMessageAlreadyExists   = errors.New("message with provided message_id already exists")
 	ErrMessageNotFound        = errors.New("message does not exist")
 	ErrNotMember              = errors.New("user is not a member")
+	ErrDirectChatExists       = errors.New("direct chat between these users already exists")
 )
 
 const (
@@ -25,6 +29,8 @@ const (
 	MessagesPrimaryKey          = "messages_pkey"
 	MessagesReplyToForeignKey   = "messages_reply_to_fkey"
 	MessagesChatIdForeignKey    = "messages_chat_id_fkey"
+	DirectChatsUsersKey         = "direct_chats_users_key"
+	ReactionsMessageForeignKey  = "message_reactions_message_id_fkey"
 )
 
 type ChatsStorage struct {
@@ -37,10 +43,25 @@ func NewChatsStorage(db Scope) *ChatsStorage {
 	}
 }
 
-func (s *ChatsStorage) CreateChat(ctx context.Context, chatId string, isDirect bool) error {
+type CreateChatOptions struct {
+	CreatedBy string
+	Info      models.ChatInfo
+}
+
+func (s *ChatsStorage) CreateChat(ctx context.Context, chatId string, isDirect bool, options ...CreateChatOptions) error {
+	option := CreateChatOptions{}
+	if len(options) > 0 {
+		option = options[0]
+	}
+
+	var createdBy *string
+	if len(option.CreatedBy) > 0 {
+		createdBy = &option.CreatedBy
+	}
+
 	query, args, err := sq.Insert("chats").
-		Columns("chat_id", "is_direct").
-		Values(chatId, isDirect).
+		Columns("chat_id", "is_direct", "title", "description", "avatar_file_id", "created_by").
+		Values(chatId, isDirect, option.Info.Title, option.Info.Description, option.Info.AvatarFileID, createdBy).
 		PlaceholderFormat(sq.Dollar).
 		ToSql()
 
@@ -115,6 +136,184 @@ func (s *ChatsStorage) DeleteChatMembers(ctx context.Context, chatId string, mem
 	}
 }
 
+// DeleteChat removes the chat. Its members, messages and their attachments
+// are removed along with it by the ON DELETE CASCADE constraints
+func (s *ChatsStorage) DeleteChat(ctx context.Context, chatId string) error {
+	query, args, err := sq.Delete("chats").
+		Where(sq.Eq{"chat_id": chatId}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+
+	if err != nil {
+		return err
+	}
+
+	res, err := s.db.ExecContext(ctx, query, args...)
+
+	if err != nil {
+		return err
+	}
+
+	count, err := res.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return ErrChatNotFound
+	}
+
+	return nil
+}
+
+func directPair(userA string, userB string) (string, string) {
+	if userA > userB {
+		return userB, userA
+	}
+	return userA, userB
+}
+
+// PutDirectChat links direct chat to its participants. Returns
+// ErrDirectChatExists if there is another direct chat between them
+func (s *ChatsStorage) PutDirectChat(ctx context.Context, chatId string, userA string, userB string) error {
+	userA, userB = directPair(userA, userB)
+	query, args, err := sq.Insert("direct_chats").
+		Columns("chat_id", "user_a", "user_b").
+		Values(chatId, userA, userB).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx, query, args...)
+
+	if GetPgxConstraintName(err) == DirectChatsUsersKey {
+		return ErrDirectChatExists
+	} else {
+		return err
+	}
+}
+
+// GetDirectChat returns id of direct chat between two users
+// or ErrChatNotFound if there is no such chat
+func (s *ChatsStorage) GetDirectChat(ctx context.Context, userA string, userB string) (string, error) {
+	userA, userB = directPair(userA, userB)
+	query, args, err := sq.Select("chat_id").
+		From("direct_chats").
+		Where(sq.Eq{
+			"user_a": userA,
+			"user_b": userB,
+		}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+
+	if err != nil {
+		return "", err
+	}
+
+	var chatId string
+	err = s.db.GetContext(ctx, &chatId, query, args...)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrChatNotFound
+	} else if err != nil {
+		return "", err
+	}
+
+	return chatId, nil
+}
+
+// UpdateChatInfo sets provided fields of chat info, empty values are stored as NULL
+func (s *ChatsStorage) UpdateChatInfo(ctx context.Context, chatId string, info models.ChatInfo) error {
+	builder := sq.Update("chats").
+		Where(sq.Eq{"chat_id": chatId}).
+		PlaceholderFormat(sq.Dollar)
+
+	fields := []struct {
+		column string
+		value  *string
+	}{
+		{"title", info.Title},
+		{"description", info.Description},
+		{"avatar_file_id", info.AvatarFileID},
+	}
+
+	changed := false
+	for _, field := range fields {
+		if field.value == nil {
+			continue
+		}
+
+		changed = true
+		if len(*field.value) == 0 {
+			builder = builder.Set(field.column, nil)
+		} else {
+			builder = builder.Set(field.column, *field.value)
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+
+	query, args, err := builder.ToSql()
+
+	if err != nil {
+		return err
+	}
+
+	res, err := s.db.ExecContext(ctx, query, args...)
+
+	if err != nil {
+		return err
+	}
+
+	count, err := res.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return ErrChatNotFound
+	}
+
+	return nil
+}
+
+func (s *ChatsStorage) SetReadReceipts(ctx context.Context, chatId string, enabled bool) error {
+	query, args, err := sq.Update("chats").
+		Set("read_receipts", enabled).
+		Where(sq.Eq{"chat_id": chatId}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+
+	if err != nil {
+		return err
+	}
+
+	res, err := s.db.ExecContext(ctx, query, args...)
+
+	if err != nil {
+		return err
+	}
+
+	count, err := res.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return ErrChatNotFound
+	}
+
+	return nil
+}
+
 func (s *ChatsStorage) GetChat(ctx context.Context, chatId string) (*models.Chat, error) {
 	query, args, err := sq.Select("chats.*, count(user_id) as members_count").
 		From("chats").
@@ -136,6 +335,7 @@ func (s *ChatsStorage) GetChat(ctx context.Context, chatId string) (*models.Chat
 	} else if err != nil {
 		return nil, err
 	} else {
+		inUTC(&chat.CreatedAt)
 		return &chat, nil
 	}
 }
@@ -148,11 +348,10 @@ func (s *ChatsStorage) GetChatWithMembers(ctx context.Context, chatId string) (*
 		return nil, err
 	}
 
-	query, args, err := sq.Select("*").
-		From("chats").
+	query, args, err := sq.Select("user_id", "role").
+		From("chat_members").
 		Where(sq.Eq{"chat_id": chatId}).
-		Join("chat_members USING(chat_id)").
-		OrderBy("chat_id, user_id").
+		OrderBy("user_id").
 		PlaceholderFormat(sq.Dollar).
 		ToSql()
 
@@ -160,21 +359,13 @@ func (s *ChatsStorage) GetChatWithMembers(ctx context.Context, chatId string) (*
 		return nil, err
 	}
 
-	rows, err := s.db.QueryxContext(ctx, query, args...)
+	members := make([]models.ChatMember, 0)
+	err = s.db.SelectContext(ctx, &members, query, args...)
 
-	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+	if err != nil {
 		return nil, err
 	}
 
-	members := make([]models.ChatMember, 0)
-	for rows.Next() {
-		member := models.ChatMember{}
-		if err = rows.Scan(&chat.ChatID, &chat.IsDirect, &member.UserID); err != nil {
-			return nil, err
-		}
-		members = append(members, member)
-	}
-
 	return &models.ChatWithMembers{
 		Chat:    *chat,
 		Members: members,
@@ -205,126 +396,40 @@ func (s *ChatsStorage) UserIsMember(ctx context.Context, chatId string, userId s
 	return ok, nil
 }
 
-func (s *ChatsStorage) PutMessage(ctx context.Context, message *models.Message) error {
-	// TODO: check if message and reply_to message are in the same chat
-	// TODO: add attachments handling
-	query, args, err := sq.Insert("messages").
-		Columns("message_id", "chat_id", "from_user", "reply_to", "text", "sending_time").
-		Values(message.MessageID, message.ChatID, message.FromUser, message.ReplyTo, message.Text, message.SendingTime).
+// GetMemberRole returns ErrNotMember if user is not a chat member
+func (s *ChatsStorage) GetMemberRole(ctx context.Context, chatId string, userId string) (models.ChatRole, error) {
+	query, args, err := sq.Select("role").
+		From("chat_members").
+		Where(sq.Eq{
+			"chat_id": chatId,
+			"user_id": userId,
+		}).
 		PlaceholderFormat(sq.Dollar).
 		ToSql()
 
 	if err != nil {
-		return err
-	}
-
-	_, err = s.db.ExecContext(ctx, query, args...)
-
-	if GetPgxConstraintName(err) == "messages_reply_to_fkey" {
-		return ErrRepliedMessageNotFound
-	} else if GetPgxConstraintName(err) == "messages_chat_id_fkey" {
-		return ErrChatNotFound
-	} else if GetPgxConstraintName(err) == "messages_pkey" {
-		return ErrMessageAlreadyExists
-	} else if err != nil {
-		return err
-	}
-
-	return nil
-}
-
-type SelectOptions struct {
-	Limit   uint64
-	OrderBy []string
-}
-
-func (s *ChatsStorage) SelectMessages(ctx context.Context, selector sq.Sqlizer, options ...SelectOptions) ([]models.Message, error) {
-	// TODO: handle attachments
-	option := SelectOptions{}
-	if len(options) > 0 {
-		option = options[0]
-	}
-
-	builder := sq.Select("*").
-		From("messages").
-		Where(selector).
-		PlaceholderFormat(sq.Dollar)
-
-	if len(option.OrderBy) > 0 {
-		builder = builder.OrderBy(option.OrderBy...)
-	}
-
-	if option.Limit > 0 {
-		builder = builder.Limit(option.Limit)
-	}
-
-	query, args, err := builder.ToSql()
-
-	if err != nil {
-		return nil, err
+		return "", err
 	}
 
-	rows, err := s.db.QueryxContext(ctx, query, args...)
+	var role models.ChatRole
+	err = s.db.GetContext(ctx, &role, query, args...)
 
-	if GetPgxConstraintName(err) == ChatsPrimaryKey {
-		return nil, ErrChatNotFound
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", ErrNotMember
 	} else if err != nil {
-		return nil, err
-	}
-
-	messages := make([]models.Message, 0)
-
-	for rows.Next() {
-		msg := models.Message{
-			Attachments: []models.FileAttachment{},
-		}
-
-		err = rows.StructScan(&msg)
-
-		if err != nil && !errors.Is(err, sql.ErrNoRows) {
-			return nil, err
-		}
-		messages = append(messages, msg)
-	}
-
-	return messages, nil
-}
-
-func (s *ChatsStorage) GetMessagesSince(ctx context.Context, chatId string, since time.Time, count uint64) ([]models.Message, error) {
-	selector := sq.And{
-		sq.Eq{"chat_id": chatId},
-		sq.GtOrEq{"sending_time": since.UTC()},
+		return "", err
 	}
-	return s.SelectMessages(ctx, selector, SelectOptions{
-		Limit:   count,
-		OrderBy: []string{"sending_time"},
-	})
-}
-
-func (s *ChatsStorage) GetMessagesBefore(ctx context.Context, chatId string, before time.Time, count uint64) ([]models.Message, error) {
-	selector := sq.And{
-		sq.Eq{"chat_id": chatId},
-		sq.LtOrEq{"sending_time": before.UTC()},
-	}
-	return s.SelectMessages(ctx, selector, SelectOptions{
-		Limit:   count,
-		OrderBy: []string{"sending_time DESC"},
-	})
-}
 
-func (s *ChatsStorage) GetMessagesById(ctx context.Context, ids []string) ([]models.Message, error) {
-	selector := sq.Or{}
-	for _, id := range ids {
-		selector = append(selector, sq.Eq{"message_id": id})
-	}
-	return s.SelectMessages(ctx, selector, SelectOptions{
-		OrderBy: []string{"sending_time DESC"},
-	})
+	return role, nil
 }
 
-func (s *ChatsStorage) DeleteMessage(ctx context.Context, messageId string) error {
-	query, args, err := sq.Delete("messages").
-		Where(sq.Eq{"message_id": messageId}).
+func (s *ChatsStorage) SetMemberRole(ctx context.Context, chatId string, userId string, role models.ChatRole) error {
+	query, args, err := sq.Update("chat_members").
+		Set("role", role).
+		Where(sq.Eq{
+			"chat_id": chatId,
+			"user_id": userId,
+		}).
 		PlaceholderFormat(sq.Dollar).
 		ToSql()
 
@@ -345,23 +450,940 @@ func (s *ChatsStorage) DeleteMessage(ctx context.Context, messageId string) erro
 	}
 
 	if count == 0 {
-		return ErrMessageNotFound
+		return ErrNotMember
 	}
 
 	return nil
 }
 
+// MarkRead moves member's read marker to the cursor. Marker is never moved
+// backwards, so false is returned if it is already at or after the cursor
+func (s *ChatsStorage) MarkRead(ctx context.Context, chatId string, userId string, c *models.MessageCursor) (bool, error) {
+	query, args, err := sq.Update("chat_members").
+		Set("last_read_message_id", c.MessageID).
+		Set("last_read_at", c.SendingTime.UTC()).
+		Where(sq.Eq{
+			"chat_id": chatId,
+			"user_id": userId,
+		}).
+		Where(sq.Or{
+			sq.Eq{"last_read_at": nil},
+			sq.Expr("(last_read_at, last_read_message_id) < (?::timestamptz, ?::uuid)", c.SendingTime.UTC(), c.MessageID),
+		}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+
+	if err != nil {
+		return false, err
+	}
+
+	res, err := s.db.ExecContext(ctx, query, args...)
+
+	if err != nil {
+		return false, err
+	}
+
+	count, err := res.RowsAffected()
+
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// GetReadBy returns members whose read marker is at or after the cursor
+func (s *ChatsStorage) GetReadBy(ctx context.Context, chatId string, c *models.MessageCursor) ([]string, error) {
+	query, args, err := sq.Select("user_id").
+		From("chat_members").
+		Where(sq.Eq{"chat_id": chatId}).
+		Where(sq.Expr("(last_read_at, last_read_message_id) >= (?::timestamptz, ?::uuid)", c.SendingTime.UTC(), c.MessageID)).
+		OrderBy("user_id").
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+
+	if err != nil {
+		return nil, err
+	}
+
+	users := make([]string, 0)
+	err = s.db.SelectContext(ctx, &users, query, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return users, nil
+}
+
+func (s *ChatsStorage) PutMessage(ctx context.Context, message *models.Message) error {
+	// TODO: check if message and reply_to message are in the same chat
+	origin := message.ForwardOrigin
+	query, args, err := sq.Insert("messages").
+		Columns("message_id", "chat_id", "from_user", "reply_to", "text", "sending_time").
+		Columns("forwarded_from_chat", "forwarded_from_message", "forwarded_from_user", "forwarded_sending_time").
+		Columns("thread_root_id").
+		Values(
+			message.MessageID, message.ChatID, message.FromUser, message.ReplyTo, message.Text, message.SendingTime,
+			origin.ForwardedFromChat, origin.ForwardedFromMessage, origin.ForwardedFromUser, origin.ForwardedSendingTime,
+			message.ThreadRootID,
+		).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx, query, args...)
+
+	if GetPgxConstraintName(err) == "messages_reply_to_fkey" {
+		return ErrRepliedMessageNotFound
+	} else if GetPgxConstraintName(err) == "messages_chat_id_fkey" {
+		return ErrChatNotFound
+	} else if GetPgxConstraintName(err) == "messages_pkey" {
+		return ErrMessageAlreadyExists
+	} else if err != nil {
+		return err
+	}
+
+	return s.putAttachments(ctx, message.MessageID, message.Attachments)
+}
+
+func (s *ChatsStorage) putAttachments(ctx context.Context, messageId string, attachments []models.FileAttachment) error {
+	if len(attachments) == 0 {
+		return nil
+	}
+
+	builder := sq.Insert("attachments").
+		Columns("message_id", "file_id", "mime_type").
+		PlaceholderFormat(sq.Dollar)
+
+	for _, att := range attachments {
+		builder = builder.Values(messageId, att.FileID, att.MimeType)
+	}
+
+	query, args, err := builder.ToSql()
+
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx, query, args...)
+	return err
+}
+
+type attachmentRow struct {
+	MessageID string `db:"message_id"`
+	models.FileAttachment
+}
+
+// selectAttachments loads attachments of all provided messages in one query
+// and groups them by message_id
+func (s *ChatsStorage) selectAttachments(ctx context.Context, messageIds []string) (map[string][]models.FileAttachment, error) {
+	attachments := make(map[string][]models.FileAttachment, len(messageIds))
+
+	if len(messageIds) == 0 {
+		return attachments, nil
+	}
+
+	query, args, err := sq.Select("message_id", "file_id", "mime_type").
+		From("attachments").
+		Where(sq.Eq{"message_id": messageIds}).
+		OrderBy("attachment_id").
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+
+	if err != nil {
+		return nil, err
+	}
+
+	rows := make([]attachmentRow, 0)
+	err = s.db.SelectContext(ctx, &rows, query, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		attachments[row.MessageID] = append(attachments[row.MessageID], row.FileAttachment)
+	}
+
+	return attachments, nil
+}
+
+// fillAttachments sets Attachments of every message in place
+func (s *ChatsStorage) fillAttachments(ctx context.Context, messages []*models.Message) error {
+	ids := make([]string, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.MessageID
+	}
+
+	attachments, err := s.selectAttachments(ctx, ids)
+
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range messages {
+		if atts, ok := attachments[msg.MessageID]; ok {
+			msg.Attachments = atts
+		} else {
+			msg.Attachments = []models.FileAttachment{}
+		}
+	}
+
+	return nil
+}
+
+type reactionRow struct {
+	MessageID string `db:"message_id"`
+	models.Reaction
+}
+
+// selectReactions loads aggregated reactions of all provided messages in one
+// query. Reacted is set for reactions left by viewer
+func (s *ChatsStorage) selectReactions(ctx context.Context, messageIds []string, viewer string) (map[string][]models.Reaction, error) {
+	reactions := make(map[string][]models.Reaction, len(messageIds))
+
+	if len(messageIds) == 0 {
+		return reactions, nil
+	}
+
+	query, args, err := sq.Select("message_id", "reaction", "count(*) AS count").
+		Column("bool_or(user_id = ?) AS reacted", viewer).
+		From("message_reactions").
+		Where(sq.Eq{"message_id": messageIds}).
+		GroupBy("message_id", "reaction").
+		// Reactions are listed in order they first appeared
+		OrderBy("message_id", "min(reacted_at)", "reaction").
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+
+	if err != nil {
+		return nil, err
+	}
+
+	rows := make([]reactionRow, 0)
+	err = s.db.SelectContext(ctx, &rows, query, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		reactions[row.MessageID] = append(reactions[row.MessageID], row.Reaction)
+	}
+
+	return reactions, nil
+}
+
+// fillReactions sets Reactions of every message in place
+func (s *ChatsStorage) fillReactions(ctx context.Context, messages []*models.Message, viewer string) error {
+	ids := make([]string, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.MessageID
+	}
+
+	reactions, err := s.selectReactions(ctx, ids, viewer)
+
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range messages {
+		if r, ok := reactions[msg.MessageID]; ok {
+			msg.Reactions = r
+		} else {
+			msg.Reactions = []models.Reaction{}
+		}
+	}
+
+	return nil
+}
+
+type threadStatsRow struct {
+	RootID string `db:"thread_root_id"`
+	models.ThreadStats
+}
+
+// GetThreadStats returns stats of threads which have at least one reply,
+// deleted replies are not counted
+func (s *ChatsStorage) GetThreadStats(ctx context.Context, rootIds []string) (map[string]models.ThreadStats, error) {
+	stats := make(map[string]models.ThreadStats, len(rootIds))
+
+	if len(rootIds) == 0 {
+		return stats, nil
+	}
+
+	query, args, err := sq.Select("thread_root_id", "count(*) AS reply_count", "max(sending_time) AS last_reply_at").
+		From("messages").
+		Where(sq.Eq{
+			"thread_root_id": rootIds,
+			"deleted_at":     nil,
+		}).
+		GroupBy("thread_root_id").
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+
+	if err != nil {
+		return nil, err
+	}
+
+	rows := make([]threadStatsRow, 0)
+	err = s.db.SelectContext(ctx, &rows, query, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, row := range rows {
+		inUTC(row.LastReplyAt)
+		stats[row.RootID] = row.ThreadStats
+	}
+
+	return stats, nil
+}
+
+// fillThreadStats sets ThreadStats of every message in place
+func (s *ChatsStorage) fillThreadStats(ctx context.Context, messages []*models.Message) error {
+	ids := make([]string, len(messages))
+	for i, msg := range messages {
+		ids[i] = msg.MessageID
+	}
+
+	stats, err := s.GetThreadStats(ctx, ids)
+
+	if err != nil {
+		return err
+	}
+
+	for _, msg := range messages {
+		msg.ThreadStats = stats[msg.MessageID]
+	}
+
+	return nil
+}
+
+// AddReaction returns false if user already has this reaction on the message
+func (s *ChatsStorage) AddReaction(ctx context.Context, messageId string, userId string, reaction string) (bool, error) {
+	query, args, err := sq.Insert("message_reactions").
+		Columns("message_id", "user_id", "reaction").
+		Values(messageId, userId, reaction).
+		Suffix("ON CONFLICT DO NOTHING").
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+
+	if err != nil {
+		return false, err
+	}
+
+	res, err := s.db.ExecContext(ctx, query, args...)
+
+	if GetPgxConstraintName(err) == ReactionsMessageForeignKey {
+		return false, ErrMessageNotFound
+	} else if err != nil {
+		return false, err
+	}
+
+	count, err := res.RowsAffected()
+
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// RemoveReaction returns false if user has no such reaction on the message
+func (s *ChatsStorage) RemoveReaction(ctx context.Context, messageId string, userId string, reaction string) (bool, error) {
+	query, args, err := sq.Delete("message_reactions").
+		Where(sq.Eq{
+			"message_id": messageId,
+			"user_id":    userId,
+			"reaction":   reaction,
+		}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+
+	if err != nil {
+		return false, err
+	}
+
+	res, err := s.db.ExecContext(ctx, query, args...)
+
+	if err != nil {
+		return false, err
+	}
+
+	count, err := res.RowsAffected()
+
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+func (s *ChatsStorage) CountReactions(ctx context.Context, messageId string, reaction string) (int64, error) {
+	query, args, err := sq.Select("count(*)").
+		From("message_reactions").
+		Where(sq.Eq{
+			"message_id": messageId,
+			"reaction":   reaction,
+		}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+
+	if err != nil {
+		return 0, err
+	}
+
+	var count int64
+	err = s.db.GetContext(ctx, &count, query, args...)
+	return count, err
+}
+
+// PinMessage returns false if the message is already pinned
+func (s *ChatsStorage) PinMessage(ctx context.Context, pin *models.Pin) (bool, error) {
+	query, args, err := sq.Insert("chat_pins").
+		Columns("chat_id", "message_id", "pinned_by", "pinned_at").
+		Values(pin.ChatID, pin.MessageID, pin.PinnedBy, pin.PinnedAt.UTC()).
+		Suffix("ON CONFLICT DO NOTHING").
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+
+	if err != nil {
+		return false, err
+	}
+
+	res, err := s.db.ExecContext(ctx, query, args...)
+
+	if err != nil {
+		return false, err
+	}
+
+	count, err := res.RowsAffected()
+
+	if err != nil {
+		return false, err
+	}
+
+	return count > 0, nil
+}
+
+// UnpinMessages returns ids of messages which were pinned
+func (s *ChatsStorage) UnpinMessages(ctx context.Context, chatId string, messageIds []string) ([]string, error) {
+	query, args, err := sq.Delete("chat_pins").
+		Where(sq.Eq{
+			"chat_id":    chatId,
+			"message_id": messageIds,
+		}).
+		Suffix("RETURNING message_id").
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+
+	if err != nil {
+		return nil, err
+	}
+
+	unpinned := make([]string, 0)
+	err = s.db.SelectContext(ctx, &unpinned, query, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return unpinned, nil
+}
+
+// GetPins returns chat pins from the most recent one, all pins
+// are returned if limit is zero
+func (s *ChatsStorage) GetPins(ctx context.Context, chatId string, limit uint64) ([]models.Pin, error) {
+	builder := sq.Select("chat_id", "message_id", "pinned_by", "pinned_at").
+		From("chat_pins").
+		Where(sq.Eq{"chat_id": chatId}).
+		OrderBy("pinned_at DESC", "message_id DESC").
+		PlaceholderFormat(sq.Dollar)
+
+	if limit > 0 {
+		builder = builder.Limit(limit)
+	}
+
+	query, args, err := builder.ToSql()
+
+	if err != nil {
+		return nil, err
+	}
+
+	pins := make([]models.Pin, 0)
+	err = s.db.SelectContext(ctx, &pins, query, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range pins {
+		inUTC(&pins[i].PinnedAt)
+	}
+
+	return pins, nil
+}
+
+// messageColumns are selected instead of * because messages
+// table has columns which are not a part of the model
+var messageColumns = []string{
+	"message_id", "from_user", "chat_id", "sending_time", "text", "reply_to", "edited_at", "deleted_at",
+	"forwarded_from_chat", "forwarded_from_message", "forwarded_from_user", "forwarded_sending_time",
+	"thread_root_id",
+}
+
+// inUTC converts time scanned from timestamptz to UTC in place,
+// because pgx scans it in local time zone. Nil is ignored
+func inUTC(t *time.Time) {
+	if t != nil {
+		*t = t.UTC()
+	}
+}
+
+// messageInUTC converts all times of the scanned message to UTC in place
+func messageInUTC(msg *models.Message) {
+	inUTC(&msg.SendingTime)
+	inUTC(msg.EditedAt)
+	inUTC(msg.DeletedAt)
+	inUTC(msg.ForwardedSendingTime)
+}
+
+type SelectOptions struct {
+	Limit   uint64
+	OrderBy []string
+	// Viewer is a user whose own reactions are marked as Reacted
+	Viewer string
+}
+
+func (s *ChatsStorage) SelectMessages(ctx context.Context, selector sq.Sqlizer, options ...SelectOptions) ([]models.Message, error) {
+	option := SelectOptions{}
+	if len(options) > 0 {
+		option = options[0]
+	}
+
+	builder := sq.Select(messageColumns...).
+		From("messages").
+		Where(selector).
+		PlaceholderFormat(sq.Dollar)
+
+	if len(option.OrderBy) > 0 {
+		builder = builder.OrderBy(option.OrderBy...)
+	}
+
+	if option.Limit > 0 {
+		builder = builder.Limit(option.Limit)
+	}
+
+	query, args, err := builder.ToSql()
+
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryxContext(ctx, query, args...)
+
+	if GetPgxConstraintName(err) == ChatsPrimaryKey {
+		return nil, ErrChatNotFound
+	} else if err != nil {
+		return nil, err
+	}
+
+	messages := make([]models.Message, 0)
+
+	for rows.Next() {
+		msg := models.Message{
+			Attachments: []models.FileAttachment{},
+			Reactions:   []models.Reaction{},
+		}
+
+		err = rows.StructScan(&msg)
+
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		messageInUTC(&msg)
+		messages = append(messages, msg)
+	}
+
+	refs := make([]*models.Message, len(messages))
+	for i := range messages {
+		refs[i] = &messages[i]
+	}
+
+	if err = s.fillAttachments(ctx, refs); err != nil {
+		return nil, err
+	}
+
+	if err = s.fillReactions(ctx, refs, option.Viewer); err != nil {
+		return nil, err
+	}
+
+	if err = s.fillThreadStats(ctx, refs); err != nil {
+		return nil, err
+	}
+
+	return messages, nil
+}
+
+// Matches are marked by ts_headline with private use characters, they are
+// removed from message text beforehand, so users can't forge highlighting.
+// Snippet is HTML escaped and markers are replaced with <b> tags afterwards
+const (
+	highlightStart = "\uE000"
+	highlightStop  = "\uE001"
+)
+
+func highlightSnippet(headline string) string {
+	return strings.NewReplacer(
+		highlightStart, "<b>",
+		highlightStop, "</b>",
+	).Replace(html.EscapeString(headline))
+}
+
+type SearchOptions struct {
+	Limit uint64
+	After *models.SearchCursor
+}
+
+// SearchMessages looks for messages matching the search query in chats where
+// user is a member. Results are ordered by relevance, then by recency
+func (s *ChatsStorage) SearchMessages(ctx context.Context, userId string, search *models.MessagesSearch, options SearchOptions) ([]models.SearchResult, error) {
+	builder := sq.Select(messageColumns...).
+		Column("ts_rank(text_search, q) AS rank").
+		Column(sq.Expr(
+			"ts_headline('simple', translate(coalesce(text, ''), ?, ''), q, ?) AS snippet",
+			highlightStart+highlightStop,
+			fmt.Sprintf(`StartSel="%s", StopSel="%s", MaxFragments=2`, highlightStart, highlightStop),
+		)).
+		From("messages").
+		JoinClause("CROSS JOIN websearch_to_tsquery('simple', ?) q", search.Query).
+		Where("text_search @@ q").
+		Where(sq.Eq{"deleted_at": nil}).
+		Where(sq.Expr("chat_id IN (SELECT chat_id FROM chat_members WHERE user_id = ?)", userId)).
+		Where(NotHiddenFor(userId)).
+		OrderBy("rank DESC").
+		OrderBy(MessagesDescending...).
+		PlaceholderFormat(sq.Dollar)
+
+	if search.ChatID != nil {
+		builder = builder.Where(sq.Eq{"chat_id": *search.ChatID})
+	}
+
+	if search.FromUser != nil {
+		builder = builder.Where(sq.Eq{"from_user": *search.FromUser})
+	}
+
+	if search.Since != nil {
+		builder = builder.Where(sq.GtOrEq{"sending_time": search.Since.UTC()})
+	}
+
+	if search.Until != nil {
+		builder = builder.Where(sq.LtOrEq{"sending_time": search.Until.UTC()})
+	}
+
+	if search.HasAttachments != nil {
+		hasAttachments := "EXISTS (SELECT 1 FROM attachments a WHERE a.message_id = messages.message_id)"
+		if *search.HasAttachments {
+			builder = builder.Where(hasAttachments)
+		} else {
+			builder = builder.Where("NOT " + hasAttachments)
+		}
+	}
+
+	if c := options.After; c != nil {
+		builder = builder.Where(
+			"(ts_rank(text_search, q), sending_time, message_id) < (?::real, ?::timestamptz, ?::uuid)",
+			c.Rank, c.SendingTime.UTC(), c.MessageID,
+		)
+	}
+
+	if options.Limit > 0 {
+		builder = builder.Limit(options.Limit)
+	}
+
+	query, args, err := builder.ToSql()
+
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]models.SearchResult, 0)
+	err = s.db.SelectContext(ctx, &results, query, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make([]*models.Message, len(results))
+	for i := range results {
+		results[i].Snippet = highlightSnippet(results[i].Snippet)
+		messageInUTC(&results[i].Message)
+		refs[i] = &results[i].Message
+	}
+
+	if err = s.fillAttachments(ctx, refs); err != nil {
+		return nil, err
+	}
+
+	if err = s.fillReactions(ctx, refs, userId); err != nil {
+		return nil, err
+	}
+
+	return results, nil
+}
+
+func (s *ChatsStorage) GetMessagesSince(ctx context.Context, chatId string, since time.Time, count uint64) ([]models.Message, error) {
+	selector := sq.And{
+		sq.Eq{"chat_id": chatId},
+		sq.GtOrEq{"sending_time": since.UTC()},
+	}
+	return s.SelectMessages(ctx, selector, SelectOptions{
+		Limit:   count,
+		OrderBy: MessagesAscending,
+	})
+}
+
+func (s *ChatsStorage) GetMessagesBefore(ctx context.Context, chatId string, before time.Time, count uint64) ([]models.Message, error) {
+	selector := sq.And{
+		sq.Eq{"chat_id": chatId},
+		sq.LtOrEq{"sending_time": before.UTC()},
+	}
+	return s.SelectMessages(ctx, selector, SelectOptions{
+		Limit:   count,
+		OrderBy: MessagesDescending,
+	})
+}
+
+func (s *ChatsStorage) GetMessagesById(ctx context.Context, ids []string) ([]models.Message, error) {
+	selector := sq.Or{}
+	for _, id := range ids {
+		selector = append(selector, sq.Eq{"message_id": id})
+	}
+	return s.SelectMessages(ctx, selector, SelectOptions{
+		OrderBy: []string{"sending_time DESC"},
+	})
+}
+
+func (s *ChatsStorage) DeleteMessage(ctx context.Context, messageId string) error {
+	query, args, err := sq.Delete("messages").
+		Where(sq.Eq{"message_id": messageId}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+
+	if err != nil {
+		return err
+	}
+
+	res, err := s.db.ExecContext(ctx, query, args...)
+
+	if err != nil {
+		return err
+	}
+
+	count, err := res.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return ErrMessageNotFound
+	}
+
+	return nil
+}
+
+// TombstoneMessages marks messages as deleted for everyone. Rows are kept,
+// so replies to them are still valid, but text, attachments and edit history
+// are dropped
+func (s *ChatsStorage) TombstoneMessages(ctx context.Context, messageIds []string, deletedAt time.Time) error {
+	query, args, err := sq.Update("messages").
+		Set("text", "").
+		Set("deleted_at", deletedAt).
+		Where(sq.Eq{"message_id": messageIds}).
+		Where(sq.Eq{"deleted_at": nil}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+
+	if err != nil {
+		return err
+	}
+
+	if _, err = s.db.ExecContext(ctx, query, args...); err != nil {
+		return err
+	}
+
+	for _, table := range []string{"attachments", "message_revisions"} {
+		query, args, err = sq.Delete(table).
+			Where(sq.Eq{"message_id": messageIds}).
+			PlaceholderFormat(sq.Dollar).
+			ToSql()
+
+		if err != nil {
+			return err
+		}
+
+		if _, err = s.db.ExecContext(ctx, query, args...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// HideMessages deletes messages only for the provided user
+func (s *ChatsStorage) HideMessages(ctx context.Context, userId string, messageIds []string) error {
+	builder := sq.Insert("hidden_messages").
+		Columns("user_id", "message_id").
+		Suffix("ON CONFLICT DO NOTHING").
+		PlaceholderFormat(sq.Dollar)
+
+	for _, id := range messageIds {
+		builder = builder.Values(userId, id)
+	}
+
+	query, args, err := builder.ToSql()
+
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx, query, args...)
+	return err
+}
+
+// NotHiddenFor filters out messages hidden by the user
+func NotHiddenFor(userId string) sq.Sqlizer {
+	return sq.Expr(
+		"NOT EXISTS (SELECT 1 FROM hidden_messages h WHERE h.message_id = messages.message_id AND h.user_id = ?)",
+		userId,
+	)
+}
+
+var (
+	// MessagesAscending is the chat history order, ties in sending time
+	// are broken by message id
+	MessagesAscending  = []string{"sending_time ASC", "message_id ASC"}
+	MessagesDescending = []string{"sending_time DESC", "message_id DESC"}
+)
+
+// AfterCursor selects messages placed after the cursor in MessagesAscending order
+func AfterCursor(c *models.MessageCursor) sq.Sqlizer {
+	return sq.Expr("(sending_time, message_id) > (?::timestamptz, ?::uuid)", c.SendingTime.UTC(), c.MessageID)
+}
+
+// BeforeCursor selects messages placed before the cursor in MessagesAscending order
+func BeforeCursor(c *models.MessageCursor) sq.Sqlizer {
+	return sq.Expr("(sending_time, message_id) < (?::timestamptz, ?::uuid)", c.SendingTime.UTC(), c.MessageID)
+}
+
+// EditMessage replaces message text and keeps the previous version
+// in message_revisions
+func (s *ChatsStorage) EditMessage(ctx context.Context, messageId string, text string, editedAt time.Time) error {
+	query, args, err := sq.Insert("message_revisions").
+		Columns("message_id", "text", "revised_at").
+		Select(
+			sq.Select("message_id", "text").
+				Column("?::timestamptz", editedAt).
+				From("messages").
+				Where(sq.Eq{"message_id": messageId}),
+		).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+
+	if err != nil {
+		return err
+	}
+
+	res, err := s.db.ExecContext(ctx, query, args...)
+
+	if err != nil {
+		return err
+	}
+
+	count, err := res.RowsAffected()
+
+	if err != nil {
+		return err
+	}
+
+	if count == 0 {
+		return ErrMessageNotFound
+	}
+
+	query, args, err = sq.Update("messages").
+		Set("text", text).
+		Set("edited_at", editedAt).
+		Where(sq.Eq{"message_id": messageId}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx, query, args...)
+	return err
+}
+
+func (s *ChatsStorage) GetMessageRevisions(ctx context.Context, messageId string) ([]models.MessageRevision, error) {
+	query, args, err := sq.Select("message_id", "text", "revised_at").
+		From("message_revisions").
+		Where(sq.Eq{"message_id": messageId}).
+		OrderBy("revised_at").
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+
+	if err != nil {
+		return nil, err
+	}
+
+	revisions := make([]models.MessageRevision, 0)
+	err = s.db.SelectContext(ctx, &revisions, query, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range revisions {
+		inUTC(&revisions[i].RevisedAt)
+	}
+
+	return revisions, nil
+}
+
 func (s *ChatsStorage) GetUserChats(ctx context.Context, userId string) ([]models.RichChat, error) {
 
 	query, args, err := sq.
-		Select("c.chat_id", "is_direct", "message_id", "from_user", "reply_to", "sending_time", "text").
+		Select("c.chat_id", "is_direct", "title", "description", "avatar_file_id").
+		Column(sq.Expr(`(
+			SELECT count(*) FROM messages
+			WHERE c.chat_id = messages.chat_id
+				AND messages.from_user <> mem.user_id
+				AND messages.deleted_at IS NULL
+				AND (mem.last_read_at IS NULL OR
+					(messages.sending_time, messages.message_id) > (mem.last_read_at, mem.last_read_message_id))
+				AND ?
+		) AS unread_count`, NotHiddenFor(userId))).
+		Columns("message_id", "from_user", "reply_to", "sending_time", "text", "edited_at", "deleted_at").
+		Columns("forwarded_from_chat", "forwarded_from_message", "forwarded_from_user", "forwarded_sending_time").
+		Column("thread_root_id").
 		From("chats c").
 		Join("messages msg ON c.chat_id = msg.chat_id").
 		Join("chat_members mem ON c.chat_id = mem.chat_id ").
 		Where(sq.Eq{
 			"user_id": userId,
 		}).
-		Where("msg.sending_time = (SELECT max(sending_time) FROM messages WHERE c.chat_id = chat_id)").
+		Where(sq.Expr(`msg.sending_time = (
+			SELECT max(sending_time) FROM messages
+			WHERE c.chat_id = messages.chat_id AND ?
+		)`, NotHiddenFor(userId))).
 		PlaceholderFormat(sq.Dollar).
 		ToSql()
 
@@ -379,13 +1401,39 @@ func (s *ChatsStorage) GetUserChats(ctx context.Context, userId string) ([]model
 		return nil, err
 	}
 
+	defer rows.Close()
+
+	lastMessages := make([]*models.Message, 0)
 	for rows.Next() {
 		chat := models.RichChat{}
 		msg := models.Message{}
 		chat.LastMessage = &msg
-		err = rows.Scan(&chat.ChatID, &chat.IsDirect, &msg.MessageID, &msg.FromUser, &msg.ReplyTo, &msg.SendingTime, &msg.Text)
+		err = rows.Scan(
+			&chat.ChatID, &chat.IsDirect, &chat.Title, &chat.Description, &chat.AvatarFileID, &chat.UnreadCount,
+			&msg.MessageID, &msg.FromUser, &msg.ReplyTo, &msg.SendingTime, &msg.Text, &msg.EditedAt, &msg.DeletedAt,
+			&msg.ForwardedFromChat, &msg.ForwardedFromMessage, &msg.ForwardedFromUser, &msg.ForwardedSendingTime,
+			&msg.ThreadRootID,
+		)
+		if err != nil {
+			return nil, err
+		}
 		msg.ChatID = chat.ChatID
+		messageInUTC(&msg)
 		chats = append(chats, chat)
+		lastMessages = append(lastMessages, &msg)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	if err = s.fillAttachments(ctx, lastMessages); err != nil {
+		return nil, err
 	}
+
+	if err = s.fillReactions(ctx, lastMessages, userId); err != nil {
+		return nil, err
+	}
+
 	return chats, nil
 }
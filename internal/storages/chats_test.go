@@ -4,11 +4,15 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	sq "github.com/Masterminds/squirrel"
 	"github.com/google/uuid"
+	"github.com/practice-sem-2/user-service/internal/metrics"
 	"github.com/practice-sem-2/user-service/internal/models"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
+	"strings"
 	"testing"
 	"time"
 )
@@ -18,7 +22,7 @@ type ChatsStorageTestSuite struct {
 }
 
 func (s *ChatsStorageTestSuite) TearDownTest() {
-	_, err := s.db.Exec("TRUNCATE messages, chat_members, chats, attachments")
+	_, err := s.db.Exec("TRUNCATE messages, chat_members, chats, attachments, message_revisions, hidden_messages, direct_chats, message_reactions, chat_pins")
 	require.NoError(s.T(), err, "can't teardown test")
 }
 
@@ -93,9 +97,9 @@ func (s *ChatsStorageTestSuite) Test_AddMember_Atomic() {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	registry := NewRegistry(s.db)
+	registry := NewRegistry(s.db, &UpdatesStoreConfig{UpdatesTopic: "test"}, nil)
 
-	err := registry.Atomic(ctx, func(registry *DefaultRegistry) error {
+	err := registry.Atomic(ctx, func(registry Registry) error {
 		store := registry.GetChatsStore()
 		err := store.CreateChat(ctx, chatId, false)
 		assert.NoError(s.T(), err, "should correctly create chat")
@@ -115,6 +119,37 @@ func (s *ChatsStorageTestSuite) Test_AddMember_Atomic() {
 	assert.Equal(s.T(), 0, count, "whole transaction should be rolled back")
 }
 
+func (s *ChatsStorageTestSuite) Test_Atomic_Metrics() {
+	const chatId = "694a909e-bec7-4dbe-bf38-935a99d848cc"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	registry := NewRegistry(s.db, &UpdatesStoreConfig{UpdatesTopic: "test"}, nil)
+	transactions := histogramCount(s.T(), metrics.TransactionDuration)
+	rollbacks := testutil.ToFloat64(metrics.TransactionRollbacks)
+
+	err := registry.Atomic(ctx, func(registry Registry) error {
+		return registry.GetChatsStore().CreateChat(ctx, chatId, false)
+	})
+	require.NoError(s.T(), err, "should correctly create chat")
+	assert.Equal(s.T(), transactions+1, histogramCount(s.T(), metrics.TransactionDuration), "committed transaction should be observed")
+	assert.Equal(s.T(), rollbacks, testutil.ToFloat64(metrics.TransactionRollbacks), "committed transaction is not a rollback")
+
+	err = registry.Atomic(ctx, func(registry Registry) error {
+		return errors.New("bang")
+	})
+	assert.Error(s.T(), err, "should return error")
+	assert.Equal(s.T(), transactions+2, histogramCount(s.T(), metrics.TransactionDuration), "rolled back transaction should be observed")
+	assert.Equal(s.T(), rollbacks+1, testutil.ToFloat64(metrics.TransactionRollbacks), "rollback should be counted")
+
+	assert.Panics(s.T(), func() {
+		_ = registry.Atomic(ctx, func(registry Registry) error {
+			panic("bang")
+		})
+	}, "panic should be propagated")
+	assert.Equal(s.T(), rollbacks+2, testutil.ToFloat64(metrics.TransactionRollbacks), "rollback on panic should be counted")
+}
+
 func (s *ChatsStorageTestSuite) Test_DeleteMember() {
 	const chatId = "694a909e-bec7-4dbe-bf38-935a99d848cc"
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
@@ -195,8 +230,8 @@ func (s *ChatsStorageTestSuite) Test_GetChatWithMembers() {
 	assert.Equal(s.T(), 2, chat.MembersCount)
 
 	expectedMembers := []models.ChatMember{
-		{UserID: "67f85047-09d0-42a2-a5ee-9ce8db28cb07"},
-		{UserID: "74cccd17-9c56-490b-b721-88c027976863"},
+		{UserID: "67f85047-09d0-42a2-a5ee-9ce8db28cb07", Role: models.RoleMember},
+		{UserID: "74cccd17-9c56-490b-b721-88c027976863", Role: models.RoleMember},
 	}
 	assert.Equal(s.T(), expectedMembers, chat.Members, "should contain all chat members")
 }
@@ -265,7 +300,7 @@ func (s *ChatsStorageTestSuite) Test_PutMessage() {
 		MessageID:   messageId,
 		FromUser:    userId,
 		ChatID:      chatId,
-		SendingTime: time.Now().UTC(),
+		SendingTime: time.Now().UTC().Truncate(time.Microsecond),
 		Text:        "Hello, world!",
 		ReplyTo:     nil,
 		Attachments: nil,
@@ -273,10 +308,13 @@ func (s *ChatsStorageTestSuite) Test_PutMessage() {
 	err = store.PutMessage(ctx, &expectedMsg)
 	assert.NoError(s.T(), err, "should correctly send message to chat")
 
-	row := s.db.QueryRow("SELECT * FROM messages WHERE message_id = $1", messageId)
+	row := s.db.QueryRow(`
+		SELECT message_id, chat_id, from_user, reply_to, sending_time, text, edited_at, deleted_at
+		FROM messages WHERE message_id = $1`, messageId)
 	msg := models.Message{}
-	err = row.Scan(&msg.MessageID, &msg.ChatID, &msg.FromUser, &msg.ReplyTo, &msg.SendingTime, &msg.Text)
+	err = row.Scan(&msg.MessageID, &msg.ChatID, &msg.FromUser, &msg.ReplyTo, &msg.SendingTime, &msg.Text, &msg.EditedAt, &msg.DeletedAt)
 	assert.NoError(s.T(), err, "should return row from db")
+	msg.SendingTime = msg.SendingTime.UTC()
 
 	assert.Equal(s.T(), expectedMsg, msg)
 }
@@ -383,3 +421,822 @@ func (s *ChatsStorageTestSuite) Test_SelectMessage() {
 	assert.NoError(s.T(), err, "should not return any error")
 	assert.Equal(s.T(), expectedMessages, actualMessages, "query should return first three messages")
 }
+
+func (s *ChatsStorageTestSuite) Test_DeleteChat() {
+	const chatId = "694a909e-bec7-4dbe-bf38-935a99d848cc"
+	const userId = "74cccd17-9c56-490b-b721-88c027976863"
+	const messageId = "67f85047-09d0-42a2-a5ee-9ce8db28cb07"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	store := NewChatsStorage(s.db)
+	err := store.CreateChat(ctx, chatId, false)
+	assert.NoError(s.T(), err, "should correctly create chat")
+	err = store.AddChatMembers(ctx, chatId, []string{userId})
+	assert.NoError(s.T(), err, "should correctly add member to chat")
+
+	err = store.PutMessage(ctx, &models.Message{
+		MessageID:   messageId,
+		FromUser:    userId,
+		ChatID:      chatId,
+		SendingTime: time.Now().UTC(),
+		Text:        "Hello, world!",
+	})
+	assert.NoError(s.T(), err, "should correctly send message to chat")
+
+	err = store.DeleteChat(ctx, chatId)
+	assert.NoError(s.T(), err, "should not return any error")
+
+	count := -1
+	err = s.db.GetContext(ctx, &count, "SELECT count(1) FROM chat_members WHERE chat_id = $1", chatId)
+	assert.NoError(s.T(), err, "should not return any error")
+	assert.Equal(s.T(), 0, count, "members should be deleted")
+
+	err = s.db.GetContext(ctx, &count, "SELECT count(1) FROM messages WHERE chat_id = $1", chatId)
+	assert.NoError(s.T(), err, "should not return any error")
+	assert.Equal(s.T(), 0, count, "messages should be deleted")
+}
+
+func (s *ChatsStorageTestSuite) Test_DeleteChat_IfChatDoesNotExist() {
+	const chatId = "694a909e-bec7-4dbe-bf38-935a99d848cc"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	store := NewChatsStorage(s.db)
+
+	err := store.DeleteChat(ctx, chatId)
+	assert.ErrorIs(s.T(), err, ErrChatNotFound)
+}
+
+func (s *ChatsStorageTestSuite) Test_PutMessage_WithAttachments() {
+	const chatId = "694a909e-bec7-4dbe-bf38-935a99d848cc"
+	const userId = "74cccd17-9c56-490b-b721-88c027976863"
+	const messageId = "67f85047-09d0-42a2-a5ee-9ce8db28cb07"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	store := NewChatsStorage(s.db)
+	err := store.CreateChat(ctx, chatId, false)
+	assert.NoError(s.T(), err, "should correctly create chat")
+	err = store.AddChatMembers(ctx, chatId, []string{userId})
+	assert.NoError(s.T(), err, "should correctly add member to chat")
+
+	attachments := []models.FileAttachment{
+		{MimeType: "image/png", FileID: "0b6a4a4c-5c55-4a51-9c4e-4b0d6a0b0b7e"},
+		{MimeType: "application/pdf", FileID: "5f8c4b8e-34c8-4e5f-8f10-0f3f4b1f5a2d"},
+	}
+	err = store.PutMessage(ctx, &models.Message{
+		MessageID:   messageId,
+		FromUser:    userId,
+		ChatID:      chatId,
+		SendingTime: time.Now().UTC(),
+		Attachments: attachments,
+	})
+	assert.NoError(s.T(), err, "should correctly send message with attachments")
+
+	messages, err := store.GetMessagesById(ctx, []string{messageId})
+	require.NoError(s.T(), err, "should not return any error")
+	require.Len(s.T(), messages, 1)
+	assert.ElementsMatch(s.T(), attachments, messages[0].Attachments, "attachments should be loaded with message")
+
+	chats, err := store.GetUserChats(ctx, userId)
+	require.NoError(s.T(), err, "should not return any error")
+	require.Len(s.T(), chats, 1)
+	assert.ElementsMatch(s.T(), attachments, chats[0].LastMessage.Attachments, "last message should contain attachments")
+}
+
+func (s *ChatsStorageTestSuite) Test_EditMessage() {
+	const chatId = "694a909e-bec7-4dbe-bf38-935a99d848cc"
+	const userId = "74cccd17-9c56-490b-b721-88c027976863"
+	const messageId = "67f85047-09d0-42a2-a5ee-9ce8db28cb07"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	store := NewChatsStorage(s.db)
+	err := store.CreateChat(ctx, chatId, false)
+	assert.NoError(s.T(), err, "should correctly create chat")
+	err = store.AddChatMembers(ctx, chatId, []string{userId})
+	assert.NoError(s.T(), err, "should correctly add member to chat")
+
+	err = store.PutMessage(ctx, &models.Message{
+		MessageID:   messageId,
+		FromUser:    userId,
+		ChatID:      chatId,
+		SendingTime: time.Now().UTC(),
+		Text:        "Helo, world!",
+	})
+	assert.NoError(s.T(), err, "should correctly send message to chat")
+
+	editedAt := time.Now().UTC().Truncate(time.Microsecond)
+	err = store.EditMessage(ctx, messageId, "Hello, world!", editedAt)
+	assert.NoError(s.T(), err, "should correctly edit message")
+
+	messages, err := store.GetMessagesById(ctx, []string{messageId})
+	require.NoError(s.T(), err, "should not return any error")
+	require.Len(s.T(), messages, 1)
+	assert.Equal(s.T(), "Hello, world!", messages[0].Text, "text should be replaced")
+	require.NotNil(s.T(), messages[0].EditedAt, "message should be marked as edited")
+	assert.Equal(s.T(), &editedAt, messages[0].EditedAt, "edit time should be read in UTC")
+
+	revisions, err := store.GetMessageRevisions(ctx, messageId)
+	assert.NoError(s.T(), err, "should not return any error")
+	assert.Equal(s.T(), []models.MessageRevision{
+		{MessageID: messageId, Text: "Helo, world!", RevisedAt: editedAt},
+	}, revisions, "previous version should be kept")
+}
+
+func (s *ChatsStorageTestSuite) Test_GetMessagesById_TimesInUTC() {
+	const chatId = "694a909e-bec7-4dbe-bf38-935a99d848cc"
+	const userId = "74cccd17-9c56-490b-b721-88c027976863"
+	const messageId = "67f85047-09d0-42a2-a5ee-9ce8db28cb07"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	store := NewChatsStorage(s.db)
+	err := store.CreateChat(ctx, chatId, false)
+	assert.NoError(s.T(), err, "should correctly create chat")
+	err = store.AddChatMembers(ctx, chatId, []string{userId})
+	assert.NoError(s.T(), err, "should correctly add member to chat")
+
+	sendingTime := time.Now().UTC().Truncate(time.Microsecond)
+	err = store.PutMessage(ctx, &models.Message{
+		MessageID:   messageId,
+		FromUser:    userId,
+		ChatID:      chatId,
+		SendingTime: sendingTime,
+		Text:        "Hello, world!",
+	})
+	assert.NoError(s.T(), err, "should correctly send message to chat")
+
+	deletedAt := sendingTime.Add(time.Minute)
+	err = store.TombstoneMessages(ctx, []string{messageId}, deletedAt)
+	assert.NoError(s.T(), err, "should correctly delete message")
+
+	messages, err := store.GetMessagesById(ctx, []string{messageId})
+	require.NoError(s.T(), err, "should not return any error")
+	require.Len(s.T(), messages, 1)
+	assert.Equal(s.T(), time.UTC, messages[0].SendingTime.Location())
+	assert.Equal(s.T(), sendingTime, messages[0].SendingTime, "sending time should be read in UTC")
+	assert.Equal(s.T(), &deletedAt, messages[0].DeletedAt, "deletion time should be read in UTC")
+}
+
+func (s *ChatsStorageTestSuite) Test_EditMessage_IfMessageDoesNotExists() {
+	const messageId = "67f85047-09d0-42a2-a5ee-9ce8db28cb07"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	store := NewChatsStorage(s.db)
+
+	err := store.EditMessage(ctx, messageId, "Hello, world!", time.Now().UTC())
+	assert.ErrorIs(s.T(), err, ErrMessageNotFound)
+}
+
+func (s *ChatsStorageTestSuite) Test_TombstoneMessages() {
+	const chatId = "694a909e-bec7-4dbe-bf38-935a99d848cc"
+	const userId = "74cccd17-9c56-490b-b721-88c027976863"
+	const messageId = "67f85047-09d0-42a2-a5ee-9ce8db28cb07"
+	const replyId = "a4b0a8e4-3f5c-4a4e-a0b9-6a2d8c1c9f7e"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	store := NewChatsStorage(s.db)
+	err := store.CreateChat(ctx, chatId, false)
+	assert.NoError(s.T(), err, "should correctly create chat")
+	err = store.AddChatMembers(ctx, chatId, []string{userId})
+	assert.NoError(s.T(), err, "should correctly add member to chat")
+
+	err = store.PutMessage(ctx, &models.Message{
+		MessageID:   messageId,
+		FromUser:    userId,
+		ChatID:      chatId,
+		SendingTime: time.Now().UTC(),
+		Text:        "Hello, world!",
+		Attachments: []models.FileAttachment{
+			{MimeType: "image/png", FileID: "0b6a4a4c-5c55-4a51-9c4e-4b0d6a0b0b7e"},
+		},
+	})
+	assert.NoError(s.T(), err, "should correctly send message to chat")
+
+	replyTo := messageId
+	err = store.PutMessage(ctx, &models.Message{
+		MessageID:   replyId,
+		FromUser:    userId,
+		ChatID:      chatId,
+		SendingTime: time.Now().UTC(),
+		Text:        "Reply",
+		ReplyTo:     &replyTo,
+	})
+	assert.NoError(s.T(), err, "should correctly send reply to chat")
+
+	err = store.TombstoneMessages(ctx, []string{messageId}, time.Now().UTC())
+	assert.NoError(s.T(), err, "should not return any error")
+
+	messages, err := store.GetMessagesById(ctx, []string{messageId, replyId})
+	require.NoError(s.T(), err, "should not return any error")
+	require.Len(s.T(), messages, 2, "tombstone and reply should be kept")
+
+	for _, msg := range messages {
+		if msg.MessageID == messageId {
+			assert.NotNil(s.T(), msg.DeletedAt, "message should be marked as deleted")
+			assert.Empty(s.T(), msg.Text, "text should be dropped")
+			assert.Empty(s.T(), msg.Attachments, "attachments should be dropped")
+		} else {
+			assert.Nil(s.T(), msg.DeletedAt, "reply should not be deleted")
+			assert.Equal(s.T(), &replyTo, msg.ReplyTo, "reply should still point to the tombstone")
+		}
+	}
+}
+
+func (s *ChatsStorageTestSuite) Test_HideMessages() {
+	const chatId = "694a909e-bec7-4dbe-bf38-935a99d848cc"
+	const userId = "74cccd17-9c56-490b-b721-88c027976863"
+	const otherUserId = "67f85047-09d0-42a2-a5ee-9ce8db28cb07"
+	const messageId = "a4b0a8e4-3f5c-4a4e-a0b9-6a2d8c1c9f7e"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	store := NewChatsStorage(s.db)
+	err := store.CreateChat(ctx, chatId, false)
+	assert.NoError(s.T(), err, "should correctly create chat")
+	err = store.AddChatMembers(ctx, chatId, []string{userId, otherUserId})
+	assert.NoError(s.T(), err, "should correctly add members to chat")
+
+	err = store.PutMessage(ctx, &models.Message{
+		MessageID:   messageId,
+		FromUser:    userId,
+		ChatID:      chatId,
+		SendingTime: time.Now().UTC(),
+		Text:        "Hello, world!",
+	})
+	assert.NoError(s.T(), err, "should correctly send message to chat")
+
+	err = store.HideMessages(ctx, userId, []string{messageId})
+	assert.NoError(s.T(), err, "should not return any error")
+	err = store.HideMessages(ctx, userId, []string{messageId})
+	assert.NoError(s.T(), err, "hiding message twice should not return any error")
+
+	messages, err := store.SelectMessages(ctx, NotHiddenFor(userId))
+	assert.NoError(s.T(), err, "should not return any error")
+	assert.Empty(s.T(), messages, "message should be hidden from user")
+
+	messages, err = store.SelectMessages(ctx, NotHiddenFor(otherUserId))
+	assert.NoError(s.T(), err, "should not return any error")
+	assert.Len(s.T(), messages, 1, "message should be visible to other members")
+}
+
+func (s *ChatsStorageTestSuite) Test_SelectMessages_Cursors() {
+	const chatId = "694a909e-bec7-4dbe-bf38-935a99d848cc"
+	const userId = "74cccd17-9c56-490b-b721-88c027976863"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	store := NewChatsStorage(s.db)
+	err := store.CreateChat(ctx, chatId, false)
+	assert.NoError(s.T(), err, "should correctly create chat")
+	err = store.AddChatMembers(ctx, chatId, []string{userId})
+	assert.NoError(s.T(), err, "should correctly add member to chat")
+
+	// All messages are sent at the same time, so only id orders them
+	sendingTime := time.Now().UTC().Truncate(time.Second)
+	ids := []string{
+		"10000000-0000-0000-0000-000000000000",
+		"20000000-0000-0000-0000-000000000000",
+		"30000000-0000-0000-0000-000000000000",
+	}
+	for _, id := range ids {
+		err = store.PutMessage(ctx, &models.Message{
+			MessageID:   id,
+			FromUser:    userId,
+			ChatID:      chatId,
+			SendingTime: sendingTime,
+			Text:        "Hello, world!",
+		})
+		assert.NoError(s.T(), err, "should correctly send message to chat")
+	}
+
+	cursor := &models.MessageCursor{SendingTime: sendingTime, MessageID: ids[1]}
+
+	messages, err := store.SelectMessages(ctx, AfterCursor(cursor), SelectOptions{OrderBy: MessagesAscending})
+	assert.NoError(s.T(), err, "should not return any error")
+	require.Len(s.T(), messages, 1, "only message after cursor should be returned")
+	assert.Equal(s.T(), ids[2], messages[0].MessageID)
+
+	messages, err = store.SelectMessages(ctx, BeforeCursor(cursor), SelectOptions{OrderBy: MessagesDescending})
+	assert.NoError(s.T(), err, "should not return any error")
+	require.Len(s.T(), messages, 1, "only message before cursor should be returned")
+	assert.Equal(s.T(), ids[0], messages[0].MessageID)
+}
+
+func (s *ChatsStorageTestSuite) Test_SetMemberRole() {
+	const chatId = "694a909e-bec7-4dbe-bf38-935a99d848cc"
+	const userId = "74cccd17-9c56-490b-b721-88c027976863"
+	const userIdNotMember = "67f85047-09d0-42a2-a5ee-9ce8db28cb07"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	store := NewChatsStorage(s.db)
+	err := store.CreateChat(ctx, chatId, false)
+	assert.NoError(s.T(), err, "should correctly create chat")
+	err = store.AddChatMembers(ctx, chatId, []string{userId})
+	assert.NoError(s.T(), err, "should correctly add member to chat")
+
+	role, err := store.GetMemberRole(ctx, chatId, userId)
+	assert.NoError(s.T(), err, "should not return any error")
+	assert.Equal(s.T(), models.RoleMember, role, "added user should be a regular member")
+
+	err = store.SetMemberRole(ctx, chatId, userId, models.RoleAdmin)
+	assert.NoError(s.T(), err, "should correctly change role")
+
+	role, err = store.GetMemberRole(ctx, chatId, userId)
+	assert.NoError(s.T(), err, "should not return any error")
+	assert.Equal(s.T(), models.RoleAdmin, role, "role should be changed")
+
+	_, err = store.GetMemberRole(ctx, chatId, userIdNotMember)
+	assert.ErrorIs(s.T(), err, ErrNotMember)
+
+	err = store.SetMemberRole(ctx, chatId, userIdNotMember, models.RoleAdmin)
+	assert.ErrorIs(s.T(), err, ErrNotMember)
+}
+
+func (s *ChatsStorageTestSuite) Test_CreateChat_WithInfo() {
+	const chatId = "694a909e-bec7-4dbe-bf38-935a99d848cc"
+	const userId = "74cccd17-9c56-490b-b721-88c027976863"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	title := "Chat"
+	avatar := "0b6a4a4c-5c55-4a51-9c4e-4b0d6a0b0b7e"
+
+	store := NewChatsStorage(s.db)
+	err := store.CreateChat(ctx, chatId, false, CreateChatOptions{
+		CreatedBy: userId,
+		Info: models.ChatInfo{
+			Title:        &title,
+			AvatarFileID: &avatar,
+		},
+	})
+	assert.NoError(s.T(), err, "should correctly create chat")
+	err = store.AddChatMembers(ctx, chatId, []string{userId})
+	assert.NoError(s.T(), err, "should correctly add member to chat")
+
+	chat, err := store.GetChat(ctx, chatId)
+	require.NoError(s.T(), err, "chat should be returned without errors")
+	assert.Equal(s.T(), &title, chat.Title)
+	assert.Nil(s.T(), chat.Description)
+	assert.Equal(s.T(), &avatar, chat.AvatarFileID)
+	assert.Equal(s.T(), userId, *chat.CreatedBy)
+	assert.False(s.T(), chat.CreatedAt.IsZero(), "creation time should be set")
+}
+
+func (s *ChatsStorageTestSuite) Test_UpdateChatInfo() {
+	const chatId = "694a909e-bec7-4dbe-bf38-935a99d848cc"
+	const userId = "74cccd17-9c56-490b-b721-88c027976863"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	title := "Chat"
+	description := "Description"
+
+	store := NewChatsStorage(s.db)
+	err := store.CreateChat(ctx, chatId, false, CreateChatOptions{
+		Info: models.ChatInfo{Title: &title},
+	})
+	assert.NoError(s.T(), err, "should correctly create chat")
+	err = store.AddChatMembers(ctx, chatId, []string{userId})
+	assert.NoError(s.T(), err, "should correctly add member to chat")
+
+	empty := ""
+	err = store.UpdateChatInfo(ctx, chatId, models.ChatInfo{
+		Title:       &empty,
+		Description: &description,
+	})
+	assert.NoError(s.T(), err, "should correctly update chat info")
+
+	chat, err := store.GetChat(ctx, chatId)
+	require.NoError(s.T(), err, "chat should be returned without errors")
+	assert.Nil(s.T(), chat.Title, "empty title should clear it")
+	assert.Equal(s.T(), &description, chat.Description)
+
+	err = store.UpdateChatInfo(ctx, "67f85047-09d0-42a2-a5ee-9ce8db28cb07", models.ChatInfo{Title: &title})
+	assert.ErrorIs(s.T(), err, ErrChatNotFound)
+}
+
+func (s *ChatsStorageTestSuite) Test_DirectChats() {
+	const chatId = "0f3a5d2e-6b1c-4f7a-9e8d-2c4b6a8f1e3d"
+	const otherChatId = "5b7c9e1f-3a2d-4c6e-8f0a-1b3d5f7a9c2e"
+	const userA = "alice"
+	const userB = "bob"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	store := NewChatsStorage(s.db)
+
+	_, err := store.GetDirectChat(ctx, userA, userB)
+	assert.ErrorIs(s.T(), err, ErrChatNotFound, "there is no direct chat yet")
+
+	err = store.CreateChat(ctx, chatId, true)
+	require.NoError(s.T(), err, "should correctly create chat")
+	err = store.PutDirectChat(ctx, chatId, userB, userA)
+	require.NoError(s.T(), err, "should correctly link direct chat")
+
+	found, err := store.GetDirectChat(ctx, userA, userB)
+	assert.NoError(s.T(), err, "direct chat should be found")
+	assert.Equal(s.T(), chatId, found, "direct chat should be found regardless of users order")
+
+	err = store.CreateChat(ctx, otherChatId, true)
+	require.NoError(s.T(), err, "should correctly create chat")
+	err = store.PutDirectChat(ctx, otherChatId, userA, userB)
+	assert.ErrorIs(s.T(), err, ErrDirectChatExists, "second direct chat between users should be rejected")
+}
+
+func (s *ChatsStorageTestSuite) Test_MarkRead() {
+	const chatId = "694a909e-bec7-4dbe-bf38-935a99d848cc"
+	const reader = "74cccd17-9c56-490b-b721-88c027976863"
+	const sender = "e2b1c4d6-8f0a-4b3c-9d5e-7f1a3c5e7b9d"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	store := NewChatsStorage(s.db)
+	err := store.CreateChat(ctx, chatId, false)
+	assert.NoError(s.T(), err, "should correctly create chat")
+	err = store.AddChatMembers(ctx, chatId, []string{reader, sender})
+	assert.NoError(s.T(), err, "should correctly add members to chat")
+
+	sendingTime := time.Now().UTC().Truncate(time.Second)
+	ids := []string{
+		"10000000-0000-0000-0000-000000000000",
+		"20000000-0000-0000-0000-000000000000",
+		"30000000-0000-0000-0000-000000000000",
+	}
+	for _, id := range ids {
+		err = store.PutMessage(ctx, &models.Message{
+			MessageID:   id,
+			FromUser:    sender,
+			ChatID:      chatId,
+			SendingTime: sendingTime,
+			Text:        "Hello, world!",
+		})
+		assert.NoError(s.T(), err, "should correctly send message to chat")
+	}
+
+	unreadCount := func() int64 {
+		chats, err := store.GetUserChats(ctx, reader)
+		require.NoError(s.T(), err, "user chats should be returned without errors")
+		require.Len(s.T(), chats, 1)
+		return chats[0].UnreadCount
+	}
+	assert.Equal(s.T(), int64(3), unreadCount(), "all messages should be unread")
+
+	moved, err := store.MarkRead(ctx, chatId, reader, &models.MessageCursor{SendingTime: sendingTime, MessageID: ids[1]})
+	assert.NoError(s.T(), err, "should correctly mark messages read")
+	assert.True(s.T(), moved, "marker should be moved forward")
+	assert.Equal(s.T(), int64(1), unreadCount(), "only message after marker should be unread")
+
+	moved, err = store.MarkRead(ctx, chatId, reader, &models.MessageCursor{SendingTime: sendingTime, MessageID: ids[0]})
+	assert.NoError(s.T(), err, "should not return any error")
+	assert.False(s.T(), moved, "marker should not be moved backwards")
+	assert.Equal(s.T(), int64(1), unreadCount(), "unread count should not change")
+}
+
+func (s *ChatsStorageTestSuite) Test_GetReadBy() {
+	const chatId = "694a909e-bec7-4dbe-bf38-935a99d848cc"
+	const reader = "74cccd17-9c56-490b-b721-88c027976863"
+	const sender = "e2b1c4d6-8f0a-4b3c-9d5e-7f1a3c5e7b9d"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	store := NewChatsStorage(s.db)
+	err := store.CreateChat(ctx, chatId, false)
+	assert.NoError(s.T(), err, "should correctly create chat")
+	err = store.AddChatMembers(ctx, chatId, []string{reader, sender})
+	assert.NoError(s.T(), err, "should correctly add members to chat")
+
+	sendingTime := time.Now().UTC().Truncate(time.Second)
+	first := &models.MessageCursor{SendingTime: sendingTime, MessageID: "10000000-0000-0000-0000-000000000000"}
+	second := &models.MessageCursor{SendingTime: sendingTime, MessageID: "20000000-0000-0000-0000-000000000000"}
+	for _, c := range []*models.MessageCursor{first, second} {
+		err = store.PutMessage(ctx, &models.Message{
+			MessageID:   c.MessageID,
+			FromUser:    sender,
+			ChatID:      chatId,
+			SendingTime: c.SendingTime,
+			Text:        "Hello, world!",
+		})
+		assert.NoError(s.T(), err, "should correctly send message to chat")
+	}
+
+	_, err = store.MarkRead(ctx, chatId, reader, first)
+	assert.NoError(s.T(), err, "should correctly mark messages read")
+
+	readBy, err := store.GetReadBy(ctx, chatId, first)
+	assert.NoError(s.T(), err, "should not return any error")
+	assert.Equal(s.T(), []string{reader}, readBy, "member read up to the message should be returned")
+
+	readBy, err = store.GetReadBy(ctx, chatId, second)
+	assert.NoError(s.T(), err, "should not return any error")
+	assert.Empty(s.T(), readBy, "nobody has read the message yet")
+
+	err = store.SetReadReceipts(ctx, chatId, false)
+	assert.NoError(s.T(), err, "should correctly turn off read receipts")
+	chat, err := store.GetChat(ctx, chatId)
+	require.NoError(s.T(), err, "chat should be returned without errors")
+	assert.False(s.T(), chat.ReadReceipts, "read receipts should be turned off")
+}
+
+func (s *ChatsStorageTestSuite) Test_Reactions() {
+	const chatId = "694a909e-bec7-4dbe-bf38-935a99d848cc"
+	const viewer = "74cccd17-9c56-490b-b721-88c027976863"
+	const other = "e2b1c4d6-8f0a-4b3c-9d5e-7f1a3c5e7b9d"
+	const messageId = "10000000-0000-0000-0000-000000000000"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	store := NewChatsStorage(s.db)
+	err := store.CreateChat(ctx, chatId, false)
+	assert.NoError(s.T(), err, "should correctly create chat")
+	err = store.AddChatMembers(ctx, chatId, []string{viewer, other})
+	assert.NoError(s.T(), err, "should correctly add members to chat")
+	err = store.PutMessage(ctx, &models.Message{
+		MessageID:   messageId,
+		FromUser:    other,
+		ChatID:      chatId,
+		SendingTime: time.Now().UTC(),
+		Text:        "Hello, world!",
+	})
+	assert.NoError(s.T(), err, "should correctly send message to chat")
+
+	added, err := store.AddReaction(ctx, messageId, viewer, "👍")
+	assert.NoError(s.T(), err, "should correctly add reaction")
+	assert.True(s.T(), added)
+	added, err = store.AddReaction(ctx, messageId, viewer, "👍")
+	assert.NoError(s.T(), err, "repeated reaction should not cause an error")
+	assert.False(s.T(), added, "repeated reaction should not be added")
+	_, err = store.AddReaction(ctx, messageId, other, "👍")
+	assert.NoError(s.T(), err, "should correctly add reaction")
+	_, err = store.AddReaction(ctx, messageId, other, "🔥")
+	assert.NoError(s.T(), err, "should correctly add reaction")
+
+	messages, err := store.SelectMessages(ctx, NotHiddenFor(viewer), SelectOptions{Viewer: viewer})
+	assert.NoError(s.T(), err, "should not return any error")
+	require.Len(s.T(), messages, 1)
+	assert.Equal(s.T(), []models.Reaction{
+		{Reaction: "👍", Count: 2, Reacted: true},
+		{Reaction: "🔥", Count: 1, Reacted: false},
+	}, messages[0].Reactions)
+
+	removed, err := store.RemoveReaction(ctx, messageId, viewer, "👍")
+	assert.NoError(s.T(), err, "should correctly remove reaction")
+	assert.True(s.T(), removed)
+	count, err := store.CountReactions(ctx, messageId, "👍")
+	assert.NoError(s.T(), err, "should not return any error")
+	assert.Equal(s.T(), int64(1), count)
+
+	_, err = store.AddReaction(ctx, "67f85047-09d0-42a2-a5ee-9ce8db28cb07", viewer, "👍")
+	assert.ErrorIs(s.T(), err, ErrMessageNotFound)
+}
+
+func (s *ChatsStorageTestSuite) Test_Pins() {
+	const chatId = "694a909e-bec7-4dbe-bf38-935a99d848cc"
+	const userId = "74cccd17-9c56-490b-b721-88c027976863"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	store := NewChatsStorage(s.db)
+	err := store.CreateChat(ctx, chatId, false)
+	assert.NoError(s.T(), err, "should correctly create chat")
+	err = store.AddChatMembers(ctx, chatId, []string{userId})
+	assert.NoError(s.T(), err, "should correctly add member to chat")
+
+	pinnedAt := time.Now().UTC().Truncate(time.Second)
+	ids := []string{
+		"10000000-0000-0000-0000-000000000000",
+		"20000000-0000-0000-0000-000000000000",
+	}
+	for i, id := range ids {
+		err = store.PutMessage(ctx, &models.Message{
+			MessageID:   id,
+			FromUser:    userId,
+			ChatID:      chatId,
+			SendingTime: pinnedAt,
+			Text:        "Hello, world!",
+		})
+		assert.NoError(s.T(), err, "should correctly send message to chat")
+
+		pinned, err := store.PinMessage(ctx, &models.Pin{
+			ChatID:    chatId,
+			MessageID: id,
+			PinnedBy:  userId,
+			PinnedAt:  pinnedAt.Add(time.Duration(i) * time.Minute),
+		})
+		assert.NoError(s.T(), err, "should correctly pin message")
+		assert.True(s.T(), pinned)
+	}
+
+	pinned, err := store.PinMessage(ctx, &models.Pin{ChatID: chatId, MessageID: ids[0], PinnedBy: userId, PinnedAt: pinnedAt})
+	assert.NoError(s.T(), err, "repeated pin should not cause an error")
+	assert.False(s.T(), pinned, "message should not be pinned twice")
+
+	pins, err := store.GetPins(ctx, chatId, 0)
+	assert.NoError(s.T(), err, "should not return any error")
+	require.Len(s.T(), pins, 2)
+	assert.Equal(s.T(), ids[1], pins[0].MessageID, "the latest pin should be the first")
+
+	unpinned, err := store.UnpinMessages(ctx, chatId, ids)
+	assert.NoError(s.T(), err, "should correctly unpin messages")
+	assert.ElementsMatch(s.T(), ids, unpinned)
+
+	pins, err = store.GetPins(ctx, chatId, 1)
+	assert.NoError(s.T(), err, "should not return any error")
+	assert.Empty(s.T(), pins)
+}
+
+func (s *ChatsStorageTestSuite) Test_SearchMessages() {
+	const chatId = "694a909e-bec7-4dbe-bf38-935a99d848cc"
+	const otherChatId = "5b7c9e1f-3a2d-4c6e-8f0a-1b3d5f7a9c2e"
+	const userId = "74cccd17-9c56-490b-b721-88c027976863"
+	const otherUserId = "e2b1c4d6-8f0a-4b3c-9d5e-7f1a3c5e7b9d"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	store := NewChatsStorage(s.db)
+	err := store.CreateChat(ctx, chatId, false)
+	assert.NoError(s.T(), err, "should correctly create chat")
+	err = store.AddChatMembers(ctx, chatId, []string{userId})
+	assert.NoError(s.T(), err, "should correctly add member to chat")
+	err = store.CreateChat(ctx, otherChatId, false)
+	assert.NoError(s.T(), err, "should correctly create chat")
+	err = store.AddChatMembers(ctx, otherChatId, []string{otherUserId})
+	assert.NoError(s.T(), err, "should correctly add member to chat")
+
+	messages := []models.Message{
+		{MessageID: "10000000-0000-0000-0000-000000000000", ChatID: chatId, Text: "let's meet tomorrow"},
+		{MessageID: "20000000-0000-0000-0000-000000000000", ChatID: chatId, Text: "meet me, meet me now"},
+		{MessageID: "30000000-0000-0000-0000-000000000000", ChatID: chatId, Text: "nothing relevant"},
+		{MessageID: "40000000-0000-0000-0000-000000000000", ChatID: otherChatId, Text: "meet in other chat"},
+	}
+	for _, msg := range messages {
+		msg.FromUser = userId
+		msg.SendingTime = time.Now().UTC()
+		err = store.PutMessage(ctx, &msg)
+		assert.NoError(s.T(), err, "should correctly send message to chat")
+	}
+
+	results, err := store.SearchMessages(ctx, userId, &models.MessagesSearch{Query: "meet"}, SearchOptions{})
+	assert.NoError(s.T(), err, "should not return any error")
+	require.Len(s.T(), results, 2, "only messages from user's chats should be found")
+	assert.Equal(s.T(), messages[1].MessageID, results[0].MessageID, "more relevant message should be the first")
+	assert.Contains(s.T(), results[0].Snippet, "<b>meet</b>")
+
+	after := &models.SearchCursor{
+		Rank: results[0].Rank,
+		MessageCursor: models.MessageCursor{
+			SendingTime: results[0].SendingTime,
+			MessageID:   results[0].MessageID,
+		},
+	}
+	results, err = store.SearchMessages(ctx, userId, &models.MessagesSearch{Query: "meet"}, SearchOptions{After: after})
+	assert.NoError(s.T(), err, "should not return any error")
+	require.Len(s.T(), results, 1, "only results after cursor should be returned")
+	assert.Equal(s.T(), messages[0].MessageID, results[0].MessageID)
+
+	hasAttachments := true
+	results, err = store.SearchMessages(ctx, userId, &models.MessagesSearch{Query: "meet", HasAttachments: &hasAttachments}, SearchOptions{})
+	assert.NoError(s.T(), err, "should not return any error")
+	assert.Empty(s.T(), results, "there are no messages with attachments")
+}
+
+func (s *ChatsStorageTestSuite) Test_SearchMessages_EscapesSnippet() {
+	const chatId = "694a909e-bec7-4dbe-bf38-935a99d848cc"
+	const userId = "74cccd17-9c56-490b-b721-88c027976863"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	store := NewChatsStorage(s.db)
+	err := store.CreateChat(ctx, chatId, false)
+	assert.NoError(s.T(), err, "should correctly create chat")
+	err = store.AddChatMembers(ctx, chatId, []string{userId})
+	assert.NoError(s.T(), err, "should correctly add member to chat")
+
+	err = store.PutMessage(ctx, &models.Message{
+		MessageID:   "10000000-0000-0000-0000-000000000000",
+		ChatID:      chatId,
+		FromUser:    userId,
+		SendingTime: time.Now().UTC(),
+		Text:        "meet <script>alert(1)</script> \uE000here\uE001",
+	})
+	assert.NoError(s.T(), err, "should correctly send message to chat")
+
+	results, err := store.SearchMessages(ctx, userId, &models.MessagesSearch{Query: "meet"}, SearchOptions{})
+	assert.NoError(s.T(), err, "should not return any error")
+	require.Len(s.T(), results, 1)
+	assert.Contains(s.T(), results[0].Snippet, "<b>meet</b>")
+	assert.NotContains(s.T(), results[0].Snippet, "<script>", "user text should be escaped")
+	assert.Equal(s.T(), 1, strings.Count(results[0].Snippet, "<b>"), "user can't forge highlighting")
+}
+
+func TestHighlightSnippet(t *testing.T) {
+	headline := "a < b & " + highlightStart + "meet" + highlightStop + " \"quoted\""
+	assert.Equal(t, "a &lt; b &amp; <b>meet</b> &#34;quoted&#34;", highlightSnippet(headline))
+}
+
+func (s *ChatsStorageTestSuite) Test_PutMessage_Forwarded() {
+	const chatId = "694a909e-bec7-4dbe-bf38-935a99d848cc"
+	const otherChatId = "5b7c9e1f-3a2d-4c6e-8f0a-1b3d5f7a9c2e"
+	const userId = "74cccd17-9c56-490b-b721-88c027976863"
+	const originalId = "10000000-0000-0000-0000-000000000000"
+	const forwardedId = "20000000-0000-0000-0000-000000000000"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	store := NewChatsStorage(s.db)
+	for _, id := range []string{chatId, otherChatId} {
+		err := store.CreateChat(ctx, id, false)
+		assert.NoError(s.T(), err, "should correctly create chat")
+		err = store.AddChatMembers(ctx, id, []string{userId})
+		assert.NoError(s.T(), err, "should correctly add member to chat")
+	}
+
+	original := models.Message{
+		MessageID:   originalId,
+		FromUser:    userId,
+		ChatID:      chatId,
+		SendingTime: time.Now().UTC().Truncate(time.Second),
+		Text:        "Hello, world!",
+	}
+	err := store.PutMessage(ctx, &original)
+	assert.NoError(s.T(), err, "should correctly send message to chat")
+
+	err = store.PutMessage(ctx, &models.Message{
+		MessageID:   forwardedId,
+		FromUser:    userId,
+		ChatID:      otherChatId,
+		SendingTime: time.Now().UTC(),
+		Text:        original.Text,
+		ForwardOrigin: models.ForwardOrigin{
+			ForwardedFromChat:    &original.ChatID,
+			ForwardedFromMessage: &original.MessageID,
+			ForwardedFromUser:    &original.FromUser,
+			ForwardedSendingTime: &original.SendingTime,
+		},
+	})
+	assert.NoError(s.T(), err, "should correctly forward message")
+
+	messages, err := store.GetMessagesById(ctx, []string{forwardedId})
+	assert.NoError(s.T(), err, "should not return any error")
+	require.Len(s.T(), messages, 1)
+	origin := messages[0].ForwardOrigin
+	assert.Equal(s.T(), &original.MessageID, origin.ForwardedFromMessage)
+	assert.Equal(s.T(), &original.FromUser, origin.ForwardedFromUser)
+	require.NotNil(s.T(), origin.ForwardedSendingTime)
+	assert.True(s.T(), original.SendingTime.Equal(*origin.ForwardedSendingTime))
+
+	err = store.DeleteChat(ctx, chatId)
+	assert.NoError(s.T(), err, "should correctly delete chat")
+	messages, err = store.GetMessagesById(ctx, []string{forwardedId})
+	assert.NoError(s.T(), err, "should not return any error")
+	require.Len(s.T(), messages, 1, "forwarded message should outlive the original")
+	assert.Nil(s.T(), messages[0].ForwardedFromMessage)
+	assert.Equal(s.T(), &original.FromUser, messages[0].ForwardedFromUser, "original author should be kept")
+}
+
+func (s *ChatsStorageTestSuite) Test_ThreadStats() {
+	const chatId = "694a909e-bec7-4dbe-bf38-935a99d848cc"
+	const userId = "74cccd17-9c56-490b-b721-88c027976863"
+	const rootId = "10000000-0000-0000-0000-000000000000"
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	store := NewChatsStorage(s.db)
+	err := store.CreateChat(ctx, chatId, false)
+	assert.NoError(s.T(), err, "should correctly create chat")
+	err = store.AddChatMembers(ctx, chatId, []string{userId})
+	assert.NoError(s.T(), err, "should correctly add member to chat")
+
+	sendingTime := time.Now().UTC().Truncate(time.Second)
+	root := rootId
+	messages := []models.Message{
+		{MessageID: rootId, SendingTime: sendingTime},
+		{MessageID: "20000000-0000-0000-0000-000000000000", ReplyTo: &root, ThreadRootID: &root, SendingTime: sendingTime.Add(time.Minute)},
+		{MessageID: "30000000-0000-0000-0000-000000000000", ReplyTo: &root, ThreadRootID: &root, SendingTime: sendingTime.Add(2 * time.Minute)},
+	}
+	for _, msg := range messages {
+		msg.ChatID = chatId
+		msg.FromUser = userId
+		msg.Text = "Hello, world!"
+		err = store.PutMessage(ctx, &msg)
+		assert.NoError(s.T(), err, "should correctly send message to chat")
+	}
+
+	roots, err := store.SelectMessages(ctx, sq.Eq{"thread_root_id": nil})
+	assert.NoError(s.T(), err, "should not return any error")
+	require.Len(s.T(), roots, 1, "only root should be selected")
+	assert.Equal(s.T(), int64(2), roots[0].ReplyCount)
+	require.NotNil(s.T(), roots[0].LastReplyAt)
+	assert.True(s.T(), sendingTime.Add(2*time.Minute).Equal(*roots[0].LastReplyAt))
+
+	err = store.TombstoneMessages(ctx, []string{messages[2].MessageID}, time.Now().UTC())
+	assert.NoError(s.T(), err, "should correctly delete message")
+	stats, err := store.GetThreadStats(ctx, []string{rootId})
+	assert.NoError(s.T(), err, "should not return any error")
+	assert.Equal(s.T(), int64(1), stats[rootId].ReplyCount, "deleted replies should not be counted")
+}
@@ -34,6 +34,12 @@ func (s *PostgresTestSuite) SetupSuite() {
 	err = s.m.Up()
 	require.NoError(s.T(), err, "failed to migrate database")
 }
+
+// DB returns connection to the migrated database for suites of other packages
+func (s *PostgresTestSuite) DB() *sqlx.DB {
+	return s.db
+}
+
 func (s *PostgresTestSuite) TearDownSuite() {
 	_ = s.m.Down()
 	_ = s.db.Close()
@@ -0,0 +1,208 @@
+package storage
+
+import (
+	"context"
+	sq "github.com/Masterminds/squirrel"
+	"github.com/Shopify/sarama"
+	"github.com/jmoiron/sqlx"
+	"github.com/practice-sem-2/user-service/internal/metrics"
+	"github.com/sirupsen/logrus"
+	"time"
+)
+
+// relayLockKey is a key of postgres advisory lock which guarantees that
+// only one relay publishes updates at a time, so updates order is kept
+const relayLockKey = 7_160_517
+
+// pruneInterval is how often sent updates older than retention are deleted
+const pruneInterval = time.Minute
+
+type UpdatesRelayConfig struct {
+	PollInterval time.Duration
+	BatchSize    uint64
+	// Retention is how long sent updates are kept for GetDifference,
+	// they are never deleted if it is zero
+	Retention time.Duration
+}
+
+// UpdatesRelay publishes updates saved by UpdatesStorage to kafka in order
+// of update_id and marks them as sent. Delivery is at-least-once:
+// if marking fails after publishing, updates will be published again.
+//
+// update_id is taken from a sequence on insert, so across keys it is not
+// the commit order. Writers of the same key are serialized until commit
+// by UpdatesStorage, so updates of a key are published in commit order
+type UpdatesRelay struct {
+	db       *sqlx.DB
+	producer sarama.SyncProducer
+	cfg      *UpdatesRelayConfig
+	logger   *logrus.Logger
+}
+
+type outboxRow struct {
+	UpdateID  int64     `db:"update_id"`
+	Topic     string    `db:"topic"`
+	Key       string    `db:"key"`
+	Type      string    `db:"update_type"`
+	Payload   []byte    `db:"payload"`
+	CreatedAt time.Time `db:"created_at"`
+}
+
+func NewUpdatesRelay(db *sqlx.DB, p sarama.SyncProducer, cfg *UpdatesRelayConfig, logger *logrus.Logger) *UpdatesRelay {
+	return &UpdatesRelay{
+		db:       db,
+		producer: p,
+		cfg:      cfg,
+		logger:   logger,
+	}
+}
+
+// Run publishes pending updates and prunes old ones until ctx is done
+func (r *UpdatesRelay) Run(ctx context.Context) {
+	ticker := time.NewTicker(r.cfg.PollInterval)
+	defer ticker.Stop()
+
+	var lastPrune time.Time
+	for {
+		if r.cfg.Retention > 0 && time.Since(lastPrune) >= pruneInterval {
+			lastPrune = time.Now()
+			if _, err := r.Prune(ctx); err != nil {
+				r.logger.WithError(err).Error("can't prune sent updates")
+			}
+		}
+
+		count, err := r.PublishPending(ctx)
+		if err != nil {
+			r.logger.WithError(err).Error("can't publish pending updates")
+		} else if uint64(count) == r.cfg.BatchSize {
+			// Batch is full, so there may be more pending updates
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// PublishPending publishes one batch of pending updates and returns
+// how many of them were published. Advisory lock is held on a dedicated
+// connection while updates are sent, but rows are selected and marked
+// in short statements, so no transaction is kept open during sending
+func (r *UpdatesRelay) PublishPending(ctx context.Context) (int, error) {
+	conn, err := r.db.Connx(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	locked := false
+	err = conn.GetContext(ctx, &locked, "SELECT pg_try_advisory_lock($1)", relayLockKey)
+	if err != nil || !locked {
+		return 0, err
+	}
+
+	defer func() {
+		// Lock must be released before connection is returned to the pool
+		_, unlockErr := conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1)", relayLockKey)
+		if unlockErr != nil {
+			r.logger.WithError(unlockErr).Error("can't release relay lock")
+		}
+	}()
+
+	query, args, err := sq.Select("update_id", "topic", "key", "update_type", "payload", "created_at").
+		From("updates_outbox").
+		Where(sq.Eq{"sent_at": nil}).
+		OrderBy("update_id").
+		Limit(r.cfg.BatchSize).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+
+	if err != nil {
+		return 0, err
+	}
+
+	rows := make([]outboxRow, 0)
+	err = conn.SelectContext(ctx, &rows, query, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	sent := make([]int64, 0, len(rows))
+	var sendErr error
+	for _, row := range rows {
+		sendErr = r.send(row)
+
+		// Following updates are not published to keep the order
+		if sendErr != nil {
+			break
+		}
+		sent = append(sent, row.UpdateID)
+	}
+
+	if len(sent) > 0 {
+		query, args, err = sq.Update("updates_outbox").
+			Set("sent_at", time.Now().UTC()).
+			Where(sq.Eq{"update_id": sent}).
+			PlaceholderFormat(sq.Dollar).
+			ToSql()
+
+		if err != nil {
+			return 0, err
+		}
+
+		if _, err = conn.ExecContext(ctx, query, args...); err != nil {
+			return 0, err
+		}
+	}
+
+	if sendErr != nil {
+		r.logger.
+			WithError(sendErr).
+			WithField("published", len(sent)).
+			Error("publishing updates interrupted")
+	}
+
+	return len(sent), nil
+}
+
+// send publishes a single update and records its latency or failure
+func (r *UpdatesRelay) send(row outboxRow) error {
+	start := time.Now()
+	_, _, err := r.producer.SendMessage(&sarama.ProducerMessage{
+		Topic:     row.Topic,
+		Key:       sarama.StringEncoder(row.Key),
+		Value:     sarama.ByteEncoder(row.Payload),
+		Timestamp: row.CreatedAt,
+	})
+
+	if err != nil {
+		metrics.UpdatePublishFailures.WithLabelValues(row.Type).Inc()
+		return err
+	}
+
+	metrics.UpdatePublishDuration.WithLabelValues(row.Type).Observe(time.Since(start).Seconds())
+	return nil
+}
+
+// Prune deletes updates sent earlier than retention, users' references
+// to them are deleted by cascade. Returns how many updates were deleted
+func (r *UpdatesRelay) Prune(ctx context.Context) (int64, error) {
+	query, args, err := sq.Delete("updates_outbox").
+		Where(sq.Lt{"sent_at": time.Now().UTC().Add(-r.cfg.Retention)}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := r.db.ExecContext(ctx, query, args...)
+	if err != nil {
+		return 0, err
+	}
+
+	return res.RowsAffected()
+}
@@ -4,8 +4,10 @@ import (
 	"context"
 	"database/sql"
 	"fmt"
-	"github.com/Shopify/sarama"
 	"github.com/jmoiron/sqlx"
+	"github.com/practice-sem-2/user-service/internal/metrics"
+	"github.com/practice-sem-2/user-service/internal/pb/chats/updates"
+	"time"
 )
 
 type AtomicFunc func(Registry) error
@@ -16,11 +18,19 @@ type Registry interface {
 	GetUpdatesStore() *UpdatesStorage
 }
 
+// UpdatesPublisher receives updates once they are committed
+type UpdatesPublisher interface {
+	Publish(update *updates.Update)
+}
+
 type DefaultRegistry struct {
-	db       *sqlx.DB
-	scope    Scope
-	producer sarama.SyncProducer
-	cfg      *UpdatesStoreConfig
+	db        *sqlx.DB
+	scope     Scope
+	cfg       *UpdatesStoreConfig
+	publisher UpdatesPublisher
+	// saved collects updates written inside transaction, they are
+	// passed to publisher after commit
+	saved *[]*updates.Update
 }
 
 type Scope interface {
@@ -37,12 +47,12 @@ type Scope interface {
 	NamedQuery(query string, arg interface{}) (*sqlx.Rows, error)
 }
 
-func NewRegistry(db *sqlx.DB, p sarama.SyncProducer, cfg *UpdatesStoreConfig) *DefaultRegistry {
+func NewRegistry(db *sqlx.DB, cfg *UpdatesStoreConfig, p UpdatesPublisher) *DefaultRegistry {
 	return &DefaultRegistry{
-		db:       db,
-		scope:    db,
-		producer: p,
-		cfg:      cfg,
+		db:        db,
+		scope:     db,
+		cfg:       cfg,
+		publisher: p,
 	}
 }
 
@@ -52,25 +62,39 @@ func (r *DefaultRegistry) Atomic(ctx context.Context, fn AtomicFunc) (err error)
 		return err
 	}
 
+	saved := make([]*updates.Update, 0)
+	start := time.Now()
+
 	defer func() {
+		defer func() {
+			metrics.TransactionDuration.Observe(time.Since(start).Seconds())
+		}()
+
 		if p := recover(); p != nil {
 			_ = tx.Rollback()
+			metrics.TransactionRollbacks.Inc()
 			panic(p)
 		}
 		if err != nil {
+			metrics.TransactionRollbacks.Inc()
 			if rbErr := tx.Rollback(); rbErr != nil {
 				err = fmt.Errorf("rollback caused by error: \"%v\" failed: %v", err, rbErr)
 			}
 		} else {
 			err = tx.Commit()
 		}
+
+		if err == nil {
+			r.publish(saved)
+		}
 	}()
 
 	storage := DefaultRegistry{
-		db:       r.db,
-		scope:    tx,
-		producer: r.producer,
-		cfg:      r.cfg,
+		db:        r.db,
+		scope:     tx,
+		cfg:       r.cfg,
+		publisher: r.publisher,
+		saved:     &saved,
 	}
 	err = fn(&storage)
 	return err
@@ -81,5 +105,26 @@ func (r *DefaultRegistry) GetChatsStore() *ChatsStorage {
 }
 
 func (r *DefaultRegistry) GetUpdatesStore() *UpdatesStorage {
-	return NewUpdatesStore(r.producer, r.cfg)
+	store := NewUpdatesStore(r.scope, r.cfg)
+	store.onSaved = r.onUpdateSaved
+	return store
+}
+
+func (r *DefaultRegistry) onUpdateSaved(update *updates.Update) {
+	if r.saved != nil {
+		*r.saved = append(*r.saved, update)
+	} else {
+		// Outside of transaction update is already committed
+		r.publish([]*updates.Update{update})
+	}
+}
+
+func (r *DefaultRegistry) publish(saved []*updates.Update) {
+	if r.publisher == nil {
+		return
+	}
+
+	for _, update := range saved {
+		r.publisher.Publish(update)
+	}
 }
@@ -1,54 +1,294 @@
 package storage
 
 import (
-	"github.com/Shopify/sarama"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	sq "github.com/Masterminds/squirrel"
 	"github.com/practice-sem-2/user-service/internal/models"
 	"github.com/practice-sem-2/user-service/internal/pb/chats/updates"
 	"google.golang.org/protobuf/proto"
-	"time"
+	"sort"
+	"strings"
 )
 
+// UpdatesStorage writes updates into the outbox table. Being used inside
+// Registry.Atomic updates are saved only if the whole transaction is committed.
+// Saved updates are published to kafka by UpdatesRelay
 type UpdatesStorage struct {
-	cfg      *UpdatesStoreConfig
-	producer sarama.SyncProducer
+	cfg     *UpdatesStoreConfig
+	db      Scope
+	onSaved func(update *updates.Update)
 }
 
 type UpdatesStoreConfig struct {
 	UpdatesTopic string
 }
 
-func NewUpdatesStore(p sarama.SyncProducer, cfg *UpdatesStoreConfig) *UpdatesStorage {
+// keyLockSpace is the first key of advisory locks taken per update key.
+// Two-key locks don't conflict with the single-key relayLockKey
+const keyLockSpace = 1
+
+func NewUpdatesStore(db Scope, cfg *UpdatesStoreConfig) *UpdatesStorage {
 	return &UpdatesStorage{
-		producer: p,
-		cfg:      cfg,
+		db:  db,
+		cfg: cfg,
 	}
 }
 
-func (s *UpdatesStorage) putUpdate(topic, key string, event *updates.Update) error {
+// putUpdate saves the update to the outbox. Writers of the same key are
+// serialized by a transaction level lock taken before update_id is
+// generated, so ids of the key's updates follow commit order and relay
+// publishes them in order
+func (s *UpdatesStorage) putUpdate(ctx context.Context, topic, key string, event *updates.Update) error {
 	bytes, err := proto.Marshal(event)
 	if err != nil {
 		return err
 	}
-	_, _, err = s.producer.SendMessage(&sarama.ProducerMessage{
-		Topic:     topic,
-		Key:       sarama.StringEncoder(key),
-		Value:     sarama.ByteEncoder(bytes),
-		Timestamp: time.Time{},
-	})
+
+	if err = s.lockKey(ctx, key); err != nil {
+		return err
+	}
+
+	query, args, err := sq.Insert("updates_outbox").
+		Columns("topic", "key", "update_type", "payload").
+		Values(topic, key, updateTypeOf(event), bytes).
+		Suffix("RETURNING update_id").
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+
+	if err != nil {
+		return err
+	}
+
+	var updateId int64
+	err = s.db.GetContext(ctx, &updateId, query, args...)
+	if err != nil {
+		return err
+	}
+
+	err = s.fanOut(ctx, updateId, event.Meta.Audience)
+	if err != nil {
+		return err
+	}
+
+	if s.onSaved != nil {
+		s.onSaved(event)
+	}
+
+	return nil
+}
+
+func (s *UpdatesStorage) lockKey(ctx context.Context, key string) error {
+	_, err := s.db.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1, hashtext($2))", keyLockSpace, key)
 	return err
 }
 
+// LockAudience locks the chat's key and sequence states of the users in
+// the order used by every fan-out. Transaction writing updates of the chat
+// to different audiences must lock their union first, otherwise it may
+// deadlock with a transaction locking the same users in the other order
+func (s *UpdatesStorage) LockAudience(ctx context.Context, chatId string, audience []string) error {
+	if err := s.lockKey(ctx, chatId); err != nil {
+		return err
+	}
+
+	users := sortedUsers(audience)
+	if len(users) == 0 {
+		return nil
+	}
+
+	// Missing states are created with zero pts, so fan-out assigns 1
+	builder := sq.Insert("user_update_state").
+		Columns("user_id", "pts").
+		Suffix("ON CONFLICT (user_id) DO UPDATE SET pts = user_update_state.pts").
+		PlaceholderFormat(sq.Dollar)
+
+	for _, user := range users {
+		builder = builder.Values(user, 0)
+	}
+
+	query, args, err := builder.ToSql()
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx, query, args...)
+	return err
+}
+
+// sortedUsers returns unique users in the order their states are locked
+func sortedUsers(audience []string) []string {
+	users := make([]string, 0, len(audience))
+	seen := make(map[string]bool, len(audience))
+	for _, user := range audience {
+		if !seen[user] {
+			seen[user] = true
+			users = append(users, user)
+		}
+	}
+
+	sort.Strings(users)
+	return users
+}
+
+// updateTypeOf returns name of the update oneof wrapper, e.g. "Message"
+// for *updates.Update_Message. It is saved to the outbox to label relay metrics
+func updateTypeOf(event *updates.Update) string {
+	name := fmt.Sprintf("%T", event.Update)
+	return strings.TrimPrefix(name[strings.LastIndex(name, ".")+1:], "Update_")
+}
+
+type userUpdateState struct {
+	UserID string `db:"user_id"`
+	Pts    int64  `db:"pts"`
+}
+
+// fanOut assigns next sequence number of every audience member to the update
+func (s *UpdatesStorage) fanOut(ctx context.Context, updateId int64, audience []string) error {
+	// Users' states are always locked in the same order, transactions
+	// with several audiences lock them beforehand with LockAudience
+	users := sortedUsers(audience)
+	if len(users) == 0 {
+		return nil
+	}
+
+	builder := sq.Insert("user_update_state").
+		Columns("user_id", "pts").
+		Suffix("ON CONFLICT (user_id) DO UPDATE SET pts = user_update_state.pts + 1 RETURNING user_id, pts").
+		PlaceholderFormat(sq.Dollar)
+
+	for _, user := range users {
+		builder = builder.Values(user, 1)
+	}
+
+	query, args, err := builder.ToSql()
+	if err != nil {
+		return err
+	}
+
+	states := make([]userUpdateState, 0, len(users))
+
+	err = s.db.SelectContext(ctx, &states, query, args...)
+	if err != nil {
+		return err
+	}
+
+	builder = sq.Insert("user_updates").
+		Columns("user_id", "pts", "update_id").
+		PlaceholderFormat(sq.Dollar)
+
+	for _, state := range states {
+		builder = builder.Values(state.UserID, state.Pts, updateId)
+	}
+
+	query, args, err = builder.ToSql()
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx, query, args...)
+	return err
+}
+
+// GetUserPts returns the last user's update sequence number
+func (s *UpdatesStorage) GetUserPts(ctx context.Context, userId string) (int64, error) {
+	query, args, err := sq.Select("pts").
+		From("user_update_state").
+		Where(sq.Eq{"user_id": userId}).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+
+	if err != nil {
+		return 0, err
+	}
+
+	var pts int64
+	err = s.db.GetContext(ctx, &pts, query, args...)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+
+	return pts, nil
+}
+
+// SelectUserUpdates returns user's updates with pts greater than fromPts
+// in ascending order
+func (s *UpdatesStorage) SelectUserUpdates(ctx context.Context, userId string, fromPts int64, limit uint64) ([]models.UserUpdate, error) {
+	query, args, err := sq.Select("u.pts", "o.payload").
+		From("user_updates u").
+		Join("updates_outbox o USING(update_id)").
+		Where(sq.Eq{"u.user_id": userId}).
+		Where(sq.Gt{"u.pts": fromPts}).
+		OrderBy("u.pts").
+		Limit(limit).
+		PlaceholderFormat(sq.Dollar).
+		ToSql()
+
+	if err != nil {
+		return nil, err
+	}
+
+	userUpdates := make([]models.UserUpdate, 0)
+	err = s.db.SelectContext(ctx, &userUpdates, query, args...)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return userUpdates, nil
+}
+
+// metaToProtobuf keeps timestamp in seconds for old clients
+func (s *UpdatesStorage) metaToProtobuf(meta *models.UpdateMeta) *updates.UpdateMeta {
+	return &updates.UpdateMeta{
+		Timestamp:   meta.Timestamp.UTC().Unix(),
+		TimestampMs: meta.Timestamp.UTC().UnixMilli(),
+		Audience:    meta.Audience,
+	}
+}
+
 func (s *UpdatesStorage) chatCreatedToProtobuf(chat *models.ChatCreated) *updates.Update {
 	return &updates.Update{
-		Meta: &updates.UpdateMeta{
-			Timestamp: chat.Timestamp.UTC().Unix(),
-			Audience:  chat.Audience,
-		},
+		Meta: s.metaToProtobuf(&chat.UpdateMeta),
 		Update: &updates.Update_CreatedChat{
 			CreatedChat: &updates.ChatCreated{
-				ChatId:   chat.ChatID,
-				IsDirect: chat.IsDirect,
-				Members:  chat.Members,
+				ChatId:       chat.ChatID,
+				IsDirect:     chat.IsDirect,
+				Members:      chat.Members,
+				Title:        chat.Title,
+				Description:  chat.Description,
+				AvatarFileId: chat.AvatarFileID,
+			},
+		},
+	}
+}
+
+func (s *UpdatesStorage) chatInfoUpdatedToProtobuf(chat *models.ChatInfoUpdated) *updates.Update {
+	return &updates.Update{
+		Meta: s.metaToProtobuf(&chat.UpdateMeta),
+		Update: &updates.Update_ChatInfoUpdated{
+			ChatInfoUpdated: &updates.ChatInfoUpdated{
+				ChatId:       chat.ChatID,
+				UpdatedBy:    chat.UpdatedBy,
+				Title:        chat.Title,
+				Description:  chat.Description,
+				AvatarFileId: chat.AvatarFileID,
+			},
+		},
+	}
+}
+
+func (s *UpdatesStorage) chatDeletedToProtobuf(chat *models.ChatDeleted) *updates.Update {
+	return &updates.Update{
+		Meta: s.metaToProtobuf(&chat.UpdateMeta),
+		Update: &updates.Update_DeletedChat{
+			DeletedChat: &updates.ChatDeleted{
+				ChatId: chat.ChatID,
 			},
 		},
 	}
@@ -68,69 +308,300 @@ func (s *UpdatesStorage) messageSentToProtobuf(msg *models.MessageSent) *updates
 		attachments = make([]*updates.FileAttachment, 0, 0)
 	}
 	return &updates.Update{
-		Meta: &updates.UpdateMeta{
-			Timestamp: msg.Timestamp.UTC().Unix(),
-			Audience:  msg.Audience,
-		},
+		Meta: s.metaToProtobuf(&msg.UpdateMeta),
 		Update: &updates.Update_Message{
 			Message: &updates.MessageSent{
-				MessageId:   msg.MessageID,
-				FromUser:    msg.FromUser,
-				ChatId:      msg.ChatID,
-				Text:        msg.Text,
-				ReplyTo:     msg.ReplyTo,
-				Attachments: attachments,
+				MessageId:     msg.MessageID,
+				FromUser:      msg.FromUser,
+				ChatId:        msg.ChatID,
+				Text:          msg.Text,
+				ReplyTo:       msg.ReplyTo,
+				Attachments:   attachments,
+				ForwardedFrom: s.forwardOriginToProtobuf(&msg.ForwardOrigin),
+				ThreadRootId:  msg.ThreadRootID,
 			},
 		},
 	}
 }
 
-func (s *UpdatesStorage) memberAddedToProtobuf(member *models.MemberAdded) *updates.Update {
+func (s *UpdatesStorage) forwardOriginToProtobuf(origin *models.ForwardOrigin) *updates.ForwardOrigin {
+	if origin.ForwardedFromUser == nil {
+		return nil
+	}
+
+	res := &updates.ForwardOrigin{
+		ChatId:    origin.ForwardedFromChat,
+		MessageId: origin.ForwardedFromMessage,
+		FromUser:  *origin.ForwardedFromUser,
+	}
+	if origin.ForwardedSendingTime != nil {
+		res.SendingTime = origin.ForwardedSendingTime.UTC().Unix()
+		res.SendingTimeMs = origin.ForwardedSendingTime.UTC().UnixMilli()
+	}
+	return res
+}
+
+func (s *UpdatesStorage) messageEditedToProtobuf(msg *models.MessageEdited) *updates.Update {
+	return &updates.Update{
+		Meta: s.metaToProtobuf(&msg.UpdateMeta),
+		Update: &updates.Update_MessageEdited{
+			MessageEdited: &updates.MessageEdited{
+				MessageId:  msg.MessageID,
+				ChatId:     msg.ChatID,
+				Text:       msg.Text,
+				EditedAt:   msg.EditedAt.UTC().Unix(),
+				EditedAtMs: msg.EditedAt.UTC().UnixMilli(),
+			},
+		},
+	}
+}
+
+func (s *UpdatesStorage) messageDeletedToProtobuf(msg *models.MessageDeleted) *updates.Update {
+	return &updates.Update{
+		Meta: s.metaToProtobuf(&msg.UpdateMeta),
+		Update: &updates.Update_MessageDeleted{
+			MessageDeleted: &updates.MessageDeleted{
+				ChatId:     msg.ChatID,
+				MessageIds: msg.MessageIDs,
+			},
+		},
+	}
+}
+
+func (s *UpdatesStorage) readMarkerUpdatedToProtobuf(marker *models.ReadMarkerUpdated) *updates.Update {
+	return &updates.Update{
+		Meta: s.metaToProtobuf(&marker.UpdateMeta),
+		Update: &updates.Update_ReadMarkerUpdated{
+			ReadMarkerUpdated: &updates.ReadMarkerUpdated{
+				ChatId:    marker.ChatID,
+				MessageId: marker.MessageID,
+			},
+		},
+	}
+}
+
+func (s *UpdatesStorage) messagesReadToProtobuf(read *models.MessagesRead) *updates.Update {
 	return &updates.Update{
-		Meta: &updates.UpdateMeta{
-			Timestamp: member.Timestamp.UTC().Unix(),
-			Audience:  member.Audience,
+		Meta: s.metaToProtobuf(&read.UpdateMeta),
+		Update: &updates.Update_MessagesRead{
+			MessagesRead: &updates.MessagesRead{
+				ChatId:    read.ChatID,
+				Username:  read.Username,
+				MessageId: read.MessageID,
+			},
+		},
+	}
+}
+
+func (s *UpdatesStorage) reactionChangedToProtobuf(r *models.ReactionChanged) *updates.Update {
+	return &updates.Update{
+		Meta: s.metaToProtobuf(&r.UpdateMeta),
+		Update: &updates.Update_ReactionChanged{
+			ReactionChanged: &updates.ReactionChanged{
+				ChatId:    r.ChatID,
+				MessageId: r.MessageID,
+				Username:  r.Username,
+				Reaction:  r.Reaction,
+				Added:     r.Added,
+				Count:     r.Count,
+			},
+		},
+	}
+}
+
+func (s *UpdatesStorage) messagePinnedToProtobuf(pin *models.MessagePinned) *updates.Update {
+	return &updates.Update{
+		Meta: s.metaToProtobuf(&pin.UpdateMeta),
+		Update: &updates.Update_MessagePinned{
+			MessagePinned: &updates.MessagePinned{
+				ChatId:    pin.ChatID,
+				MessageId: pin.MessageID,
+				PinnedBy:  pin.PinnedBy,
+			},
+		},
+	}
+}
+
+func (s *UpdatesStorage) messageUnpinnedToProtobuf(pin *models.MessageUnpinned) *updates.Update {
+	return &updates.Update{
+		Meta: s.metaToProtobuf(&pin.UpdateMeta),
+		Update: &updates.Update_MessageUnpinned{
+			MessageUnpinned: &updates.MessageUnpinned{
+				ChatId:     pin.ChatID,
+				MessageId:  pin.MessageID,
+				UnpinnedBy: pin.UnpinnedBy,
+			},
+		},
+	}
+}
+
+func (s *UpdatesStorage) threadUpdatedToProtobuf(thread *models.ThreadUpdated) *updates.Update {
+	var lastReplyAt, lastReplyAtMs *int64
+	if thread.LastReplyAt != nil {
+		lastReplyAt, lastReplyAtMs = new(int64), new(int64)
+		*lastReplyAt = thread.LastReplyAt.UTC().Unix()
+		*lastReplyAtMs = thread.LastReplyAt.UTC().UnixMilli()
+	}
+	return &updates.Update{
+		Meta: s.metaToProtobuf(&thread.UpdateMeta),
+		Update: &updates.Update_ThreadUpdated{
+			ThreadUpdated: &updates.ThreadUpdated{
+				ChatId:        thread.ChatID,
+				RootMessageId: thread.RootID,
+				ReplyCount:    thread.ReplyCount,
+				LastReplyAt:   lastReplyAt,
+				LastReplyAtMs: lastReplyAtMs,
+			},
 		},
+	}
+}
+
+func (s *UpdatesStorage) memberAddedToProtobuf(member *models.MemberAdded) *updates.Update {
+	return &updates.Update{
+		Meta: s.metaToProtobuf(&member.UpdateMeta),
 		Update: &updates.Update_MemberAdded{
 			MemberAdded: &updates.MemberAdded{
 				ChatId:   member.ChatID,
 				Username: member.Username,
+				Actor:    member.Actor,
 			},
 		},
 	}
 }
 
-func (s *UpdatesStorage) memberRemovedToProtobuf(member *models.MemberRemoved) *updates.Update {
+func (s *UpdatesStorage) membersAddedToProtobuf(members *models.MembersAdded) *updates.Update {
 	return &updates.Update{
-		Meta: &updates.UpdateMeta{
-			Timestamp: member.Timestamp.UTC().Unix(),
-			Audience:  member.Audience,
+		Meta: s.metaToProtobuf(&members.UpdateMeta),
+		Update: &updates.Update_MembersAdded{
+			MembersAdded: &updates.MembersAdded{
+				ChatId:    members.ChatID,
+				Usernames: members.Usernames,
+				Actor:     members.Actor,
+			},
+		},
+	}
+}
+
+func (s *UpdatesStorage) memberRoleChangedToProtobuf(member *models.MemberRoleChanged) *updates.Update {
+	return &updates.Update{
+		Meta: s.metaToProtobuf(&member.UpdateMeta),
+		Update: &updates.Update_MemberRoleChanged{
+			MemberRoleChanged: &updates.MemberRoleChanged{
+				ChatId:   member.ChatID,
+				Username: member.Username,
+				Role:     string(member.Role),
+			},
 		},
+	}
+}
+
+func (s *UpdatesStorage) memberRemovedToProtobuf(member *models.MemberRemoved) *updates.Update {
+	return &updates.Update{
+		Meta: s.metaToProtobuf(&member.UpdateMeta),
 		Update: &updates.Update_MemberRemoved{
 			MemberRemoved: &updates.MemberRemoved{
 				ChatId:   member.ChatID,
 				Username: member.Username,
+				Actor:    member.Actor,
+			},
+		},
+	}
+}
+
+func (s *UpdatesStorage) membersRemovedToProtobuf(members *models.MembersRemoved) *updates.Update {
+	return &updates.Update{
+		Meta: s.metaToProtobuf(&members.UpdateMeta),
+		Update: &updates.Update_MembersRemoved{
+			MembersRemoved: &updates.MembersRemoved{
+				ChatId:    members.ChatID,
+				Usernames: members.Usernames,
+				Actor:     members.Actor,
 			},
 		},
 	}
 }
 
-func (s *UpdatesStorage) ChatCreated(chat *models.ChatCreated) error {
+func (s *UpdatesStorage) ChatCreated(ctx context.Context, chat *models.ChatCreated) error {
 	update := s.chatCreatedToProtobuf(chat)
-	return s.putUpdate(s.cfg.UpdatesTopic, chat.ChatID, update)
+	return s.putUpdate(ctx, s.cfg.UpdatesTopic, chat.ChatID, update)
 }
 
-func (s *UpdatesStorage) MessageSent(msg *models.MessageSent) error {
+func (s *UpdatesStorage) ChatInfoUpdated(ctx context.Context, chat *models.ChatInfoUpdated) error {
+	update := s.chatInfoUpdatedToProtobuf(chat)
+	return s.putUpdate(ctx, s.cfg.UpdatesTopic, chat.ChatID, update)
+}
+
+func (s *UpdatesStorage) ChatDeleted(ctx context.Context, chat *models.ChatDeleted) error {
+	update := s.chatDeletedToProtobuf(chat)
+	return s.putUpdate(ctx, s.cfg.UpdatesTopic, chat.ChatID, update)
+}
+
+func (s *UpdatesStorage) MessageSent(ctx context.Context, msg *models.MessageSent) error {
 	update := s.messageSentToProtobuf(msg)
-	return s.putUpdate(s.cfg.UpdatesTopic, msg.ChatID, update)
+	return s.putUpdate(ctx, s.cfg.UpdatesTopic, msg.ChatID, update)
+}
+
+func (s *UpdatesStorage) MessageEdited(ctx context.Context, msg *models.MessageEdited) error {
+	update := s.messageEditedToProtobuf(msg)
+	return s.putUpdate(ctx, s.cfg.UpdatesTopic, msg.ChatID, update)
+}
+
+func (s *UpdatesStorage) MessageDeleted(ctx context.Context, msg *models.MessageDeleted) error {
+	update := s.messageDeletedToProtobuf(msg)
+	return s.putUpdate(ctx, s.cfg.UpdatesTopic, msg.ChatID, update)
+}
+
+func (s *UpdatesStorage) ReadMarkerUpdated(ctx context.Context, marker *models.ReadMarkerUpdated) error {
+	update := s.readMarkerUpdatedToProtobuf(marker)
+	return s.putUpdate(ctx, s.cfg.UpdatesTopic, marker.ChatID, update)
+}
+
+func (s *UpdatesStorage) MessagesRead(ctx context.Context, read *models.MessagesRead) error {
+	update := s.messagesReadToProtobuf(read)
+	return s.putUpdate(ctx, s.cfg.UpdatesTopic, read.ChatID, update)
+}
+
+func (s *UpdatesStorage) ReactionChanged(ctx context.Context, r *models.ReactionChanged) error {
+	update := s.reactionChangedToProtobuf(r)
+	return s.putUpdate(ctx, s.cfg.UpdatesTopic, r.ChatID, update)
+}
+
+func (s *UpdatesStorage) MessagePinned(ctx context.Context, pin *models.MessagePinned) error {
+	update := s.messagePinnedToProtobuf(pin)
+	return s.putUpdate(ctx, s.cfg.UpdatesTopic, pin.ChatID, update)
+}
+
+func (s *UpdatesStorage) MessageUnpinned(ctx context.Context, pin *models.MessageUnpinned) error {
+	update := s.messageUnpinnedToProtobuf(pin)
+	return s.putUpdate(ctx, s.cfg.UpdatesTopic, pin.ChatID, update)
+}
+
+func (s *UpdatesStorage) ThreadUpdated(ctx context.Context, thread *models.ThreadUpdated) error {
+	update := s.threadUpdatedToProtobuf(thread)
+	return s.putUpdate(ctx, s.cfg.UpdatesTopic, thread.ChatID, update)
 }
 
-func (s *UpdatesStorage) MemberAdded(member *models.MemberAdded) error {
+func (s *UpdatesStorage) MemberAdded(ctx context.Context, member *models.MemberAdded) error {
 	update := s.memberAddedToProtobuf(member)
-	return s.putUpdate(s.cfg.UpdatesTopic, member.ChatID, update)
+	return s.putUpdate(ctx, s.cfg.UpdatesTopic, member.ChatID, update)
 }
 
-func (s *UpdatesStorage) MemberRemoved(member *models.MemberRemoved) error {
+func (s *UpdatesStorage) MembersAdded(ctx context.Context, members *models.MembersAdded) error {
+	update := s.membersAddedToProtobuf(members)
+	return s.putUpdate(ctx, s.cfg.UpdatesTopic, members.ChatID, update)
+}
+
+func (s *UpdatesStorage) MemberRoleChanged(ctx context.Context, member *models.MemberRoleChanged) error {
+	update := s.memberRoleChangedToProtobuf(member)
+	return s.putUpdate(ctx, s.cfg.UpdatesTopic, member.ChatID, update)
+}
+
+func (s *UpdatesStorage) MemberRemoved(ctx context.Context, member *models.MemberRemoved) error {
 	update := s.memberRemovedToProtobuf(member)
-	return s.putUpdate(s.cfg.UpdatesTopic, member.ChatID, update)
+	return s.putUpdate(ctx, s.cfg.UpdatesTopic, member.ChatID, update)
+}
+
+func (s *UpdatesStorage) MembersRemoved(ctx context.Context, members *models.MembersRemoved) error {
+	update := s.membersRemovedToProtobuf(members)
+	return s.putUpdate(ctx, s.cfg.UpdatesTopic, members.ChatID, update)
 }
@@ -2,9 +2,16 @@ package storage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/Shopify/sarama"
+	"github.com/Shopify/sarama/mocks"
+	"github.com/practice-sem-2/user-service/internal/metrics"
 	"github.com/practice-sem-2/user-service/internal/models"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -16,7 +23,7 @@ import (
 )
 
 type EventsTestSuite struct {
-	suite.Suite
+	PostgresTestSuite
 	p sarama.SyncProducer
 	c sarama.Consumer
 }
@@ -24,9 +31,16 @@ type EventsTestSuite struct {
 func (s *EventsTestSuite) TearDownSuite() {
 	err := s.p.Close()
 	require.NoError(s.T(), err, "Sarama producer should be closed correctly")
+	s.PostgresTestSuite.TearDownSuite()
+}
+
+func (s *EventsTestSuite) TearDownTest() {
+	_, err := s.db.Exec("TRUNCATE updates_outbox, user_updates, user_update_state")
+	require.NoError(s.T(), err, "can't teardown test")
 }
 
 func (s *EventsTestSuite) SetupSuite() {
+	s.PostgresTestSuite.SetupSuite()
 	viper.AutomaticEnv()
 	brokers := viper.GetString("KAFKA_BROKERS")
 
@@ -55,6 +69,13 @@ func TestEventsSuite(t *testing.T) {
 	suite.Run(t, &EventsTestSuite{})
 }
 
+func (s *EventsTestSuite) newRelay() *UpdatesRelay {
+	return NewUpdatesRelay(s.db, s.p, &UpdatesRelayConfig{
+		PollInterval: time.Second,
+		BatchSize:    100,
+	}, logrus.New())
+}
+
 func (s *EventsTestSuite) Test_EventsStorage_MemberAdded() {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -73,11 +94,16 @@ func (s *EventsTestSuite) Test_EventsStorage_MemberAdded() {
 		},
 		ChatID:   "256e3354-8263-4913-8bdd-345bd04d962e",
 		Username: "johndoe",
+		Actor:    "janedoe",
 	}
-	store := NewUpdatesStore(s.p, &UpdatesStoreConfig{UpdatesTopic: "test"})
-	err = store.MemberAdded(&update)
+	store := NewUpdatesStore(s.db, &UpdatesStoreConfig{UpdatesTopic: "test"})
+	err = store.MemberAdded(ctx, &update)
 	assert.NoError(s.T(), err, "event should be pushed without error")
 
+	count, err := s.newRelay().PublishPending(ctx)
+	assert.NoError(s.T(), err, "event should be published without error")
+	assert.Equal(s.T(), 1, count, "exactly one event should be published")
+
 	select {
 	case msg := <-consumer.Messages():
 		body, err := proto.Marshal(store.memberAddedToProtobuf(&update))
@@ -91,6 +117,46 @@ func (s *EventsTestSuite) Test_EventsStorage_MemberAdded() {
 
 }
 
+func (s *EventsTestSuite) Test_EventsStorage_MembersAdded() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	consumer, err := s.c.ConsumePartition("test", 0, sarama.OffsetNewest)
+	require.NoError(s.T(), err, "create consume partition")
+	defer consumer.Close()
+
+	update := models.MembersAdded{
+		UpdateMeta: models.UpdateMeta{
+			Timestamp: time.Now().UTC(),
+			Audience: []string{
+				"253becbb-76b1-4471-9ff3-529462925899",
+				"1230cadb-899e-4710-8cdd-0a2f83882712",
+			},
+		},
+		ChatID:    "256e3354-8263-4913-8bdd-345bd04d962e",
+		Usernames: []string{"johndoe", "janedoe"},
+		Actor:     "alice",
+	}
+	store := NewUpdatesStore(s.db, &UpdatesStoreConfig{UpdatesTopic: "test"})
+	err = store.MembersAdded(ctx, &update)
+	assert.NoError(s.T(), err, "event should be pushed without error")
+
+	count, err := s.newRelay().PublishPending(ctx)
+	assert.NoError(s.T(), err, "event should be published without error")
+	assert.Equal(s.T(), 1, count, "the whole batch should be published as one event")
+
+	select {
+	case msg := <-consumer.Messages():
+		body, err := proto.Marshal(store.membersAddedToProtobuf(&update))
+		require.NoError(s.T(), err)
+
+		assert.Equal(s.T(), update.ChatID, string(msg.Key))
+		assert.Equal(s.T(), body, msg.Value)
+	case _ = <-ctx.Done():
+		assert.FailNow(s.T(), "Timeout")
+	}
+}
+
 func (s *EventsTestSuite) Test_EventsStorage_MemberRemoved() {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -109,11 +175,16 @@ func (s *EventsTestSuite) Test_EventsStorage_MemberRemoved() {
 		},
 		ChatID:   "256e3354-8263-4913-8bdd-345bd04d962e",
 		Username: "johndoe",
+		Actor:    "janedoe",
 	}
-	store := NewUpdatesStore(s.p, &UpdatesStoreConfig{UpdatesTopic: "test"})
-	err = store.MemberRemoved(&update)
+	store := NewUpdatesStore(s.db, &UpdatesStoreConfig{UpdatesTopic: "test"})
+	err = store.MemberRemoved(ctx, &update)
 	assert.NoError(s.T(), err, "event should be pushed without error")
 
+	count, err := s.newRelay().PublishPending(ctx)
+	assert.NoError(s.T(), err, "event should be published without error")
+	assert.Equal(s.T(), 1, count, "exactly one event should be published")
+
 	select {
 	case msg := <-consumer.Messages():
 		body, err := proto.Marshal(store.memberRemovedToProtobuf(&update))
@@ -126,3 +197,293 @@ func (s *EventsTestSuite) Test_EventsStorage_MemberRemoved() {
 	}
 
 }
+
+func (s *EventsTestSuite) Test_UpdatesRelay_SkipsRolledBackUpdates() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	registry := NewRegistry(s.db, &UpdatesStoreConfig{UpdatesTopic: "test"}, nil)
+	err := registry.Atomic(ctx, func(r Registry) error {
+		err := r.GetUpdatesStore().MemberAdded(ctx, &models.MemberAdded{
+			UpdateMeta: models.UpdateMeta{
+				Timestamp: time.Now().UTC(),
+				Audience:  []string{"253becbb-76b1-4471-9ff3-529462925899"},
+			},
+			ChatID:   "256e3354-8263-4913-8bdd-345bd04d962e",
+			Username: "johndoe",
+		})
+		require.NoError(s.T(), err, "event should be pushed without error")
+		return errors.New("bang")
+	})
+	assert.Error(s.T(), err, "should return error")
+
+	count, err := s.newRelay().PublishPending(ctx)
+	assert.NoError(s.T(), err, "should not return any error")
+	assert.Equal(s.T(), 0, count, "updates of rolled back transaction should not be published")
+}
+
+func (s *EventsTestSuite) Test_UpdatesRelay_MarksUpdatesSent() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	store := NewUpdatesStore(s.db, &UpdatesStoreConfig{UpdatesTopic: "test"})
+	for i := 0; i < 3; i++ {
+		err := store.MemberRemoved(ctx, &models.MemberRemoved{
+			UpdateMeta: models.UpdateMeta{
+				Timestamp: time.Now().UTC(),
+				Audience:  []string{"253becbb-76b1-4471-9ff3-529462925899"},
+			},
+			ChatID:   "256e3354-8263-4913-8bdd-345bd04d962e",
+			Username: fmt.Sprintf("johndoe%d", i),
+		})
+		require.NoError(s.T(), err, "event should be pushed without error")
+	}
+
+	relay := s.newRelay()
+	count, err := relay.PublishPending(ctx)
+	assert.NoError(s.T(), err, "should not return any error")
+	assert.Equal(s.T(), 3, count, "all pending updates should be published")
+
+	count, err = relay.PublishPending(ctx)
+	assert.NoError(s.T(), err, "should not return any error")
+	assert.Equal(s.T(), 0, count, "sent updates should not be published again")
+}
+
+func (s *EventsTestSuite) Test_UpdatesRelay_PrunesSentUpdates() {
+	const alice = "253becbb-76b1-4471-9ff3-529462925899"
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	store := NewUpdatesStore(s.db, &UpdatesStoreConfig{UpdatesTopic: "test"})
+	for i := 0; i < 2; i++ {
+		err := store.MemberRemoved(ctx, &models.MemberRemoved{
+			UpdateMeta: models.UpdateMeta{
+				Timestamp: time.Now().UTC(),
+				Audience:  []string{alice},
+			},
+			ChatID:   "256e3354-8263-4913-8bdd-345bd04d962e",
+			Username: fmt.Sprintf("johndoe%d", i),
+		})
+		require.NoError(s.T(), err, "event should be pushed without error")
+	}
+
+	// Only the first update is sent long ago
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE updates_outbox SET sent_at = (now() at time zone 'utc') - interval '2 hours'
+		WHERE update_id = (SELECT min(update_id) FROM updates_outbox)`)
+	require.NoError(s.T(), err)
+
+	relay := NewUpdatesRelay(s.db, s.p, &UpdatesRelayConfig{
+		PollInterval: time.Second,
+		BatchSize:    100,
+		Retention:    time.Hour,
+	}, logrus.New())
+	pruned, err := relay.Prune(ctx)
+	assert.NoError(s.T(), err, "should not return any error")
+	assert.Equal(s.T(), int64(1), pruned, "only updates sent before retention should be deleted")
+
+	updates, err := store.SelectUserUpdates(ctx, alice, 0, 10)
+	assert.NoError(s.T(), err, "should not return any error")
+	require.Len(s.T(), updates, 1, "user's references to pruned updates should be deleted")
+	assert.Equal(s.T(), int64(2), updates[0].Pts)
+}
+
+func (s *EventsTestSuite) Test_UpdatesStorage_AssignsUserPts() {
+	const alice = "253becbb-76b1-4471-9ff3-529462925899"
+	const bob = "1230cadb-899e-4710-8cdd-0a2f83882712"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	store := NewUpdatesStore(s.db, &UpdatesStoreConfig{UpdatesTopic: "test"})
+	audiences := [][]string{{alice, bob}, {alice}, {alice, bob}}
+	for _, audience := range audiences {
+		err := store.MemberAdded(ctx, &models.MemberAdded{
+			UpdateMeta: models.UpdateMeta{
+				Timestamp: time.Now().UTC(),
+				Audience:  audience,
+			},
+			ChatID:   "256e3354-8263-4913-8bdd-345bd04d962e",
+			Username: "johndoe",
+		})
+		require.NoError(s.T(), err, "event should be pushed without error")
+	}
+
+	pts, err := store.GetUserPts(ctx, alice)
+	assert.NoError(s.T(), err, "should not return any error")
+	assert.Equal(s.T(), int64(3), pts, "every update should increment pts")
+
+	pts, err = store.GetUserPts(ctx, bob)
+	assert.NoError(s.T(), err, "should not return any error")
+	assert.Equal(s.T(), int64(2), pts, "only updates with user in audience should increment pts")
+
+	userUpdates, err := store.SelectUserUpdates(ctx, alice, 1, 10)
+	assert.NoError(s.T(), err, "should not return any error")
+	require.Len(s.T(), userUpdates, 2, "updates after provided pts should be returned")
+	assert.Equal(s.T(), int64(2), userUpdates[0].Pts)
+	assert.Equal(s.T(), int64(3), userUpdates[1].Pts)
+
+	pts, err = store.GetUserPts(ctx, "unknown")
+	assert.NoError(s.T(), err, "should not return any error")
+	assert.Equal(s.T(), int64(0), pts, "user without updates should have zero pts")
+}
+
+func (s *EventsTestSuite) Test_UpdatesRelay_Metrics() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	store := NewUpdatesStore(s.db, &UpdatesStoreConfig{UpdatesTopic: "test"})
+	err := store.MemberAdded(ctx, &models.MemberAdded{
+		UpdateMeta: models.UpdateMeta{
+			Timestamp: time.Now().UTC(),
+			Audience:  []string{"253becbb-76b1-4471-9ff3-529462925899"},
+		},
+		ChatID:   "256e3354-8263-4913-8bdd-345bd04d962e",
+		Username: "johndoe",
+	})
+	require.NoError(s.T(), err, "event should be pushed without error")
+
+	err = store.MemberRemoved(ctx, &models.MemberRemoved{
+		UpdateMeta: models.UpdateMeta{
+			Timestamp: time.Now().UTC(),
+			Audience:  []string{"253becbb-76b1-4471-9ff3-529462925899"},
+		},
+		ChatID:   "256e3354-8263-4913-8bdd-345bd04d962e",
+		Username: "johndoe",
+	})
+	require.NoError(s.T(), err, "event should be pushed without error")
+
+	types := make([]string, 0)
+	err = s.db.SelectContext(ctx, &types, "SELECT update_type FROM updates_outbox ORDER BY update_id")
+	require.NoError(s.T(), err)
+	assert.Equal(s.T(), []string{"MemberAdded", "MemberRemoved"}, types, "type of updates should be saved")
+
+	published := histogramCount(s.T(), metrics.UpdatePublishDuration.WithLabelValues("MemberAdded"))
+	failures := testutil.ToFloat64(metrics.UpdatePublishFailures.WithLabelValues("MemberRemoved"))
+
+	producer := mocks.NewSyncProducer(s.T(), nil)
+	producer.ExpectSendMessageAndSucceed()
+	producer.ExpectSendMessageAndFail(sarama.ErrOutOfBrokers)
+	defer producer.Close()
+
+	relay := NewUpdatesRelay(s.db, producer, &UpdatesRelayConfig{
+		PollInterval: time.Second,
+		BatchSize:    100,
+	}, logrus.New())
+
+	count, err := relay.PublishPending(ctx)
+	assert.NoError(s.T(), err, "should not return any error")
+	assert.Equal(s.T(), 1, count, "only the first update should be published")
+
+	assert.Equal(s.T(), published+1, histogramCount(s.T(), metrics.UpdatePublishDuration.WithLabelValues("MemberAdded")),
+		"latency of published update should be observed")
+	assert.Equal(s.T(), failures+1, testutil.ToFloat64(metrics.UpdatePublishFailures.WithLabelValues("MemberRemoved")),
+		"failed update should be counted")
+}
+
+// histogramCount returns how many values were observed by histogram
+func histogramCount(t *testing.T, o prometheus.Observer) uint64 {
+	m := &dto.Metric{}
+	require.NoError(t, o.(prometheus.Metric).Write(m))
+	return m.GetHistogram().GetSampleCount()
+}
+
+func (s *EventsTestSuite) Test_UpdatesStorage_SerializesWritersOfKey() {
+	const chatId = "256e3354-8263-4913-8bdd-345bd04d962e"
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	registry := NewRegistry(s.db, &UpdatesStoreConfig{UpdatesTopic: "test"}, nil)
+
+	// First transaction writes an update of the chat and doesn't commit
+	written := make(chan struct{})
+	release := make(chan struct{})
+	first := make(chan error, 1)
+	go func() {
+		first <- registry.Atomic(ctx, func(r Registry) error {
+			err := r.GetUpdatesStore().MemberAdded(ctx, &models.MemberAdded{
+				UpdateMeta: models.UpdateMeta{
+					Timestamp: time.Now().UTC(),
+					Audience:  []string{"253becbb-76b1-4471-9ff3-529462925899"},
+				},
+				ChatID:   chatId,
+				Username: "johndoe",
+			})
+			close(written)
+			if err != nil {
+				return err
+			}
+			<-release
+			return nil
+		})
+	}()
+	<-written
+
+	// Audience is different, so only the key lock can block the second one
+	second := make(chan error, 1)
+	go func() {
+		second <- registry.Atomic(ctx, func(r Registry) error {
+			return r.GetUpdatesStore().MemberRemoved(ctx, &models.MemberRemoved{
+				UpdateMeta: models.UpdateMeta{
+					Timestamp: time.Now().UTC(),
+					Audience:  []string{"1230cadb-899e-4710-8cdd-0a2f83882712"},
+				},
+				ChatID:   chatId,
+				Username: "janedoe",
+			})
+		})
+	}()
+
+	require.Eventually(s.T(), func() bool {
+		waiting := 0
+		err := s.db.GetContext(ctx, &waiting, "SELECT count(*) FROM pg_stat_activity WHERE wait_event_type = 'Lock'")
+		return err == nil && waiting > 0
+	}, 3*time.Second, 10*time.Millisecond, "writer of the same key should wait for commit")
+
+	close(release)
+	require.NoError(s.T(), <-first)
+	require.NoError(s.T(), <-second)
+
+	types := make([]string, 0)
+	err := s.db.SelectContext(ctx, &types, "SELECT update_type FROM updates_outbox ORDER BY update_id")
+	require.NoError(s.T(), err)
+	assert.Equal(s.T(), []string{"MemberAdded", "MemberRemoved"}, types, "ids should follow commit order")
+}
+
+func (s *EventsTestSuite) Test_UpdatesStorage_LockAudience() {
+	const alice = "253becbb-76b1-4471-9ff3-529462925899"
+	const bob = "1230cadb-899e-4710-8cdd-0a2f83882712"
+	const chatId = "256e3354-8263-4913-8bdd-345bd04d962e"
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	store := NewUpdatesStore(s.db, &UpdatesStoreConfig{UpdatesTopic: "test"})
+	err := store.MemberAdded(ctx, &models.MemberAdded{
+		UpdateMeta: models.UpdateMeta{Timestamp: time.Now().UTC(), Audience: []string{alice}},
+		ChatID:     chatId,
+		Username:   "johndoe",
+	})
+	require.NoError(s.T(), err, "event should be pushed without error")
+
+	err = store.LockAudience(ctx, chatId, []string{bob, alice, bob})
+	require.NoError(s.T(), err, "audience should be locked")
+
+	pts, err := store.GetUserPts(ctx, alice)
+	require.NoError(s.T(), err)
+	assert.Equal(s.T(), int64(1), pts, "locking should not change existing state")
+
+	pts, err = store.GetUserPts(ctx, bob)
+	require.NoError(s.T(), err)
+	assert.Equal(s.T(), int64(0), pts, "missing state should be created empty")
+
+	err = store.MemberRemoved(ctx, &models.MemberRemoved{
+		UpdateMeta: models.UpdateMeta{Timestamp: time.Now().UTC(), Audience: []string{bob}},
+		ChatID:     chatId,
+		Username:   "johndoe",
+	})
+	require.NoError(s.T(), err, "event should be pushed without error")
+
+	pts, err = store.GetUserPts(ctx, bob)
+	require.NoError(s.T(), err)
+	assert.Equal(s.T(), int64(1), pts, "first update of locked user should get pts 1")
+}
@@ -5,7 +5,10 @@ import (
 	"errors"
 	"fmt"
 	"github.com/Masterminds/squirrel"
+	"github.com/google/uuid"
 	"github.com/practice-sem-2/auth-tools"
+	"github.com/practice-sem-2/user-service/internal/broker"
+	"github.com/practice-sem-2/user-service/internal/metrics"
 	"github.com/practice-sem-2/user-service/internal/models"
 	storage "github.com/practice-sem-2/user-service/internal/storages"
 	"time"
@@ -15,24 +18,121 @@ var (
 	ErrPermissionDenied       = errors.New("user is not authorized to this action")
 	ErrAuthenticationRequired = fmt.Errorf("%w: Authentication required", ErrPermissionDenied)
 	ErrUserIsNotAChatMember   = fmt.Errorf("%w: User is not a chat member", ErrPermissionDenied)
+	ErrUserIsNotMessageAuthor = fmt.Errorf("%w: User is not a message author", ErrPermissionDenied)
 	ErrBusinessLogicViolation = errors.New("business logic violation")
+	ErrDirectChatInfo         = fmt.Errorf("%w: direct chat can't have title, description or avatar", ErrBusinessLogicViolation)
+	ErrReadReceiptsDisabled   = fmt.Errorf("%w: read receipts are disabled in this chat", ErrBusinessLogicViolation)
+	ErrReactionNotAllowed     = errors.New("reaction is not allowed")
+	ErrDirectChatLeave        = fmt.Errorf("%w: direct chat can't be left, it can only be deleted", ErrBusinessLogicViolation)
+	ErrMessageIdConflict      = fmt.Errorf("%w: id is used by a different message", storage.ErrMessageAlreadyExists)
 )
 
+const (
+	// MaxDifference is the largest gap between client's and current pts
+	// which is returned by GetDifference, larger gaps require refetching
+	MaxDifference = 1000
+	// DefaultMessagesCount is a page size of GetMessages and GetThread
+	// if client doesn't set count
+	DefaultMessagesCount = 50
+)
+
+type ChatsConfig struct {
+	// AllowedReactions is a list of emoji users can react with
+	AllowedReactions []string
+}
+
 type ChatsUsecase struct {
-	registry storage.Registry
+	registry  storage.Registry
+	broker    *broker.Broker
+	reactions map[string]bool
 }
 
-func NewChatsUsecase(r storage.Registry) *ChatsUsecase {
+func NewChatsUsecase(r storage.Registry, b *broker.Broker, cfg *ChatsConfig) *ChatsUsecase {
+	reactions := make(map[string]bool, len(cfg.AllowedReactions))
+	for _, reaction := range cfg.AllowedReactions {
+		reactions[reaction] = true
+	}
+
 	return &ChatsUsecase{
-		registry: r,
+		registry:  r,
+		broker:    b,
+		reactions: reactions,
 	}
 }
 
-func (u *ChatsUsecase) CreateChat(ctx context.Context, claims *auth.UserClaims, chat models.ChatCreate) (err error) {
+// CreateChat creates the chat and returns it with members
+func (u *ChatsUsecase) CreateChat(ctx context.Context, claims *auth.UserClaims, chat models.ChatCreate) (c *models.ChatWithMembers, err error) {
 	if claims == nil {
-		return ErrAuthenticationRequired
+		return nil, ErrAuthenticationRequired
+	}
+
+	chat, err = u.prepareChat(claims, chat)
+	if err != nil {
+		return nil, err
+	}
+
+	err = u.registry.Atomic(ctx, func(r storage.Registry) error {
+		err := u.createChat(ctx, r, claims, chat)
+		if err != nil {
+			return err
+		}
+
+		c, err = r.GetChatsStore().GetChatWithMembers(ctx, chat.ChatID)
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	metrics.ChatsCreated.WithLabelValues(metrics.ChatKind(chat.IsDirect)).Inc()
+	return c, nil
+}
+
+// GetOrCreateDirectChat returns id of existing direct chat between
+// the users or creates a new one with provided chatId
+func (u *ChatsUsecase) GetOrCreateDirectChat(ctx context.Context, claims *auth.UserClaims, chatId string, username string) (existingId string, created bool, err error) {
+	if claims == nil {
+		return "", false, ErrAuthenticationRequired
+	}
+
+	chat, err := u.prepareChat(claims, models.ChatCreate{
+		ChatID:   chatId,
+		IsDirect: true,
+		Members:  []string{username},
+	})
+	if err != nil {
+		return "", false, err
+	}
+
+	err = u.registry.Atomic(ctx, func(r storage.Registry) error {
+		existingId, err = r.GetChatsStore().GetDirectChat(ctx, claims.Username, username)
+		if !errors.Is(err, storage.ErrChatNotFound) {
+			return err
+		}
+
+		existingId, created = chatId, true
+		return u.createChat(ctx, r, claims, chat)
+	})
+
+	// Chat was concurrently created by the other user
+	if errors.Is(err, storage.ErrDirectChatExists) {
+		created = false
+		existingId, err = u.registry.GetChatsStore().GetDirectChat(ctx, claims.Username, username)
+	}
+
+	if err != nil {
+		return "", false, err
+	}
+
+	if created {
+		metrics.ChatsCreated.WithLabelValues(metrics.ChatKind(true)).Inc()
 	}
+	return existingId, created, nil
+}
 
+// prepareChat adds creator to chat members and checks chat is consistent
+func (u *ChatsUsecase) prepareChat(claims *auth.UserClaims, chat models.ChatCreate) (models.ChatCreate, error) {
 	found := false
 	for _, mem := range chat.Members {
 		if mem == claims.Username {
@@ -45,34 +145,57 @@ func (u *ChatsUsecase) CreateChat(ctx context.Context, claims *auth.UserClaims,
 		chat.Members = append(chat.Members, claims.Username)
 	}
 
-	if chat.IsDirect && len(chat.Members) != 2 {
-		return fmt.Errorf("%w: direct chat must have exactly two members", ErrBusinessLogicViolation)
+	if chat.IsDirect && (len(chat.Members) != 2 || chat.Members[0] == chat.Members[1]) {
+		return chat, fmt.Errorf("%w: direct chat must have exactly two members", ErrBusinessLogicViolation)
 	}
 
-	err = u.registry.Atomic(ctx, func(r storage.Registry) error {
-		store := r.GetChatsStore()
-		err := store.CreateChat(ctx, chat.ChatID, chat.IsDirect)
+	if chat.IsDirect && chat.ChatInfo != (models.ChatInfo{}) {
+		return chat, ErrDirectChatInfo
+	}
+
+	return chat, nil
+}
+
+func (u *ChatsUsecase) createChat(ctx context.Context, r storage.Registry, claims *auth.UserClaims, chat models.ChatCreate) error {
+	store := r.GetChatsStore()
+	err := store.CreateChat(ctx, chat.ChatID, chat.IsDirect, storage.CreateChatOptions{
+		CreatedBy: claims.Username,
+		Info:      chat.ChatInfo,
+	})
+	if err != nil {
+		return err
+	}
+	if chat.IsDirect {
+		// Only one direct chat may exist between two users
+		err = store.PutDirectChat(ctx, chat.ChatID, chat.Members[0], chat.Members[1])
 		if err != nil {
 			return err
 		}
-		err = store.AddChatMembers(ctx, chat.ChatID, chat.Members)
+	}
+	err = store.AddChatMembers(ctx, chat.ChatID, chat.Members)
+	if err != nil {
+		return err
+	}
+	// Participants of direct chat are equal, so nobody owns it
+	if !chat.IsDirect {
+		err = store.SetMemberRole(ctx, chat.ChatID, claims.Username, models.RoleOwner)
 		if err != nil {
 			return err
 		}
+	}
 
-		upd := u.registry.GetUpdatesStore()
-		err = upd.ChatCreated(&models.ChatCreated{
-			UpdateMeta: models.UpdateMeta{
-				Audience: chat.Members,
-			},
-			ChatID:   chat.ChatID,
-			IsDirect: chat.IsDirect,
-			Members:  chat.Members,
-		})
-		return err
+	upd := r.GetUpdatesStore()
+	err = upd.ChatCreated(ctx, &models.ChatCreated{
+		UpdateMeta: models.UpdateMeta{
+			Timestamp: time.Now().UTC(),
+			Audience:  chat.Members,
+		},
+		ChatID:   chat.ChatID,
+		IsDirect: chat.IsDirect,
+		Members:  chat.Members,
+		ChatInfo: chat.ChatInfo,
 	})
-
-	return
+	return err
 }
 
 func (u *ChatsUsecase) GetChatWithMembers(ctx context.Context, claims *auth.UserClaims, chatId string) (c *models.ChatWithMembers, err error) {
@@ -91,202 +214,1627 @@ func (u *ChatsUsecase) GetChatWithMembers(ctx context.Context, claims *auth.User
 		}
 
 		c, err = store.GetChatWithMembers(ctx, chatId)
+		if err != nil {
+			return err
+		}
 
-		return err
+		pins, err := store.GetPins(ctx, chatId, 1)
+		if err != nil {
+			return err
+		}
+
+		if len(pins) > 0 {
+			c.LastPin = &pins[0]
+		}
+		return nil
 	})
 	return
 }
 
-func (u *ChatsUsecase) AddChatMembers(ctx context.Context, claims *auth.UserClaims, chatId string, users []string) error {
-	err := u.registry.Atomic(ctx, func(r storage.Registry) error {
+func (u *ChatsUsecase) UpdateChatInfo(ctx context.Context, claims *auth.UserClaims, update models.ChatInfoUpdate) error {
+	return u.registry.Atomic(ctx, func(r storage.Registry) error {
 		store := r.GetChatsStore()
-		isMember, err := store.UserIsMember(ctx, chatId, claims.Username)
+
+		chat, err := store.GetChat(ctx, update.ChatID)
 		if err != nil {
 			return err
 		}
 
-		if !isMember {
-			return ErrUserIsNotAChatMember
+		if chat.IsDirect {
+			return ErrDirectChatInfo
 		}
 
-		audience, err := u.getChatAudience(ctx, chatId, store)
+		_, err = u.checkPermission(ctx, store, update.ChatID, claims.Username, PermEditChatInfo)
 		if err != nil {
 			return err
 		}
 
-		for _, username := range audience {
-			err = r.GetUpdatesStore().MemberAdded(&models.MemberAdded{
-				UpdateMeta: models.UpdateMeta{
-					Timestamp: time.Time{},
-					Audience:  audience,
-				},
-				ChatID:   chatId,
-				Username: username,
-			})
+		err = store.UpdateChatInfo(ctx, update.ChatID, update.ChatInfo)
+		if err != nil {
+			return err
+		}
 
-			if err != nil {
-				return err
-			}
+		// Update contains the whole chat info, not only changed fields
+		chat, err = store.GetChat(ctx, update.ChatID)
+		if err != nil {
+			return err
 		}
 
-		return store.AddChatMembers(ctx, chatId, users)
+		audience, err := u.getChatAudience(ctx, update.ChatID, store)
+		if err != nil {
+			return err
+		}
+
+		return r.GetUpdatesStore().ChatInfoUpdated(ctx, &models.ChatInfoUpdated{
+			UpdateMeta: models.UpdateMeta{
+				Timestamp: time.Now().UTC(),
+				Audience:  audience,
+			},
+			ChatID:    update.ChatID,
+			UpdatedBy: claims.Username,
+			ChatInfo:  chat.ChatInfo,
+		})
 	})
-	return err
 }
 
-func (u *ChatsUsecase) DeleteChatMembers(ctx context.Context, claims *auth.UserClaims, chatId string, users []string) error {
-	err := u.registry.Atomic(ctx, func(r storage.Registry) error {
+func (u *ChatsUsecase) DeleteChat(ctx context.Context, claims *auth.UserClaims, chatId string) error {
+	if claims == nil {
+		return ErrAuthenticationRequired
+	}
+
+	return u.registry.Atomic(ctx, func(r storage.Registry) error {
 		store := r.GetChatsStore()
-		isMember, err := store.UserIsMember(ctx, chatId, claims.Username)
+
+		chat, err := store.GetChat(ctx, chatId)
 		if err != nil {
 			return err
 		}
 
-		if !isMember {
-			return ErrUserIsNotAChatMember
+		// Direct chat can be deleted by any of its participants,
+		// group chat only by a member permitted to
+		if chat.IsDirect {
+			_, err = u.getRole(ctx, store, chatId, claims.Username)
+		} else {
+			_, err = u.checkPermission(ctx, store, chatId, claims.Username, PermDeleteChat)
+		}
+		if err != nil {
+			return err
 		}
 
+		// Audience must be collected before members are deleted
 		audience, err := u.getChatAudience(ctx, chatId, store)
 		if err != nil {
 			return err
 		}
 
-		for _, username := range audience {
-			err = r.GetUpdatesStore().MemberAdded(&models.MemberAdded{
-				UpdateMeta: models.UpdateMeta{
-					Timestamp: time.Time{},
-					Audience:  audience,
-				},
-				ChatID:   chatId,
-				Username: username,
-			})
+		err = store.DeleteChat(ctx, chatId)
+		if err != nil {
+			return err
+		}
 
-			if err != nil {
-				return err
+		return r.GetUpdatesStore().ChatDeleted(ctx, &models.ChatDeleted{
+			UpdateMeta: models.UpdateMeta{
+				Timestamp: time.Now().UTC(),
+				Audience:  audience,
+			},
+			ChatID: chatId,
+		})
+	})
+}
+
+func (u *ChatsUsecase) AddChatMembers(ctx context.Context, claims *auth.UserClaims, chatId string, users []string) error {
+	err := u.registry.Atomic(ctx, func(r storage.Registry) error {
+		store := r.GetChatsStore()
+		if err := u.checkNotDirect(ctx, store, chatId); err != nil {
+			return err
+		}
+
+		_, err := u.checkPermission(ctx, store, chatId, claims.Username, PermAddMembers)
+		if err != nil {
+			return err
+		}
+
+		chat, err := store.GetChatWithMembers(ctx, chatId)
+		if err != nil {
+			return err
+		}
+
+		// Users who are already members are skipped
+		skip := make(map[string]bool, len(chat.Members)+len(users))
+		for _, member := range chat.Members {
+			skip[member.UserID] = true
+		}
+
+		added := make([]string, 0, len(users))
+		for _, username := range users {
+			if !skip[username] {
+				skip[username] = true
+				added = append(added, username)
 			}
 		}
 
-		return store.DeleteChatMembers(ctx, chatId, users)
+		if len(added) == 0 {
+			return nil
+		}
+
+		err = store.AddChatMembers(ctx, chatId, added)
+		if err != nil {
+			return err
+		}
+
+		// Audience is collected after members are added, so they get the update too
+		audience, err := u.getChatAudience(ctx, chatId, store)
+		if err != nil {
+			return err
+		}
+
+		return u.membersAdded(ctx, r.GetUpdatesStore(), chatId, claims.Username, added, audience)
 	})
 	return err
 }
 
-func (u *ChatsUsecase) SendMessage(ctx context.Context, sender *auth.UserClaims, message models.MessageSend) error {
-	// TODO: Handle attachments
-
-	return u.registry.Atomic(ctx, func(r storage.Registry) error {
+func (u *ChatsUsecase) DeleteChatMembers(ctx context.Context, claims *auth.UserClaims, chatId string, users []string) error {
+	err := u.registry.Atomic(ctx, func(r storage.Registry) error {
 		store := r.GetChatsStore()
+		if err := u.checkNotDirect(ctx, store, chatId); err != nil {
+			return err
+		}
 
-		// Check if user is a chat member
-		isMember, err := store.UserIsMember(ctx, message.ChatID, sender.Username)
+		role, err := u.checkPermission(ctx, store, chatId, claims.Username, PermRemoveMembers)
 		if err != nil {
 			return err
-		} else if !isMember {
-			return ErrUserIsNotAChatMember
 		}
 
-		// If ReplyTo is not nil, check weather replied message exists and is in the same chat
-		if message.ReplyTo != nil {
-			msgs, err := store.GetMessagesById(ctx, []string{*message.ReplyTo})
-
-			if err != nil {
+		// Members can be removed only by those who outrank them
+		removed := make([]string, 0, len(users))
+		isRemoved := make(map[string]bool, len(users))
+		for _, username := range users {
+			target, err := store.GetMemberRole(ctx, chatId, username)
+			if errors.Is(err, storage.ErrNotMember) {
+				continue
+			} else if err != nil {
 				return err
 			}
 
-			repliedMsg := msgs[0]
-			if repliedMsg.ChatID != message.ChatID {
-				return fmt.Errorf("%w: replied message must be in the same chat", ErrBusinessLogicViolation)
+			if !Outranks(role, target) {
+				return ErrInsufficientRole
+			}
+
+			if !isRemoved[username] {
+				isRemoved[username] = true
+				removed = append(removed, username)
 			}
 		}
 
-		now := time.Now().UTC()
-		err = store.PutMessage(ctx, &models.Message{
-			MessageID:   message.MessageID,
-			FromUser:    sender.Username,
-			ChatID:      message.ChatID,
-			SendingTime: now,
-			Text:        message.Text,
-			ReplyTo:     message.ReplyTo,
-			Attachments: nil,
-		})
+		if len(removed) == 0 {
+			return nil
+		}
 
+		// Audience must be collected before members are deleted,
+		// so removed members get the update too
+		audience, err := u.getChatAudience(ctx, chatId, store)
 		if err != nil {
 			return err
 		}
 
-		upd := r.GetUpdatesStore()
-
-		audience, err := u.getChatAudience(ctx, message.ChatID, store)
+		err = store.DeleteChatMembers(ctx, chatId, removed)
 		if err != nil {
 			return err
 		}
 
-		err = upd.MessageSent(&models.MessageSent{
-			UpdateMeta: models.UpdateMeta{
-				Timestamp: now,
-				Audience:  audience,
-			},
-			MessageID:   message.MessageID,
-			FromUser:    sender.Username,
-			ChatID:      message.ChatID,
-			Text:        message.Text,
-			ReplyTo:     message.ReplyTo,
-			Attachments: message.Attachments,
-		})
-		return err
+		return u.membersRemoved(ctx, r.GetUpdatesStore(), chatId, claims.Username, removed, audience)
 	})
+	return err
 }
 
-func (u *ChatsUsecase) getChatAudience(ctx context.Context, chatId string, store *storage.ChatsStorage) ([]string, error) {
-	chat, err := store.GetChatWithMembers(ctx, chatId)
-	if err != nil {
-		return nil, fmt.Errorf("can't get chat members: %v", err)
+// membersAdded publishes a single update for the whole batch of added users
+func (u *ChatsUsecase) membersAdded(ctx context.Context, upd *storage.UpdatesStorage, chatId string, actor string, added []string, audience []string) error {
+	meta := models.UpdateMeta{
+		Timestamp: time.Now().UTC(),
+		Audience:  audience,
 	}
-	audience := make([]string, len(chat.Members))
-	for i, mem := range chat.Members {
-		audience[i] = mem.UserID
+
+	if len(added) == 1 {
+		return upd.MemberAdded(ctx, &models.MemberAdded{
+			UpdateMeta: meta,
+			ChatID:     chatId,
+			Username:   added[0],
+			Actor:      actor,
+		})
 	}
-	return audience, nil
+
+	return upd.MembersAdded(ctx, &models.MembersAdded{
+		UpdateMeta: meta,
+		ChatID:     chatId,
+		Usernames:  added,
+		Actor:      actor,
+	})
 }
 
-func (u *ChatsUsecase) GetMessages(ctx context.Context, user *auth.UserClaims, sel *models.MessagesSelect) ([]models.Message, error) {
-	query := squirrel.And{squirrel.Eq{"chat_id": sel.ChatID}}
-	if sel.Since != nil {
-		query = append(query, squirrel.GtOrEq{"sending_time": *sel.Since})
-	}
-	if sel.Until != nil {
-		query = append(query, squirrel.LtOrEq{"sending_time": *sel.Until})
+// membersRemoved publishes a single update for the whole batch of removed users
+func (u *ChatsUsecase) membersRemoved(ctx context.Context, upd *storage.UpdatesStorage, chatId string, actor string, removed []string, audience []string) error {
+	meta := models.UpdateMeta{
+		Timestamp: time.Now().UTC(),
+		Audience:  audience,
 	}
-	opt := storage.SelectOptions{
-		Limit:   500,
-		OrderBy: []string{"sending_time ASC"},
-	}
-	if sel.Count != nil {
-		opt.Limit = uint64(*sel.Count)
+
+	if len(removed) == 1 {
+		return upd.MemberRemoved(ctx, &models.MemberRemoved{
+			UpdateMeta: meta,
+			ChatID:     chatId,
+			Username:   removed[0],
+			Actor:      actor,
+		})
 	}
 
-	var messages []models.Message
-	err := u.registry.Atomic(ctx, func(r storage.Registry) error {
-		var err error
+	return upd.MembersRemoved(ctx, &models.MembersRemoved{
+		UpdateMeta: meta,
+		ChatID:     chatId,
+		Usernames:  removed,
+		Actor:      actor,
+	})
+}
 
+// LeaveChat removes the user from group chat. If the user is the owner,
+// ownership is handed to the highest ranked member. Chat is deleted when
+// its last member leaves
+func (u *ChatsUsecase) LeaveChat(ctx context.Context, claims *auth.UserClaims, chatId string) error {
+	return u.registry.Atomic(ctx, func(r storage.Registry) error {
 		store := r.GetChatsStore()
 
-		isMember, err := store.UserIsMember(ctx, sel.ChatID, user.Username)
+		role, err := u.getRole(ctx, store, chatId, claims.Username)
 		if err != nil {
 			return err
 		}
 
-		if !isMember {
-			return ErrUserIsNotAChatMember
+		chat, err := store.GetChatWithMembers(ctx, chatId)
+		if err != nil {
+			return err
 		}
 
-		messages, err = store.SelectMessages(ctx, query, opt)
-		return err
-	})
+		if chat.IsDirect {
+			return ErrDirectChatLeave
+		}
 
-	return messages, err
-}
+		upd := r.GetUpdatesStore()
+		now := time.Now().UTC()
+		if len(chat.Members) == 1 {
+			err = store.DeleteChat(ctx, chatId)
+			if err != nil {
+				return err
+			}
 
-func (u *ChatsUsecase) GetUsersChats(ctx context.Context, user *auth.UserClaims) ([]models.RichChat, error) {
-	return u.registry.GetChatsStore().GetUserChats(ctx, user.Username)
+			return upd.ChatDeleted(ctx, &models.ChatDeleted{
+				UpdateMeta: models.UpdateMeta{
+					Timestamp: now,
+					Audience:  []string{claims.Username},
+				},
+				ChatID: chatId,
+			})
+		}
+
+		audience := make([]string, len(chat.Members))
+		for i, member := range chat.Members {
+			audience[i] = member.UserID
+		}
+
+		if role == models.RoleOwner {
+			successor := Successor(chat.Members, claims.Username)
+			err = store.SetMemberRole(ctx, chatId, successor.UserID, models.RoleOwner)
+			if err != nil {
+				return err
+			}
+
+			err = upd.MemberRoleChanged(ctx, &models.MemberRoleChanged{
+				UpdateMeta: models.UpdateMeta{
+					Timestamp: now,
+					Audience:  audience,
+				},
+				ChatID:   chatId,
+				Username: successor.UserID,
+				Role:     models.RoleOwner,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		err = store.DeleteChatMembers(ctx, chatId, []string{claims.Username})
+		if err != nil {
+			return err
+		}
+
+		// Leaving user is in audience, so their other sessions drop the chat
+		return u.membersRemoved(ctx, upd, chatId, claims.Username, []string{claims.Username}, audience)
+	})
+}
+
+// SetMemberRole promotes or demotes chat member. Ownership can't be
+// granted or taken away this way
+func (u *ChatsUsecase) SetMemberRole(ctx context.Context, claims *auth.UserClaims, chatId string, username string, role models.ChatRole) error {
+	if role != models.RoleAdmin && role != models.RoleMember {
+		return fmt.Errorf("%w: member can be only promoted to admin or demoted to member", ErrBusinessLogicViolation)
+	}
+
+	return u.registry.Atomic(ctx, func(r storage.Registry) error {
+		store := r.GetChatsStore()
+		if err := u.checkNotDirect(ctx, store, chatId); err != nil {
+			return err
+		}
+
+		actorRole, err := u.checkPermission(ctx, store, chatId, claims.Username, PermManageRoles)
+		if err != nil {
+			return err
+		}
+
+		target, err := store.GetMemberRole(ctx, chatId, username)
+		if err != nil {
+			return err
+		}
+
+		if !Outranks(actorRole, target) {
+			return ErrInsufficientRole
+		}
+
+		if target == role {
+			return nil
+		}
+
+		err = store.SetMemberRole(ctx, chatId, username, role)
+		if err != nil {
+			return err
+		}
+
+		audience, err := u.getChatAudience(ctx, chatId, store)
+		if err != nil {
+			return err
+		}
+
+		return r.GetUpdatesStore().MemberRoleChanged(ctx, &models.MemberRoleChanged{
+			UpdateMeta: models.UpdateMeta{
+				Timestamp: time.Now().UTC(),
+				Audience:  audience,
+			},
+			ChatID:   chatId,
+			Username: username,
+			Role:     role,
+		})
+	})
+}
+
+// SendMessage stores the message and returns it. Sending is idempotent: if
+// the message with the same id, sender and content is already stored, it is
+// returned without publishing an update again
+func (u *ChatsUsecase) SendMessage(ctx context.Context, sender *auth.UserClaims, message models.MessageSend) (*models.Message, error) {
+	sent, err := u.sendMessage(ctx, sender, message)
+
+	// Concurrent retry has stored the message first
+	if errors.Is(err, storage.ErrMessageAlreadyExists) {
+		retried, retryErr := u.retriedMessage(ctx, u.registry.GetChatsStore(), sender, message)
+		if retried != nil || retryErr != nil {
+			return retried, retryErr
+		}
+	}
+
+	return sent, err
+}
+
+func (u *ChatsUsecase) sendMessage(ctx context.Context, sender *auth.UserClaims, message models.MessageSend) (sent *models.Message, err error) {
+	retried := false
+	err = u.registry.Atomic(ctx, func(r storage.Registry) error {
+		store := r.GetChatsStore()
+
+		// Check if user is a chat member
+		isMember, err := store.UserIsMember(ctx, message.ChatID, sender.Username)
+		if err != nil {
+			return err
+		} else if !isMember {
+			return ErrUserIsNotAChatMember
+		}
+
+		sent, err = u.retriedMessage(ctx, store, sender, message)
+		if sent != nil || err != nil {
+			retried = sent != nil
+			return err
+		}
+
+		// If ReplyTo is not nil, check weather replied message exists and is in the same chat
+		var threadRootId *string
+		var preview *models.ReplyPreview
+		if message.ReplyTo != nil {
+			msgs, err := store.GetMessagesById(ctx, []string{*message.ReplyTo})
+
+			if err != nil {
+				return err
+			} else if len(msgs) == 0 {
+				return storage.ErrRepliedMessageNotFound
+			}
+
+			repliedMsg := msgs[0]
+			if repliedMsg.ChatID != message.ChatID {
+				return fmt.Errorf("%w: replied message must be in the same chat", ErrBusinessLogicViolation)
+			}
+
+			// Reply joins the thread of replied message or starts a new one
+			threadRootId = repliedMsg.ThreadRootID
+			if threadRootId == nil {
+				threadRootId = &repliedMsg.MessageID
+			}
+			preview = replyPreviewOf(&repliedMsg)
+		}
+
+		// Postgres keeps microseconds, so returned time matches the stored one
+		now := time.Now().UTC().Truncate(time.Microsecond)
+		msg := &models.Message{
+			MessageID:    message.MessageID,
+			FromUser:     sender.Username,
+			ChatID:       message.ChatID,
+			SendingTime:  now,
+			Text:         message.Text,
+			ReplyTo:      message.ReplyTo,
+			Attachments:  message.Attachments,
+			ThreadRootID: threadRootId,
+			ReplyPreview: preview,
+		}
+		err = store.PutMessage(ctx, msg)
+
+		if err != nil {
+			return err
+		}
+
+		upd := r.GetUpdatesStore()
+
+		audience, err := u.getChatAudience(ctx, message.ChatID, store)
+		if err != nil {
+			return err
+		}
+
+		err = upd.MessageSent(ctx, &models.MessageSent{
+			UpdateMeta: models.UpdateMeta{
+				Timestamp: now,
+				Audience:  audience,
+			},
+			MessageID:    message.MessageID,
+			FromUser:     sender.Username,
+			ChatID:       message.ChatID,
+			Text:         message.Text,
+			ReplyTo:      message.ReplyTo,
+			Attachments:  message.Attachments,
+			ThreadRootID: threadRootId,
+		})
+		if err != nil {
+			return err
+		}
+
+		if threadRootId != nil {
+			err = u.threadUpdated(ctx, store, upd, message.ChatID, []string{*threadRootId}, audience, now)
+			if err != nil {
+				return err
+			}
+		}
+
+		sent = msg
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !retried {
+		metrics.MessagesSent.Inc()
+	}
+	return sent, nil
+}
+
+// retriedMessage returns stored message if the message was already sent,
+// nil is returned if there is no message with such id. If the id is used
+// by a different message ErrMessageIdConflict is returned. Text of the
+// retry is compared with the sent one, so retry of edited message succeeds
+func (u *ChatsUsecase) retriedMessage(ctx context.Context, store *storage.ChatsStorage, sender *auth.UserClaims, message models.MessageSend) (*models.Message, error) {
+	msgs, err := store.GetMessagesById(ctx, []string{message.MessageID})
+	if err != nil || len(msgs) == 0 {
+		return nil, err
+	}
+
+	stored := &msgs[0]
+	sentText := stored.Text
+	if stored.EditedAt != nil {
+		// The first revision keeps the text message was sent with
+		revisions, err := store.GetMessageRevisions(ctx, stored.MessageID)
+		if err != nil {
+			return nil, err
+		}
+		if len(revisions) > 0 {
+			sentText = revisions[0].Text
+		}
+	}
+
+	if stored.FromUser != sender.Username ||
+		stored.ChatID != message.ChatID ||
+		sentText != message.Text ||
+		stored.DeletedAt != nil ||
+		!equalRefs(stored.ReplyTo, message.ReplyTo) ||
+		!sameAttachments(stored.Attachments, message.Attachments) {
+		return nil, ErrMessageIdConflict
+	}
+
+	if stored.ReplyTo != nil {
+		msgs, err = store.GetMessagesById(ctx, []string{*stored.ReplyTo})
+		if err != nil {
+			return nil, err
+		}
+		// Replied message may be already deleted
+		if len(msgs) > 0 {
+			stored.ReplyPreview = replyPreviewOf(&msgs[0])
+		}
+	}
+
+	return stored, nil
+}
+
+// replyPreviewLength is max length of replied message text in runes
+const replyPreviewLength = 100
+
+func replyPreviewOf(msg *models.Message) *models.ReplyPreview {
+	text := []rune(msg.Text)
+	if len(text) > replyPreviewLength {
+		text = append(text[:replyPreviewLength-1], '…')
+	}
+
+	return &models.ReplyPreview{
+		MessageID: msg.MessageID,
+		FromUser:  msg.FromUser,
+		Text:      string(text),
+		Deleted:   msg.DeletedAt != nil,
+	}
+}
+
+func equalRefs(a *string, b *string) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// sameAttachments compares attachments regardless of their order
+func sameAttachments(a []models.FileAttachment, b []models.FileAttachment) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	counts := make(map[models.FileAttachment]int, len(a))
+	for _, att := range a {
+		counts[att]++
+	}
+	for _, att := range b {
+		if counts[att] == 0 {
+			return false
+		}
+		counts[att]--
+	}
+	return true
+}
+
+// threadUpdated sends current stats of threads to the audience
+func (u *ChatsUsecase) threadUpdated(ctx context.Context, store *storage.ChatsStorage, upd *storage.UpdatesStorage, chatId string, rootIds []string, audience []string, now time.Time) error {
+	stats, err := store.GetThreadStats(ctx, rootIds)
+	if err != nil {
+		return err
+	}
+
+	for _, rootId := range rootIds {
+		err = upd.ThreadUpdated(ctx, &models.ThreadUpdated{
+			UpdateMeta: models.UpdateMeta{
+				Timestamp: now,
+				Audience:  audience,
+			},
+			ChatID:      chatId,
+			RootID:      rootId,
+			ThreadStats: stats[rootId],
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ForwardMessages copies messages to another chat and returns ids
+// of the copies. Forwarded messages keep origin of the original message
+func (u *ChatsUsecase) ForwardMessages(ctx context.Context, user *auth.UserClaims, fwd models.MessagesForward) ([]string, error) {
+	var forwarded []string
+	err := u.registry.Atomic(ctx, func(r storage.Registry) error {
+		store := r.GetChatsStore()
+
+		for _, chatId := range []string{fwd.FromChatID, fwd.ToChatID} {
+			isMember, err := store.UserIsMember(ctx, chatId, user.Username)
+			if err != nil {
+				return err
+			} else if !isMember {
+				return ErrUserIsNotAChatMember
+			}
+		}
+
+		msgs, err := store.SelectMessages(ctx, squirrel.And{
+			squirrel.Eq{"chat_id": fwd.FromChatID},
+			squirrel.Eq{"message_id": fwd.MessageIDs},
+			squirrel.Eq{"deleted_at": nil},
+			storage.NotHiddenFor(user.Username),
+		}, storage.SelectOptions{OrderBy: storage.MessagesAscending})
+		if err != nil {
+			return err
+		} else if len(msgs) != len(fwd.MessageIDs) {
+			return storage.ErrMessageNotFound
+		}
+
+		audience, err := u.getChatAudience(ctx, fwd.ToChatID, store)
+		if err != nil {
+			return err
+		}
+
+		upd := r.GetUpdatesStore()
+		// Truncated like in sendMessage, so updates carry the stored time
+		now := time.Now().UTC().Truncate(time.Microsecond)
+		forwarded = make([]string, len(msgs))
+		for i, msg := range msgs {
+			origin := msg.ForwardOrigin
+			// Message forwarded again points to the first origin
+			if origin.ForwardedFromUser == nil {
+				origin = models.ForwardOrigin{
+					ForwardedFromChat:    &msgs[i].ChatID,
+					ForwardedFromMessage: &msgs[i].MessageID,
+					ForwardedFromUser:    &msgs[i].FromUser,
+					ForwardedSendingTime: &msgs[i].SendingTime,
+				}
+			}
+
+			copied := models.Message{
+				MessageID: uuid.NewString(),
+				FromUser:  user.Username,
+				ChatID:    fwd.ToChatID,
+				// Copies are spaced by a microsecond, which is the database
+				// timestamp precision, so they keep the original order
+				SendingTime:   now.Add(time.Duration(i) * time.Microsecond),
+				Text:          msg.Text,
+				ForwardOrigin: origin,
+				Attachments:   msg.Attachments,
+			}
+			if err = store.PutMessage(ctx, &copied); err != nil {
+				return err
+			}
+
+			err = upd.MessageSent(ctx, &models.MessageSent{
+				UpdateMeta: models.UpdateMeta{
+					Timestamp: copied.SendingTime,
+					Audience:  audience,
+				},
+				MessageID:     copied.MessageID,
+				FromUser:      copied.FromUser,
+				ChatID:        copied.ChatID,
+				Text:          copied.Text,
+				Attachments:   copied.Attachments,
+				ForwardOrigin: origin,
+			})
+			if err != nil {
+				return err
+			}
+
+			forwarded[i] = copied.MessageID
+		}
+		return nil
+	})
+
+	if err == nil {
+		metrics.MessagesSent.Add(float64(len(forwarded)))
+	}
+	return forwarded, err
+}
+
+func (u *ChatsUsecase) EditMessage(ctx context.Context, editor *auth.UserClaims, edit models.MessageEdit) error {
+	return u.registry.Atomic(ctx, func(r storage.Registry) error {
+		store := r.GetChatsStore()
+
+		msgs, err := store.GetMessagesById(ctx, []string{edit.MessageID})
+		if err != nil {
+			return err
+		} else if len(msgs) == 0 {
+			return storage.ErrMessageNotFound
+		}
+
+		msg := msgs[0]
+		if msg.DeletedAt != nil {
+			return storage.ErrMessageNotFound
+		}
+
+		if msg.FromUser != editor.Username {
+			return ErrUserIsNotMessageAuthor
+		}
+
+		isMember, err := store.UserIsMember(ctx, msg.ChatID, editor.Username)
+		if err != nil {
+			return err
+		} else if !isMember {
+			return ErrUserIsNotAChatMember
+		}
+
+		if len(edit.Text) == 0 && len(msg.Attachments) == 0 {
+			return fmt.Errorf("%w: message without attachments can't have empty text", ErrBusinessLogicViolation)
+		}
+
+		now := time.Now().UTC()
+		err = store.EditMessage(ctx, edit.MessageID, edit.Text, now)
+		if err != nil {
+			return err
+		}
+
+		audience, err := u.getChatAudience(ctx, msg.ChatID, store)
+		if err != nil {
+			return err
+		}
+
+		return r.GetUpdatesStore().MessageEdited(ctx, &models.MessageEdited{
+			UpdateMeta: models.UpdateMeta{
+				Timestamp: now,
+				Audience:  audience,
+			},
+			MessageID: edit.MessageID,
+			ChatID:    msg.ChatID,
+			Text:      edit.Text,
+			EditedAt:  now,
+		})
+	})
+}
+
+func (u *ChatsUsecase) DeleteMessages(ctx context.Context, user *auth.UserClaims, del models.MessagesDelete) error {
+	return u.registry.Atomic(ctx, func(r storage.Registry) error {
+		store := r.GetChatsStore()
+
+		role, err := u.getRole(ctx, store, del.ChatID, user.Username)
+		if err != nil {
+			return err
+		}
+
+		msgs, err := store.SelectMessages(ctx, squirrel.And{
+			squirrel.Eq{"chat_id": del.ChatID},
+			squirrel.Eq{"message_id": del.MessageIDs},
+		})
+		if err != nil {
+			return err
+		} else if len(msgs) != len(del.MessageIDs) {
+			return storage.ErrMessageNotFound
+		}
+
+		if del.Scope == models.DeleteForMe {
+			return store.HideMessages(ctx, user.Username, del.MessageIDs)
+		}
+
+		deleted := make([]string, 0, len(msgs))
+		threads := make([]string, 0)
+		inThreads := make(map[string]bool)
+		for _, msg := range msgs {
+			if msg.FromUser != user.Username && !HasPermission(role, PermDeleteOthersMessages) {
+				return ErrUserIsNotMessageAuthor
+			}
+
+			if msg.DeletedAt == nil {
+				deleted = append(deleted, msg.MessageID)
+
+				if root := msg.ThreadRootID; root != nil && !inThreads[*root] {
+					inThreads[*root] = true
+					threads = append(threads, *root)
+				}
+			}
+		}
+
+		// All messages are already deleted, so there is nothing to notify about
+		if len(deleted) == 0 {
+			return nil
+		}
+
+		now := time.Now().UTC()
+		err = store.TombstoneMessages(ctx, deleted, now)
+		if err != nil {
+			return err
+		}
+
+		// Deleted messages can't stay pinned
+		unpinned, err := store.UnpinMessages(ctx, del.ChatID, deleted)
+		if err != nil {
+			return err
+		}
+
+		audience, err := u.getChatAudience(ctx, del.ChatID, store)
+		if err != nil {
+			return err
+		}
+
+		upd := r.GetUpdatesStore()
+		err = upd.MessageDeleted(ctx, &models.MessageDeleted{
+			UpdateMeta: models.UpdateMeta{
+				Timestamp: now,
+				Audience:  audience,
+			},
+			ChatID:     del.ChatID,
+			MessageIDs: deleted,
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, messageId := range unpinned {
+			err = upd.MessageUnpinned(ctx, &models.MessageUnpinned{
+				UpdateMeta: models.UpdateMeta{
+					Timestamp: now,
+					Audience:  audience,
+				},
+				ChatID:     del.ChatID,
+				MessageID:  messageId,
+				UnpinnedBy: user.Username,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		// Deleted replies are not counted anymore
+		return u.threadUpdated(ctx, store, upd, del.ChatID, threads, audience, now)
+	})
+}
+
+func (u *ChatsUsecase) PinMessage(ctx context.Context, user *auth.UserClaims, change models.PinChange) error {
+	return u.registry.Atomic(ctx, func(r storage.Registry) error {
+		store := r.GetChatsStore()
+
+		if err := u.checkCanPin(ctx, store, change.ChatID, user.Username); err != nil {
+			return err
+		}
+
+		msgs, err := store.GetMessagesById(ctx, []string{change.MessageID})
+		if err != nil {
+			return err
+		} else if len(msgs) == 0 || msgs[0].ChatID != change.ChatID || msgs[0].DeletedAt != nil {
+			return storage.ErrMessageNotFound
+		}
+
+		now := time.Now().UTC()
+		pinned, err := store.PinMessage(ctx, &models.Pin{
+			ChatID:    change.ChatID,
+			MessageID: change.MessageID,
+			PinnedBy:  user.Username,
+			PinnedAt:  now,
+		})
+		if err != nil || !pinned {
+			return err
+		}
+
+		audience, err := u.getChatAudience(ctx, change.ChatID, store)
+		if err != nil {
+			return err
+		}
+
+		return r.GetUpdatesStore().MessagePinned(ctx, &models.MessagePinned{
+			UpdateMeta: models.UpdateMeta{
+				Timestamp: now,
+				Audience:  audience,
+			},
+			ChatID:    change.ChatID,
+			MessageID: change.MessageID,
+			PinnedBy:  user.Username,
+		})
+	})
+}
+
+func (u *ChatsUsecase) UnpinMessage(ctx context.Context, user *auth.UserClaims, change models.PinChange) error {
+	return u.registry.Atomic(ctx, func(r storage.Registry) error {
+		store := r.GetChatsStore()
+
+		if err := u.checkCanPin(ctx, store, change.ChatID, user.Username); err != nil {
+			return err
+		}
+
+		unpinned, err := store.UnpinMessages(ctx, change.ChatID, []string{change.MessageID})
+		if err != nil || len(unpinned) == 0 {
+			return err
+		}
+
+		audience, err := u.getChatAudience(ctx, change.ChatID, store)
+		if err != nil {
+			return err
+		}
+
+		return r.GetUpdatesStore().MessageUnpinned(ctx, &models.MessageUnpinned{
+			UpdateMeta: models.UpdateMeta{
+				Timestamp: time.Now().UTC(),
+				Audience:  audience,
+			},
+			ChatID:     change.ChatID,
+			MessageID:  change.MessageID,
+			UnpinnedBy: user.Username,
+		})
+	})
+}
+
+// GetPinnedMessages returns pinned messages from the most recently pinned,
+// messages hidden by the user are skipped
+func (u *ChatsUsecase) GetPinnedMessages(ctx context.Context, user *auth.UserClaims, chatId string) ([]models.PinnedMessage, error) {
+	pinned := make([]models.PinnedMessage, 0)
+	err := u.registry.Atomic(ctx, func(r storage.Registry) error {
+		store := r.GetChatsStore()
+
+		isMember, err := store.UserIsMember(ctx, chatId, user.Username)
+		if err != nil {
+			return err
+		} else if !isMember {
+			return ErrUserIsNotAChatMember
+		}
+
+		pins, err := store.GetPins(ctx, chatId, 0)
+		if err != nil || len(pins) == 0 {
+			return err
+		}
+
+		ids := make([]string, len(pins))
+		for i, pin := range pins {
+			ids[i] = pin.MessageID
+		}
+
+		msgs, err := store.SelectMessages(ctx, squirrel.And{
+			squirrel.Eq{"message_id": ids},
+			storage.NotHiddenFor(user.Username),
+		}, storage.SelectOptions{Viewer: user.Username})
+		if err != nil {
+			return err
+		}
+
+		byId := make(map[string]models.Message, len(msgs))
+		for _, msg := range msgs {
+			byId[msg.MessageID] = msg
+		}
+
+		for _, pin := range pins {
+			if msg, ok := byId[pin.MessageID]; ok {
+				pinned = append(pinned, models.PinnedMessage{Pin: pin, Message: msg})
+			}
+		}
+		return nil
+	})
+
+	return pinned, err
+}
+
+func (u *ChatsUsecase) GetMessageRevisions(ctx context.Context, user *auth.UserClaims, messageId string) ([]models.MessageRevision, error) {
+	var revisions []models.MessageRevision
+	err := u.registry.Atomic(ctx, func(r storage.Registry) error {
+		store := r.GetChatsStore()
+
+		msgs, err := store.GetMessagesById(ctx, []string{messageId})
+		if err != nil {
+			return err
+		} else if len(msgs) == 0 {
+			return storage.ErrMessageNotFound
+		}
+
+		isMember, err := store.UserIsMember(ctx, msgs[0].ChatID, user.Username)
+		if err != nil {
+			return err
+		} else if !isMember {
+			return ErrUserIsNotAChatMember
+		}
+
+		revisions, err = store.GetMessageRevisions(ctx, messageId)
+		return err
+	})
+
+	return revisions, err
+}
+
+func (u *ChatsUsecase) AddReaction(ctx context.Context, user *auth.UserClaims, change models.ReactionChange) error {
+	if !u.reactions[change.Reaction] {
+		return ErrReactionNotAllowed
+	}
+	return u.changeReaction(ctx, user, change, true)
+}
+
+// RemoveReaction doesn't check the allowlist, so reactions which
+// are no longer allowed can still be removed
+func (u *ChatsUsecase) RemoveReaction(ctx context.Context, user *auth.UserClaims, change models.ReactionChange) error {
+	return u.changeReaction(ctx, user, change, false)
+}
+
+func (u *ChatsUsecase) changeReaction(ctx context.Context, user *auth.UserClaims, change models.ReactionChange, add bool) error {
+	return u.registry.Atomic(ctx, func(r storage.Registry) error {
+		store := r.GetChatsStore()
+
+		msgs, err := store.GetMessagesById(ctx, []string{change.MessageID})
+		if err != nil {
+			return err
+		} else if len(msgs) == 0 || msgs[0].DeletedAt != nil {
+			return storage.ErrMessageNotFound
+		}
+
+		msg := msgs[0]
+		if _, err = u.getRole(ctx, store, msg.ChatID, user.Username); err != nil {
+			return err
+		}
+
+		var changed bool
+		if add {
+			changed, err = store.AddReaction(ctx, change.MessageID, user.Username, change.Reaction)
+		} else {
+			changed, err = store.RemoveReaction(ctx, change.MessageID, user.Username, change.Reaction)
+		}
+		if err != nil || !changed {
+			return err
+		}
+
+		count, err := store.CountReactions(ctx, change.MessageID, change.Reaction)
+		if err != nil {
+			return err
+		}
+
+		audience, err := u.getChatAudience(ctx, msg.ChatID, store)
+		if err != nil {
+			return err
+		}
+
+		return r.GetUpdatesStore().ReactionChanged(ctx, &models.ReactionChanged{
+			UpdateMeta: models.UpdateMeta{
+				Timestamp: time.Now().UTC(),
+				Audience:  audience,
+			},
+			ChatID:    msg.ChatID,
+			MessageID: change.MessageID,
+			Username:  user.Username,
+			Reaction:  change.Reaction,
+			Added:     add,
+			Count:     count,
+		})
+	})
+}
+
+// MarkRead moves user's read marker to the message. Reading an older message
+// keeps the marker in place and no update is sent
+func (u *ChatsUsecase) MarkRead(ctx context.Context, user *auth.UserClaims, mark models.ReadMark) error {
+	return u.registry.Atomic(ctx, func(r storage.Registry) error {
+		store := r.GetChatsStore()
+
+		if _, err := u.getRole(ctx, store, mark.ChatID, user.Username); err != nil {
+			return err
+		}
+
+		msgs, err := store.GetMessagesById(ctx, []string{mark.MessageID})
+		if err != nil {
+			return err
+		} else if len(msgs) == 0 || msgs[0].ChatID != mark.ChatID {
+			return storage.ErrMessageNotFound
+		}
+
+		moved, err := store.MarkRead(ctx, mark.ChatID, user.Username, &models.MessageCursor{
+			SendingTime: msgs[0].SendingTime,
+			MessageID:   msgs[0].MessageID,
+		})
+		if err != nil || !moved {
+			return err
+		}
+
+		chat, err := store.GetChatWithMembers(ctx, mark.ChatID)
+		if err != nil {
+			return err
+		}
+
+		audience := make([]string, 0, len(chat.Members))
+		if chat.ReadReceipts {
+			for _, member := range chat.Members {
+				if member.UserID != user.Username {
+					audience = append(audience, member.UserID)
+				}
+			}
+		}
+
+		// Reader and other members get different updates, so all of
+		// them are locked at once in the order used by fan-out
+		upd := r.GetUpdatesStore()
+		err = upd.LockAudience(ctx, mark.ChatID, append([]string{user.Username}, audience...))
+		if err != nil {
+			return err
+		}
+
+		now := time.Now().UTC()
+
+		// Marker is delivered to reader's other sessions only
+		err = upd.ReadMarkerUpdated(ctx, &models.ReadMarkerUpdated{
+			UpdateMeta: models.UpdateMeta{
+				Timestamp: now,
+				Audience:  []string{user.Username},
+			},
+			ChatID:    mark.ChatID,
+			MessageID: mark.MessageID,
+		})
+		if err != nil || !chat.ReadReceipts {
+			return err
+		}
+
+		return upd.MessagesRead(ctx, &models.MessagesRead{
+			UpdateMeta: models.UpdateMeta{
+				Timestamp: now,
+				Audience:  audience,
+			},
+			ChatID:    mark.ChatID,
+			Username:  user.Username,
+			MessageID: mark.MessageID,
+		})
+	})
+}
+
+// GetMessageReadBy returns members who have read the message,
+// message author is not included
+func (u *ChatsUsecase) GetMessageReadBy(ctx context.Context, user *auth.UserClaims, messageId string) ([]string, error) {
+	var readBy []string
+	err := u.registry.Atomic(ctx, func(r storage.Registry) error {
+		store := r.GetChatsStore()
+
+		msgs, err := store.GetMessagesById(ctx, []string{messageId})
+		if err != nil {
+			return err
+		} else if len(msgs) == 0 {
+			return storage.ErrMessageNotFound
+		}
+
+		msg := msgs[0]
+		if _, err = u.getRole(ctx, store, msg.ChatID, user.Username); err != nil {
+			return err
+		}
+
+		chat, err := store.GetChat(ctx, msg.ChatID)
+		if err != nil {
+			return err
+		}
+
+		if !chat.ReadReceipts {
+			return ErrReadReceiptsDisabled
+		}
+
+		users, err := store.GetReadBy(ctx, msg.ChatID, &models.MessageCursor{
+			SendingTime: msg.SendingTime,
+			MessageID:   msg.MessageID,
+		})
+		if err != nil {
+			return err
+		}
+
+		readBy = make([]string, 0, len(users))
+		for _, member := range users {
+			if member != msg.FromUser {
+				readBy = append(readBy, member)
+			}
+		}
+		return nil
+	})
+
+	return readBy, err
+}
+
+// SetReadReceipts turns read receipts on or off for the chat
+func (u *ChatsUsecase) SetReadReceipts(ctx context.Context, user *auth.UserClaims, chatId string, enabled bool) error {
+	return u.registry.Atomic(ctx, func(r storage.Registry) error {
+		store := r.GetChatsStore()
+
+		chat, err := store.GetChat(ctx, chatId)
+		if err != nil {
+			return err
+		}
+
+		// Direct chat has no roles, so any participant may change it
+		if chat.IsDirect {
+			_, err = u.getRole(ctx, store, chatId, user.Username)
+		} else {
+			_, err = u.checkPermission(ctx, store, chatId, user.Username, PermEditChatInfo)
+		}
+		if err != nil {
+			return err
+		}
+
+		return store.SetReadReceipts(ctx, chatId, enabled)
+	})
+}
+
+func (u *ChatsUsecase) checkNotDirect(ctx context.Context, store *storage.ChatsStorage, chatId string) error {
+	chat, err := store.GetChat(ctx, chatId)
+	if err != nil {
+		return err
+	}
+
+	if chat.IsDirect {
+		return fmt.Errorf("%w: direct chat members can't be changed", ErrBusinessLogicViolation)
+	}
+
+	return nil
+}
+
+func (u *ChatsUsecase) getChatAudience(ctx context.Context, chatId string, store *storage.ChatsStorage) ([]string, error) {
+	chat, err := store.GetChatWithMembers(ctx, chatId)
+	if err != nil {
+		return nil, fmt.Errorf("can't get chat members: %v", err)
+	}
+	audience := make([]string, len(chat.Members))
+	for i, mem := range chat.Members {
+		audience[i] = mem.UserID
+	}
+	return audience, nil
+}
+
+func (u *ChatsUsecase) GetMessages(ctx context.Context, user *auth.UserClaims, sel *models.MessagesSelect) (*models.MessagesPage, error) {
+	query := squirrel.And{squirrel.Eq{"chat_id": sel.ChatID}, storage.NotHiddenFor(user.Username)}
+	if sel.Since != nil {
+		query = append(query, squirrel.GtOrEq{"sending_time": *sel.Since})
+	}
+	if sel.Until != nil {
+		query = append(query, squirrel.LtOrEq{"sending_time": *sel.Until})
+	}
+	if sel.RootsOnly {
+		query = append(query, squirrel.Eq{"thread_root_id": nil})
+	}
+	limit := uint64(DefaultMessagesCount)
+	if sel.Count != nil {
+		limit = uint64(*sel.Count)
+	}
+
+	var before, after *models.MessageCursor
+	var err error
+	if sel.Before != nil {
+		if before, err = DecodeCursor(*sel.Before); err != nil {
+			return nil, err
+		}
+	}
+	if sel.After != nil {
+		if after, err = DecodeCursor(*sel.After); err != nil {
+			return nil, err
+		}
+	}
+
+	page := &models.MessagesPage{}
+	err = u.registry.Atomic(ctx, func(r storage.Registry) error {
+		store := r.GetChatsStore()
+
+		isMember, err := store.UserIsMember(ctx, sel.ChatID, user.Username)
+		if err != nil {
+			return err
+		}
+
+		if !isMember {
+			return ErrUserIsNotAChatMember
+		}
+
+		viewer := user.Username
+		switch {
+		case before != nil:
+			page.Messages, err = u.selectBefore(ctx, store, query, before, limit, viewer, page)
+			page.NextCursor = sel.Before
+		case after != nil:
+			page.Messages, err = u.selectAfter(ctx, store, query, after, limit, viewer, page)
+			page.PrevCursor = sel.After
+		case sel.Around != nil:
+			page.Messages, err = u.selectAround(ctx, store, query, *sel.Around, limit, viewer, page)
+		default:
+			// Chat is opened at the latest messages
+			page.Messages, err = u.selectBefore(ctx, store, query, nil, limit, viewer, page)
+		}
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Page edges are used as cursors back to where client came from,
+	// the latest page is followed by messages which will be sent later
+	latest := before == nil && after == nil && sel.Around == nil
+	if len(page.Messages) > 0 {
+		if before != nil || latest {
+			page.NextCursor = cursorOf(&page.Messages[len(page.Messages)-1])
+		}
+		if after != nil {
+			page.PrevCursor = cursorOf(&page.Messages[0])
+		}
+	}
+
+	return page, nil
+}
+
+// GetThread returns the root message and a page of its replies
+func (u *ChatsUsecase) GetThread(ctx context.Context, user *auth.UserClaims, sel *models.ThreadSelect) (*models.ThreadPage, error) {
+	query := squirrel.And{squirrel.Eq{"thread_root_id": sel.RootID}, storage.NotHiddenFor(user.Username)}
+	limit := uint64(DefaultMessagesCount)
+	if sel.Count != nil {
+		limit = uint64(*sel.Count)
+	}
+
+	var before, after *models.MessageCursor
+	var err error
+	if sel.Before != nil {
+		if before, err = DecodeCursor(*sel.Before); err != nil {
+			return nil, err
+		}
+	}
+	if sel.After != nil {
+		if after, err = DecodeCursor(*sel.After); err != nil {
+			return nil, err
+		}
+	}
+
+	page := &models.ThreadPage{}
+	err = u.registry.Atomic(ctx, func(r storage.Registry) error {
+		store := r.GetChatsStore()
+
+		roots, err := store.GetMessagesById(ctx, []string{sel.RootID})
+		if err != nil {
+			return err
+		} else if len(roots) == 0 {
+			return storage.ErrMessageNotFound
+		}
+
+		page.Root = roots[0]
+		isMember, err := store.UserIsMember(ctx, page.Root.ChatID, user.Username)
+		if err != nil {
+			return err
+		} else if !isMember {
+			return ErrUserIsNotAChatMember
+		}
+
+		if page.Root.ThreadRootID != nil {
+			return fmt.Errorf("%w: message is not a thread root", ErrBusinessLogicViolation)
+		}
+
+		viewer := user.Username
+		switch {
+		case before != nil:
+			page.Messages, err = u.selectBefore(ctx, store, query, before, limit, viewer, &page.MessagesPage)
+			page.NextCursor = sel.Before
+		case after != nil:
+			page.Messages, err = u.selectAfter(ctx, store, query, after, limit, viewer, &page.MessagesPage)
+			page.PrevCursor = sel.After
+		default:
+			page.Messages, err = u.selectAfter(ctx, store, query, nil, limit, viewer, &page.MessagesPage)
+		}
+		return err
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	// Page edges are used as cursors back to where client came from
+	if len(page.Messages) > 0 {
+		if before != nil {
+			page.NextCursor = cursorOf(&page.Messages[len(page.Messages)-1])
+		}
+		if after != nil {
+			page.PrevCursor = cursorOf(&page.Messages[0])
+		}
+	}
+
+	return page, nil
+}
+
+// SearchMessages looks for messages in chats where user is currently a member
+func (u *ChatsUsecase) SearchMessages(ctx context.Context, user *auth.UserClaims, search *models.MessagesSearch) (*models.SearchPage, error) {
+	limit := uint64(20)
+	if search.Count != nil {
+		limit = uint64(*search.Count)
+	}
+
+	var after *models.SearchCursor
+	var err error
+	if search.After != nil {
+		if after, err = DecodeSearchCursor(*search.After); err != nil {
+			return nil, err
+		}
+	}
+
+	page := &models.SearchPage{}
+	err = u.registry.Atomic(ctx, func(r storage.Registry) error {
+		store := r.GetChatsStore()
+
+		if search.ChatID != nil {
+			isMember, err := store.UserIsMember(ctx, *search.ChatID, user.Username)
+			if err != nil {
+				return err
+			} else if !isMember {
+				return ErrUserIsNotAChatMember
+			}
+		}
+
+		// One extra result is fetched to know whether there are more
+		results, err := store.SearchMessages(ctx, user.Username, search, storage.SearchOptions{
+			Limit: limit + 1,
+			After: after,
+		})
+		if err != nil {
+			return err
+		}
+
+		if uint64(len(results)) > limit {
+			results = results[:limit]
+			page.NextCursor = searchCursorOf(&results[len(results)-1])
+		}
+
+		page.Results = results
+		return nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return page, nil
+}
+
+// selectAfter returns up to limit messages placed after the cursor (from
+// the beginning if cursor is nil) and sets NextCursor if there are more
+func (u *ChatsUsecase) selectAfter(ctx context.Context, store *storage.ChatsStorage, query squirrel.And, cursor *models.MessageCursor, limit uint64, viewer string, page *models.MessagesPage) ([]models.Message, error) {
+	if limit == 0 {
+		return []models.Message{}, nil
+	}
+
+	if cursor != nil {
+		query = append(query, storage.AfterCursor(cursor))
+	}
+
+	// One extra message is fetched to know whether there are more
+	messages, err := store.SelectMessages(ctx, query, storage.SelectOptions{
+		Limit:   limit + 1,
+		OrderBy: storage.MessagesAscending,
+		Viewer:  viewer,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if uint64(len(messages)) > limit {
+		messages = messages[:limit]
+		page.NextCursor = cursorOf(&messages[len(messages)-1])
+	}
+
+	return messages, nil
+}
+
+// selectBefore returns up to limit messages placed before the cursor (the
+// latest ones if cursor is nil) in ascending order and sets PrevCursor
+// if there are more
+func (u *ChatsUsecase) selectBefore(ctx context.Context, store *storage.ChatsStorage, query squirrel.And, cursor *models.MessageCursor, limit uint64, viewer string, page *models.MessagesPage) ([]models.Message, error) {
+	if limit == 0 {
+		return []models.Message{}, nil
+	}
+
+	if cursor != nil {
+		query = append(query, storage.BeforeCursor(cursor))
+	}
+
+	messages, err := store.SelectMessages(ctx, query, storage.SelectOptions{
+		Limit:   limit + 1,
+		OrderBy: storage.MessagesDescending,
+		Viewer:  viewer,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if uint64(len(messages)) > limit {
+		messages = messages[:limit]
+		page.PrevCursor = cursorOf(&messages[len(messages)-1])
+	}
+
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+
+	return messages, nil
+}
+
+// selectAround returns the message with its context: half of the page
+// before it and the rest after it
+func (u *ChatsUsecase) selectAround(ctx context.Context, store *storage.ChatsStorage, query squirrel.And, messageId string, limit uint64, viewer string, page *models.MessagesPage) ([]models.Message, error) {
+	anchors, err := store.SelectMessages(ctx, append(query, squirrel.Eq{"message_id": messageId}), storage.SelectOptions{
+		Viewer: viewer,
+	})
+	if err != nil {
+		return nil, err
+	} else if len(anchors) == 0 {
+		return nil, storage.ErrMessageNotFound
+	}
+
+	anchor := anchors[0]
+	if limit == 0 {
+		return []models.Message{}, nil
+	}
+
+	cursor := &models.MessageCursor{
+		SendingTime: anchor.SendingTime,
+		MessageID:   anchor.MessageID,
+	}
+
+	beforeLimit := (limit - 1) / 2
+	messages, err := u.selectBefore(ctx, store, query, cursor, beforeLimit, viewer, page)
+	if err != nil {
+		return nil, err
+	}
+
+	after, err := u.selectAfter(ctx, store, query, cursor, limit-1-beforeLimit, viewer, page)
+	if err != nil {
+		return nil, err
+	}
+
+	messages = append(messages, anchor)
+	return append(messages, after...), nil
+}
+
+func (u *ChatsUsecase) GetUsersChats(ctx context.Context, user *auth.UserClaims) ([]models.RichChat, error) {
+	return u.registry.GetChatsStore().GetUserChats(ctx, user.Username)
+}
+
+func (u *ChatsUsecase) GetDifference(ctx context.Context, user *auth.UserClaims, sel *models.DifferenceSelect) (*models.Difference, error) {
+	limit := uint64(100)
+	if sel.Limit != nil {
+		limit = uint64(*sel.Limit)
+	}
+
+	diff := &models.Difference{}
+	err := u.registry.Atomic(ctx, func(r storage.Registry) error {
+		var err error
+		store := r.GetUpdatesStore()
+
+		diff.Pts, err = store.GetUserPts(ctx, user.Username)
+		if err != nil {
+			return err
+		}
+
+		if sel.FromPts >= diff.Pts {
+			diff.Updates = []models.UserUpdate{}
+			return nil
+		}
+
+		if diff.Pts-sel.FromPts > MaxDifference {
+			diff.TooLong = true
+			return nil
+		}
+
+		diff.Updates, err = store.SelectUserUpdates(ctx, user.Username, sel.FromPts, limit)
+		if err != nil {
+			return err
+		}
+
+		// Some of the missed updates are not stored anymore
+		if len(diff.Updates) == 0 || diff.Updates[0].Pts != sel.FromPts+1 {
+			diff.Updates = nil
+			diff.TooLong = true
+			return nil
+		}
+
+		if last := diff.Updates[len(diff.Updates)-1].Pts; last < diff.Pts {
+			diff.Pts = last
+			diff.HasMore = true
+		}
+
+		return nil
+	})
+
+	return diff, err
+}
+
+// SubscribeUpdates subscribes user to committed updates. Subscription
+// is cancelled when ctx is done
+func (u *ChatsUsecase) SubscribeUpdates(ctx context.Context, user *auth.UserClaims) (*broker.Subscription, error) {
+	if user == nil {
+		return nil, ErrAuthenticationRequired
+	}
+
+	sub := u.broker.Subscribe(user.Username)
+
+	go func() {
+		<-ctx.Done()
+		u.broker.Unsubscribe(sub)
+	}()
+
+	return sub, nil
 }
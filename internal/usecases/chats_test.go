@@ -0,0 +1,820 @@
+package usecases
+
+import (
+	"context"
+	"github.com/google/uuid"
+	"github.com/practice-sem-2/auth-tools"
+	"github.com/practice-sem-2/user-service/internal/broker"
+	"github.com/practice-sem-2/user-service/internal/models"
+	"github.com/practice-sem-2/user-service/internal/pb/chats/updates"
+	storage "github.com/practice-sem-2/user-service/internal/storages"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+	"strings"
+	"testing"
+	"time"
+)
+
+var (
+	alice = &auth.UserClaims{Username: "alice"}
+	bob   = &auth.UserClaims{Username: "bob"}
+	carol = &auth.UserClaims{Username: "carol"}
+)
+
+type ChatsUsecaseTestSuite struct {
+	storage.PostgresTestSuite
+	broker   *broker.Broker
+	registry storage.Registry
+	usecase  *ChatsUsecase
+}
+
+func TestChatsUsecaseSuite(t *testing.T) {
+	suite.Run(t, &ChatsUsecaseTestSuite{})
+}
+
+func (s *ChatsUsecaseTestSuite) SetupTest() {
+	s.broker = broker.NewBroker(64)
+	s.registry = storage.NewRegistry(s.DB(), &storage.UpdatesStoreConfig{UpdatesTopic: "test"}, s.broker)
+	s.usecase = NewChatsUsecase(s.registry, s.broker, &ChatsConfig{})
+}
+
+func (s *ChatsUsecaseTestSuite) TearDownTest() {
+	s.broker.Close()
+	_, err := s.DB().Exec(`
+		TRUNCATE messages, chat_members, chats, attachments, message_revisions, hidden_messages,
+		    direct_chats, message_reactions, chat_pins, updates_outbox, user_updates, user_update_state`)
+	require.NoError(s.T(), err, "can't teardown test")
+}
+
+// createChat creates group chat owned by the creator
+func (s *ChatsUsecaseTestSuite) createChat(ctx context.Context, creator *auth.UserClaims, members ...string) string {
+	chatId := uuid.NewString()
+	_, err := s.usecase.CreateChat(ctx, creator, models.ChatCreate{
+		ChatID:  chatId,
+		Members: members,
+	})
+	require.NoError(s.T(), err, "chat should be created")
+	return chatId
+}
+
+// received returns updates already delivered to the subscription
+func received(sub *broker.Subscription) []*updates.Update {
+	upds := make([]*updates.Update, 0)
+	for {
+		select {
+		case upd, ok := <-sub.Updates():
+			if !ok {
+				return upds
+			}
+			upds = append(upds, upd)
+		default:
+			return upds
+		}
+	}
+}
+
+// messagesSent returns ids of messages from MessageSent updates
+func messagesSent(upds []*updates.Update) []string {
+	ids := make([]string, 0)
+	for _, upd := range upds {
+		if sent, ok := upd.Update.(*updates.Update_Message); ok {
+			ids = append(ids, sent.Message.MessageId)
+		}
+	}
+	return ids
+}
+
+func (s *ChatsUsecaseTestSuite) Test_SendMessage_Retry() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	chatId := s.createChat(ctx, alice, bob.Username)
+	sub := s.broker.Subscribe(bob.Username)
+
+	message := models.MessageSend{
+		MessageID: uuid.NewString(),
+		ChatID:    chatId,
+		Text:      "hello",
+		Attachments: []models.FileAttachment{
+			{MimeType: "image/png", FileID: uuid.NewString()},
+			{MimeType: "text/plain", FileID: uuid.NewString()},
+		},
+	}
+
+	sent, err := s.usecase.SendMessage(ctx, alice, message)
+	require.NoError(s.T(), err, "message should be sent")
+
+	retried, err := s.usecase.SendMessage(ctx, alice, message)
+	require.NoError(s.T(), err, "identical retry should succeed")
+
+	assert.Equal(s.T(), sent.MessageID, retried.MessageID)
+	assert.Equal(s.T(), sent.SendingTime, retried.SendingTime, "stored message should be returned")
+	assert.Equal(s.T(), sent.Text, retried.Text)
+	assert.ElementsMatch(s.T(), sent.Attachments, retried.Attachments)
+	assert.Equal(s.T(), []string{message.MessageID}, messagesSent(received(sub)), "retry should not publish update again")
+}
+
+func (s *ChatsUsecaseTestSuite) Test_SendMessage_RetryWithDifferentPayload() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	chatId := s.createChat(ctx, alice, bob.Username)
+	message := models.MessageSend{
+		MessageID:   uuid.NewString(),
+		ChatID:      chatId,
+		Text:        "hello",
+		Attachments: []models.FileAttachment{{MimeType: "image/png", FileID: uuid.NewString()}},
+	}
+
+	_, err := s.usecase.SendMessage(ctx, alice, message)
+	require.NoError(s.T(), err, "message should be sent")
+
+	changedText := message
+	changedText.Text = "bye"
+	_, err = s.usecase.SendMessage(ctx, alice, changedText)
+	assert.ErrorIs(s.T(), err, ErrMessageIdConflict, "retry with different text should be rejected")
+	assert.ErrorIs(s.T(), err, storage.ErrMessageAlreadyExists, "conflict should be reported as already existing message")
+
+	changedAttachments := message
+	changedAttachments.Attachments = []models.FileAttachment{{MimeType: "image/png", FileID: uuid.NewString()}}
+	_, err = s.usecase.SendMessage(ctx, alice, changedAttachments)
+	assert.ErrorIs(s.T(), err, ErrMessageIdConflict, "retry with different attachments should be rejected")
+
+	_, err = s.usecase.SendMessage(ctx, bob, message)
+	assert.ErrorIs(s.T(), err, ErrMessageIdConflict, "id of other user's message should be rejected")
+}
+
+func (s *ChatsUsecaseTestSuite) Test_SendMessage_RetryWithReorderedAttachments() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	chatId := s.createChat(ctx, alice, bob.Username)
+	first := models.FileAttachment{MimeType: "image/png", FileID: uuid.NewString()}
+	second := models.FileAttachment{MimeType: "text/plain", FileID: uuid.NewString()}
+	message := models.MessageSend{
+		MessageID:   uuid.NewString(),
+		ChatID:      chatId,
+		Attachments: []models.FileAttachment{first, second},
+	}
+
+	sent, err := s.usecase.SendMessage(ctx, alice, message)
+	require.NoError(s.T(), err, "message should be sent")
+
+	message.Attachments = []models.FileAttachment{second, first}
+	retried, err := s.usecase.SendMessage(ctx, alice, message)
+	require.NoError(s.T(), err, "order of attachments should not matter")
+	assert.Equal(s.T(), sent.SendingTime, retried.SendingTime, "stored message should be returned")
+}
+
+func (s *ChatsUsecaseTestSuite) Test_SendMessage_RetryAfterEdit() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	chatId := s.createChat(ctx, alice, bob.Username)
+	message := models.MessageSend{
+		MessageID: uuid.NewString(),
+		ChatID:    chatId,
+		Text:      "hello",
+	}
+
+	_, err := s.usecase.SendMessage(ctx, alice, message)
+	require.NoError(s.T(), err, "message should be sent")
+
+	err = s.usecase.EditMessage(ctx, alice, models.MessageEdit{MessageID: message.MessageID, Text: "hello, bob"})
+	require.NoError(s.T(), err, "message should be edited")
+
+	retried, err := s.usecase.SendMessage(ctx, alice, message)
+	require.NoError(s.T(), err, "retry should be compared with the sent text")
+	assert.Equal(s.T(), "hello, bob", retried.Text, "edited message should be returned")
+	assert.NotNil(s.T(), retried.EditedAt)
+
+	message.Text = "hello, bob"
+	_, err = s.usecase.SendMessage(ctx, alice, message)
+	assert.ErrorIs(s.T(), err, ErrMessageIdConflict, "edited text was never sent")
+}
+
+func (s *ChatsUsecaseTestSuite) Test_SendMessage_ConcurrentDuplicate() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	chatId := s.createChat(ctx, alice, bob.Username)
+	sub := s.broker.Subscribe(bob.Username)
+	message := models.MessageSend{
+		MessageID: uuid.NewString(),
+		ChatID:    chatId,
+		Text:      "hello",
+	}
+
+	// Concurrent request stores the message, but doesn't commit until
+	// SendMessage waits for it on the unique index
+	inserted := make(chan struct{})
+	release := make(chan struct{})
+	concurrent := make(chan error, 1)
+	go func() {
+		concurrent <- s.registry.Atomic(ctx, func(r storage.Registry) error {
+			err := r.GetChatsStore().PutMessage(ctx, &models.Message{
+				MessageID:   message.MessageID,
+				FromUser:    alice.Username,
+				ChatID:      chatId,
+				SendingTime: time.Now().UTC().Truncate(time.Microsecond),
+				Text:        message.Text,
+			})
+			close(inserted)
+			if err != nil {
+				return err
+			}
+			<-release
+			return nil
+		})
+	}()
+	<-inserted
+
+	type result struct {
+		msg *models.Message
+		err error
+	}
+	sent := make(chan result, 1)
+	go func() {
+		msg, err := s.usecase.SendMessage(ctx, alice, message)
+		sent <- result{msg, err}
+	}()
+
+	require.Eventually(s.T(), func() bool {
+		waiting := 0
+		err := s.DB().GetContext(ctx, &waiting, "SELECT count(*) FROM pg_stat_activity WHERE wait_event_type = 'Lock'")
+		return err == nil && waiting > 0
+	}, 3*time.Second, 10*time.Millisecond, "SendMessage should wait for concurrent insert")
+
+	close(release)
+	require.NoError(s.T(), <-concurrent, "concurrent insert should be committed")
+
+	res := <-sent
+	require.NoError(s.T(), res.err, "duplicate insert should be resolved as retry")
+	assert.Equal(s.T(), message.MessageID, res.msg.MessageID)
+	assert.Equal(s.T(), message.Text, res.msg.Text)
+	assert.Empty(s.T(), messagesSent(received(sub)), "message stored by concurrent request should not be published")
+}
+
+func (s *ChatsUsecaseTestSuite) Test_SendMessage_ReturnsStoredMessage() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	chatId := s.createChat(ctx, alice, bob.Username)
+	root, err := s.usecase.SendMessage(ctx, bob, models.MessageSend{
+		MessageID: uuid.NewString(),
+		ChatID:    chatId,
+		Text:      "how are you?",
+	})
+	require.NoError(s.T(), err, "message should be sent")
+
+	before := time.Now().UTC()
+	sent, err := s.usecase.SendMessage(ctx, alice, models.MessageSend{
+		MessageID:   uuid.NewString(),
+		ChatID:      chatId,
+		Text:        "fine",
+		ReplyTo:     &root.MessageID,
+		Attachments: []models.FileAttachment{{MimeType: "image/png", FileID: uuid.NewString()}},
+	})
+	require.NoError(s.T(), err, "reply should be sent")
+
+	stored, err := s.registry.GetChatsStore().GetMessagesById(ctx, []string{sent.MessageID})
+	require.NoError(s.T(), err)
+	require.Len(s.T(), stored, 1)
+
+	assert.Equal(s.T(), alice.Username, sent.FromUser)
+	assert.Equal(s.T(), stored[0].SendingTime, sent.SendingTime, "returned sending time should match the stored one")
+	assert.WithinRange(s.T(), sent.SendingTime, before.Add(-time.Millisecond), time.Now().UTC(), "sending time should be set by server")
+	assert.ElementsMatch(s.T(), stored[0].Attachments, sent.Attachments)
+	assert.Equal(s.T(), &root.MessageID, sent.ThreadRootID, "reply should start a thread")
+	assert.Equal(s.T(), &models.ReplyPreview{
+		MessageID: root.MessageID,
+		FromUser:  bob.Username,
+		Text:      "how are you?",
+	}, sent.ReplyPreview)
+}
+
+func (s *ChatsUsecaseTestSuite) Test_CreateChat_ReturnsChatWithMembers() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	title := "friends"
+	chatId := uuid.NewString()
+	chat, err := s.usecase.CreateChat(ctx, alice, models.ChatCreate{
+		ChatID:   chatId,
+		Members:  []string{bob.Username},
+		ChatInfo: models.ChatInfo{Title: &title},
+	})
+	require.NoError(s.T(), err, "chat should be created")
+
+	assert.Equal(s.T(), chatId, chat.ChatID)
+	assert.False(s.T(), chat.IsDirect)
+	assert.Equal(s.T(), &title, chat.Title)
+	assert.Equal(s.T(), &alice.Username, chat.CreatedBy)
+	assert.Equal(s.T(), 2, chat.MembersCount)
+	assert.ElementsMatch(s.T(), []models.ChatMember{
+		{UserID: alice.Username, Role: models.RoleOwner},
+		{UserID: bob.Username, Role: models.RoleMember},
+	}, chat.Members, "creator should be the owner")
+}
+
+func (s *ChatsUsecaseTestSuite) Test_CreateChat_PublishesTimestamp() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sub := s.broker.Subscribe(bob.Username)
+	before := time.Now().UTC()
+
+	groupId := s.createChat(ctx, alice, bob.Username)
+	directId, _, err := s.usecase.GetOrCreateDirectChat(ctx, alice, uuid.NewString(), bob.Username)
+	require.NoError(s.T(), err, "direct chat should be created")
+
+	created := make([]string, 0)
+	for _, upd := range received(sub) {
+		if chat, ok := upd.Update.(*updates.Update_CreatedChat); ok {
+			created = append(created, chat.CreatedChat.ChatId)
+			assert.GreaterOrEqual(s.T(), upd.GetMeta().TimestampMs, before.UnixMilli(), "update should carry creation time")
+		}
+	}
+	assert.Equal(s.T(), []string{groupId, directId}, created)
+}
+
+func (s *ChatsUsecaseTestSuite) Test_LeaveChat_OwnerHandsOverOwnership() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	chatId := s.createChat(ctx, alice, bob.Username, carol.Username)
+	err := s.usecase.SetMemberRole(ctx, alice, chatId, carol.Username, models.RoleAdmin)
+	require.NoError(s.T(), err, "carol should be promoted")
+	sub := s.broker.Subscribe(bob.Username)
+
+	err = s.usecase.LeaveChat(ctx, alice, chatId)
+	require.NoError(s.T(), err, "owner should leave chat")
+
+	chat, err := s.usecase.GetChatWithMembers(ctx, bob, chatId)
+	require.NoError(s.T(), err)
+	assert.ElementsMatch(s.T(), []models.ChatMember{
+		{UserID: bob.Username, Role: models.RoleMember},
+		{UserID: carol.Username, Role: models.RoleOwner},
+	}, chat.Members, "admin should become the owner")
+
+	changed := false
+	for _, upd := range received(sub) {
+		if roleChanged, ok := upd.Update.(*updates.Update_MemberRoleChanged); ok {
+			changed = true
+			assert.Equal(s.T(), carol.Username, roleChanged.MemberRoleChanged.Username)
+			assert.Equal(s.T(), string(models.RoleOwner), roleChanged.MemberRoleChanged.Role)
+		}
+	}
+	assert.True(s.T(), changed, "members should be notified about the new owner")
+}
+
+func (s *ChatsUsecaseTestSuite) Test_LeaveChat_LastMemberDeletesChat() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	chatId := s.createChat(ctx, alice)
+	sub := s.broker.Subscribe(alice.Username)
+
+	err := s.usecase.LeaveChat(ctx, alice, chatId)
+	require.NoError(s.T(), err, "last member should leave chat")
+
+	_, err = s.registry.GetChatsStore().GetChatWithMembers(ctx, chatId)
+	assert.ErrorIs(s.T(), err, storage.ErrChatNotFound, "chat should be deleted")
+
+	upds := received(sub)
+	require.Len(s.T(), upds, 1)
+	deleted, ok := upds[0].Update.(*updates.Update_DeletedChat)
+	require.True(s.T(), ok, "leaving member should be notified about deleted chat")
+	assert.Equal(s.T(), chatId, deleted.DeletedChat.ChatId)
+}
+
+func (s *ChatsUsecaseTestSuite) Test_LeaveChat_DirectChat() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	chatId, _, err := s.usecase.GetOrCreateDirectChat(ctx, alice, uuid.NewString(), bob.Username)
+	require.NoError(s.T(), err, "direct chat should be created")
+
+	err = s.usecase.LeaveChat(ctx, alice, chatId)
+	assert.ErrorIs(s.T(), err, ErrDirectChatLeave, "direct chat can't be left")
+
+	chat, err := s.usecase.GetChatWithMembers(ctx, alice, chatId)
+	require.NoError(s.T(), err)
+	assert.Len(s.T(), chat.Members, 2, "members should stay in direct chat")
+}
+
+func (s *ChatsUsecaseTestSuite) Test_LeaveChat_NotifiesLeavingMember() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	chatId := s.createChat(ctx, alice, bob.Username)
+	aliceSub := s.broker.Subscribe(alice.Username)
+	bobSub := s.broker.Subscribe(bob.Username)
+
+	err := s.usecase.LeaveChat(ctx, bob, chatId)
+	require.NoError(s.T(), err, "member should leave chat")
+
+	for _, sub := range []*broker.Subscription{aliceSub, bobSub} {
+		upds := received(sub)
+		require.Len(s.T(), upds, 1)
+		removed, ok := upds[0].Update.(*updates.Update_MemberRemoved)
+		require.True(s.T(), ok, "MemberRemoved should be published")
+		assert.Equal(s.T(), bob.Username, removed.MemberRemoved.Username)
+		assert.ElementsMatch(s.T(), []string{alice.Username, bob.Username}, upds[0].GetMeta().GetAudience(),
+			"leaving member should be in audience")
+	}
+}
+
+func (s *ChatsUsecaseTestSuite) Test_DeleteChatMembers_PublishesMemberRemoved() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	chatId := s.createChat(ctx, alice, bob.Username, carol.Username)
+	bobSub := s.broker.Subscribe(bob.Username)
+	carolSub := s.broker.Subscribe(carol.Username)
+
+	err := s.usecase.DeleteChatMembers(ctx, alice, chatId, []string{bob.Username})
+	require.NoError(s.T(), err, "member should be removed")
+
+	upds := received(bobSub)
+	require.Len(s.T(), upds, 1)
+	removed, ok := upds[0].Update.(*updates.Update_MemberRemoved)
+	require.True(s.T(), ok, "MemberRemoved should be published")
+	assert.Equal(s.T(), chatId, removed.MemberRemoved.ChatId)
+	assert.Equal(s.T(), bob.Username, removed.MemberRemoved.Username)
+	assert.Equal(s.T(), alice.Username, removed.MemberRemoved.Actor)
+	assert.NotZero(s.T(), upds[0].GetMeta().TimestampMs, "update should carry timestamp")
+	assert.ElementsMatch(s.T(), []string{alice.Username, bob.Username, carol.Username}, upds[0].GetMeta().GetAudience(),
+		"removed member should be in audience")
+	assert.Len(s.T(), received(carolSub), 1, "remaining members should be notified")
+}
+
+func (s *ChatsUsecaseTestSuite) Test_DeleteChatMembers_PublishesMembersRemoved() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	chatId := s.createChat(ctx, alice, bob.Username, carol.Username)
+	sub := s.broker.Subscribe(carol.Username)
+
+	err := s.usecase.DeleteChatMembers(ctx, alice, chatId, []string{bob.Username, carol.Username})
+	require.NoError(s.T(), err, "members should be removed")
+
+	upds := received(sub)
+	require.Len(s.T(), upds, 1)
+	removed, ok := upds[0].Update.(*updates.Update_MembersRemoved)
+	require.True(s.T(), ok, "MembersRemoved should be published for a batch")
+	assert.Equal(s.T(), chatId, removed.MembersRemoved.ChatId)
+	assert.ElementsMatch(s.T(), []string{bob.Username, carol.Username}, removed.MembersRemoved.Usernames)
+	assert.Equal(s.T(), alice.Username, removed.MembersRemoved.Actor)
+	assert.NotZero(s.T(), upds[0].GetMeta().TimestampMs, "update should carry timestamp")
+	assert.ElementsMatch(s.T(), []string{alice.Username, bob.Username, carol.Username}, upds[0].GetMeta().GetAudience(),
+		"removed members should be in audience")
+}
+
+func (s *ChatsUsecaseTestSuite) Test_DeleteMessages_OnlyAuthor() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	chatId := s.createChat(ctx, alice, bob.Username, carol.Username)
+	send := func(user *auth.UserClaims) string {
+		msg, err := s.usecase.SendMessage(ctx, user, models.MessageSend{
+			MessageID: uuid.NewString(),
+			ChatID:    chatId,
+			Text:      "hello",
+		})
+		require.NoError(s.T(), err, "message should be sent")
+		return msg.MessageID
+	}
+	own, others := send(bob), send(carol)
+
+	err := s.usecase.DeleteMessages(ctx, bob, models.MessagesDelete{
+		ChatID:     chatId,
+		MessageIDs: []string{own, others},
+		Scope:      models.DeleteForEveryone,
+	})
+	assert.ErrorIs(s.T(), err, ErrUserIsNotMessageAuthor, "member should not delete others' messages")
+
+	err = s.usecase.DeleteMessages(ctx, bob, models.MessagesDelete{
+		ChatID:     chatId,
+		MessageIDs: []string{others},
+		Scope:      models.DeleteForMe,
+	})
+	assert.NoError(s.T(), err, "member should hide others' messages for themselves")
+
+	err = s.usecase.DeleteMessages(ctx, bob, models.MessagesDelete{
+		ChatID:     chatId,
+		MessageIDs: []string{own},
+		Scope:      models.DeleteForEveryone,
+	})
+	assert.NoError(s.T(), err, "author should delete own message")
+
+	msgs, err := s.registry.GetChatsStore().GetMessagesById(ctx, []string{own, others})
+	require.NoError(s.T(), err)
+	for _, msg := range msgs {
+		if msg.MessageID == own {
+			assert.NotNil(s.T(), msg.DeletedAt, "author's message should be deleted")
+		} else {
+			assert.Nil(s.T(), msg.DeletedAt, "others' message should be kept for everyone")
+		}
+	}
+}
+
+func (s *ChatsUsecaseTestSuite) Test_SendMessage_ReplyToMissingMessage() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	chatId := s.createChat(ctx, alice, bob.Username)
+	replyTo := uuid.NewString()
+	_, err := s.usecase.SendMessage(ctx, alice, models.MessageSend{
+		MessageID: uuid.NewString(),
+		ChatID:    chatId,
+		Text:      "hello",
+		ReplyTo:   &replyTo,
+	})
+	assert.ErrorIs(s.T(), err, storage.ErrRepliedMessageNotFound)
+}
+
+func (s *ChatsUsecaseTestSuite) Test_GetMessages_LatestPage() {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	chatId := s.createChat(ctx, alice, bob.Username)
+	s.sendMessages(ctx, alice, chatId, DefaultMessagesCount+2)
+
+	page, err := s.usecase.GetMessages(ctx, bob, &models.MessagesSelect{ChatID: chatId})
+	require.NoError(s.T(), err)
+	require.Len(s.T(), page.Messages, DefaultMessagesCount, "default count should be applied")
+	require.NotNil(s.T(), page.PrevCursor, "older messages should be available")
+	require.NotNil(s.T(), page.NextCursor)
+
+	older, err := s.usecase.GetMessages(ctx, bob, &models.MessagesSelect{ChatID: chatId, Before: page.PrevCursor})
+	require.NoError(s.T(), err)
+	assert.Len(s.T(), older.Messages, 2, "latest page should be returned first")
+	assert.Nil(s.T(), older.PrevCursor, "the oldest messages should be reached")
+
+	newer, err := s.usecase.GetMessages(ctx, bob, &models.MessagesSelect{ChatID: chatId, After: page.NextCursor})
+	require.NoError(s.T(), err)
+	assert.Empty(s.T(), newer.Messages, "nothing should be sent after the latest page")
+}
+
+func (s *ChatsUsecaseTestSuite) Test_GetThread_ChecksMembershipFirst() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	chatId := s.createChat(ctx, alice, bob.Username)
+	root, err := s.usecase.SendMessage(ctx, alice, models.MessageSend{
+		MessageID: uuid.NewString(),
+		ChatID:    chatId,
+		Text:      "hello",
+	})
+	require.NoError(s.T(), err, "message should be sent")
+	reply, err := s.usecase.SendMessage(ctx, bob, models.MessageSend{
+		MessageID: uuid.NewString(),
+		ChatID:    chatId,
+		Text:      "hi",
+		ReplyTo:   &root.MessageID,
+	})
+	require.NoError(s.T(), err, "reply should be sent")
+
+	_, err = s.usecase.GetThread(ctx, carol, &models.ThreadSelect{RootID: reply.MessageID})
+	assert.ErrorIs(s.T(), err, ErrUserIsNotAChatMember, "non-member should not learn whether message is a reply")
+
+	_, err = s.usecase.GetThread(ctx, bob, &models.ThreadSelect{RootID: reply.MessageID})
+	assert.ErrorIs(s.T(), err, ErrBusinessLogicViolation, "reply is not a thread root")
+}
+
+func (s *ChatsUsecaseTestSuite) Test_Roles_MemberIsDenied() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	chatId := s.createChat(ctx, alice, bob.Username, carol.Username)
+	msg, err := s.usecase.SendMessage(ctx, carol, models.MessageSend{
+		MessageID: uuid.NewString(),
+		ChatID:    chatId,
+		Text:      "hello",
+	})
+	require.NoError(s.T(), err, "message should be sent")
+
+	err = s.usecase.DeleteMessages(ctx, bob, models.MessagesDelete{
+		ChatID:     chatId,
+		MessageIDs: []string{msg.MessageID},
+		Scope:      models.DeleteForEveryone,
+	})
+	assert.ErrorIs(s.T(), err, ErrUserIsNotMessageAuthor, "member should not delete others' messages")
+
+	err = s.usecase.DeleteChatMembers(ctx, bob, chatId, []string{carol.Username})
+	assert.ErrorIs(s.T(), err, ErrInsufficientRole, "member should not remove members")
+
+	err = s.usecase.SetMemberRole(ctx, bob, chatId, carol.Username, models.RoleAdmin)
+	assert.ErrorIs(s.T(), err, ErrInsufficientRole, "member should not change roles")
+
+	chat, err := s.usecase.GetChatWithMembers(ctx, alice, chatId)
+	require.NoError(s.T(), err)
+	assert.Len(s.T(), chat.Members, 3, "nobody should be removed")
+}
+
+func (s *ChatsUsecaseTestSuite) Test_Roles_AdminCantActOnOwner() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	chatId := s.createChat(ctx, alice, bob.Username, carol.Username)
+	err := s.usecase.SetMemberRole(ctx, alice, chatId, bob.Username, models.RoleAdmin)
+	require.NoError(s.T(), err, "owner should promote member")
+
+	err = s.usecase.DeleteChatMembers(ctx, bob, chatId, []string{alice.Username})
+	assert.ErrorIs(s.T(), err, ErrInsufficientRole, "admin should not remove the owner")
+
+	err = s.usecase.SetMemberRole(ctx, bob, chatId, alice.Username, models.RoleMember)
+	assert.ErrorIs(s.T(), err, ErrInsufficientRole, "admin should not demote the owner")
+
+	err = s.usecase.DeleteChatMembers(ctx, bob, chatId, []string{carol.Username})
+	assert.NoError(s.T(), err, "admin should remove a member")
+
+	chat, err := s.usecase.GetChatWithMembers(ctx, alice, chatId)
+	require.NoError(s.T(), err)
+	assert.ElementsMatch(s.T(), []models.ChatMember{
+		{UserID: alice.Username, Role: models.RoleOwner},
+		{UserID: bob.Username, Role: models.RoleAdmin},
+	}, chat.Members)
+}
+
+func (s *ChatsUsecaseTestSuite) Test_DeleteChat_OnlyOwner() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	chatId := s.createChat(ctx, alice, bob.Username, carol.Username)
+	err := s.usecase.SetMemberRole(ctx, alice, chatId, bob.Username, models.RoleAdmin)
+	require.NoError(s.T(), err, "owner should promote member")
+
+	err = s.usecase.DeleteChat(ctx, bob, chatId)
+	assert.ErrorIs(s.T(), err, ErrInsufficientRole, "admin should not delete chat")
+
+	err = s.usecase.DeleteChat(ctx, carol, chatId)
+	assert.ErrorIs(s.T(), err, ErrInsufficientRole, "member should not delete chat")
+
+	err = s.usecase.DeleteChat(ctx, alice, chatId)
+	assert.NoError(s.T(), err, "owner should delete chat")
+
+	_, err = s.registry.GetChatsStore().GetChat(ctx, chatId)
+	assert.ErrorIs(s.T(), err, storage.ErrChatNotFound)
+}
+
+func (s *ChatsUsecaseTestSuite) Test_DirectChat_HasNoOwner() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	chatId, _, err := s.usecase.GetOrCreateDirectChat(ctx, alice, uuid.NewString(), bob.Username)
+	require.NoError(s.T(), err, "direct chat should be created")
+
+	chat, err := s.usecase.GetChatWithMembers(ctx, alice, chatId)
+	require.NoError(s.T(), err)
+	assert.ElementsMatch(s.T(), []models.ChatMember{
+		{UserID: alice.Username, Role: models.RoleMember},
+		{UserID: bob.Username, Role: models.RoleMember},
+	}, chat.Members, "creator should not own direct chat")
+
+	msg, err := s.usecase.SendMessage(ctx, bob, models.MessageSend{
+		MessageID: uuid.NewString(),
+		ChatID:    chatId,
+		Text:      "hello",
+	})
+	require.NoError(s.T(), err, "message should be sent")
+
+	err = s.usecase.DeleteMessages(ctx, alice, models.MessagesDelete{
+		ChatID:     chatId,
+		MessageIDs: []string{msg.MessageID},
+		Scope:      models.DeleteForEveryone,
+	})
+	assert.ErrorIs(s.T(), err, ErrUserIsNotMessageAuthor, "creator should not delete peer's messages")
+
+	err = s.usecase.SetReadReceipts(ctx, bob, chatId, true)
+	assert.NoError(s.T(), err, "any participant should change read receipts")
+}
+
+// sendMessages sends n messages from the user to the chat
+func (s *ChatsUsecaseTestSuite) sendMessages(ctx context.Context, user *auth.UserClaims, chatId string, n int) {
+	for i := 0; i < n; i++ {
+		_, err := s.usecase.SendMessage(ctx, user, models.MessageSend{
+			MessageID: uuid.NewString(),
+			ChatID:    chatId,
+			Text:      "hello",
+		})
+		require.NoError(s.T(), err, "message should be sent")
+	}
+}
+
+// updatesPts returns sequence numbers of the user updates
+func updatesPts(upds []models.UserUpdate) []int64 {
+	pts := make([]int64, 0, len(upds))
+	for _, upd := range upds {
+		pts = append(pts, upd.Pts)
+	}
+	return pts
+}
+
+func (s *ChatsUsecaseTestSuite) Test_GetDifference_Paging() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	chatId := s.createChat(ctx, alice, bob.Username)
+	s.sendMessages(ctx, alice, chatId, 3)
+
+	limit := 2
+	diff, err := s.usecase.GetDifference(ctx, bob, &models.DifferenceSelect{FromPts: 0, Limit: &limit})
+	require.NoError(s.T(), err)
+	assert.Equal(s.T(), []int64{1, 2}, updatesPts(diff.Updates))
+	assert.Equal(s.T(), int64(2), diff.Pts, "pts of the last returned update should be returned")
+	assert.True(s.T(), diff.HasMore)
+	assert.False(s.T(), diff.TooLong)
+
+	diff, err = s.usecase.GetDifference(ctx, bob, &models.DifferenceSelect{FromPts: diff.Pts, Limit: &limit})
+	require.NoError(s.T(), err)
+	assert.Equal(s.T(), []int64{3, 4}, updatesPts(diff.Updates))
+	assert.Equal(s.T(), int64(4), diff.Pts)
+	assert.False(s.T(), diff.HasMore, "gap should be exhausted")
+	assert.False(s.T(), diff.TooLong)
+}
+
+func (s *ChatsUsecaseTestSuite) Test_GetDifference_PrunedUpdates() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	chatId := s.createChat(ctx, alice, bob.Username)
+	s.sendMessages(ctx, alice, chatId, 3)
+
+	// Updates up to pts 2 are sent long ago and pruned by relay
+	_, err := s.DB().ExecContext(ctx, `
+		UPDATE updates_outbox SET sent_at = now() - interval '2 hours'
+		WHERE update_id IN (SELECT update_id FROM user_updates WHERE user_id = $1 AND pts <= 2)`, bob.Username)
+	require.NoError(s.T(), err)
+	relay := storage.NewUpdatesRelay(s.DB(), nil, &storage.UpdatesRelayConfig{Retention: time.Hour}, logrus.New())
+	_, err = relay.Prune(ctx)
+	require.NoError(s.T(), err, "updates should be pruned")
+
+	diff, err := s.usecase.GetDifference(ctx, bob, &models.DifferenceSelect{FromPts: 1})
+	require.NoError(s.T(), err)
+	assert.True(s.T(), diff.TooLong, "gap below pruned horizon can't be filled")
+	assert.Empty(s.T(), diff.Updates)
+	assert.Equal(s.T(), int64(4), diff.Pts, "client should continue from current pts")
+
+	diff, err = s.usecase.GetDifference(ctx, bob, &models.DifferenceSelect{FromPts: 2})
+	require.NoError(s.T(), err)
+	assert.False(s.T(), diff.TooLong, "gap above pruned horizon should be filled")
+	assert.Equal(s.T(), []int64{3, 4}, updatesPts(diff.Updates))
+}
+
+func (s *ChatsUsecaseTestSuite) Test_GetDifference_FromPtsAhead() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	chatId := s.createChat(ctx, alice, bob.Username)
+	s.sendMessages(ctx, alice, chatId, 1)
+
+	diff, err := s.usecase.GetDifference(ctx, bob, &models.DifferenceSelect{FromPts: 10})
+	require.NoError(s.T(), err)
+	assert.Empty(s.T(), diff.Updates)
+	assert.Equal(s.T(), int64(2), diff.Pts, "current pts should be returned")
+	assert.False(s.T(), diff.HasMore)
+	assert.False(s.T(), diff.TooLong)
+}
+
+func TestEqualRefs(t *testing.T) {
+	a, b, c := "a", "a", "c"
+	assert.True(t, equalRefs(nil, nil))
+	assert.True(t, equalRefs(&a, &b), "values should be compared, not pointers")
+	assert.False(t, equalRefs(&a, &c))
+	assert.False(t, equalRefs(&a, nil))
+	assert.False(t, equalRefs(nil, &a))
+}
+
+func TestSameAttachments(t *testing.T) {
+	png := models.FileAttachment{MimeType: "image/png", FileID: "1"}
+	txt := models.FileAttachment{MimeType: "text/plain", FileID: "2"}
+
+	assert.True(t, sameAttachments(nil, []models.FileAttachment{}))
+	assert.True(t, sameAttachments([]models.FileAttachment{png, txt}, []models.FileAttachment{txt, png}), "order should not matter")
+	assert.False(t, sameAttachments([]models.FileAttachment{png}, []models.FileAttachment{png, txt}))
+	assert.False(t, sameAttachments([]models.FileAttachment{png, png}, []models.FileAttachment{png, txt}), "duplicates should be counted")
+	assert.False(t, sameAttachments([]models.FileAttachment{png}, []models.FileAttachment{{MimeType: "image/jpeg", FileID: "1"}}))
+}
+
+func TestReplyPreviewOf(t *testing.T) {
+	deletedAt := time.Now()
+	msg := &models.Message{
+		MessageID: "1",
+		FromUser:  "alice",
+		Text:      strings.Repeat("я", replyPreviewLength+1),
+		DeletedAt: &deletedAt,
+	}
+
+	preview := replyPreviewOf(msg)
+	assert.Equal(t, "1", preview.MessageID)
+	assert.Equal(t, "alice", preview.FromUser)
+	assert.Equal(t, strings.Repeat("я", replyPreviewLength-1)+"…", preview.Text, "long text should be cut by runes")
+	assert.True(t, preview.Deleted)
+
+	msg.Text = strings.Repeat("я", replyPreviewLength)
+	assert.Equal(t, msg.Text, replyPreviewOf(msg).Text, "text of max length should be kept")
+}
@@ -0,0 +1,95 @@
+package usecases
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/practice-sem-2/user-service/internal/models"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	ErrInvalidCursor = errors.New("invalid cursor")
+)
+
+// EncodeCursor returns opaque cursor pointing to the message position
+func EncodeCursor(c models.MessageCursor) string {
+	raw := fmt.Sprintf("%d|%s", c.SendingTime.UTC().UnixNano(), c.MessageID)
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func DecodeCursor(cursor string) (*models.MessageCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	nanos, messageId, found := strings.Cut(string(raw), "|")
+	if !found || !ValidateUUID(messageId) {
+		return nil, ErrInvalidCursor
+	}
+
+	unixNano, err := strconv.ParseInt(nanos, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	return &models.MessageCursor{
+		SendingTime: time.Unix(0, unixNano).UTC(),
+		MessageID:   messageId,
+	}, nil
+}
+
+func cursorOf(msg *models.Message) *string {
+	cursor := EncodeCursor(models.MessageCursor{
+		SendingTime: msg.SendingTime,
+		MessageID:   msg.MessageID,
+	})
+	return &cursor
+}
+
+// EncodeSearchCursor returns opaque cursor pointing to the search result position
+func EncodeSearchCursor(c models.SearchCursor) string {
+	raw := fmt.Sprintf("%s|%s", strconv.FormatFloat(float64(c.Rank), 'g', -1, 32), EncodeCursor(c.MessageCursor))
+	return base64.RawURLEncoding.EncodeToString([]byte(raw))
+}
+
+func DecodeSearchCursor(cursor string) (*models.SearchCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	rawRank, rawPosition, found := strings.Cut(string(raw), "|")
+	if !found {
+		return nil, ErrInvalidCursor
+	}
+
+	rank, err := strconv.ParseFloat(rawRank, 32)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	position, err := DecodeCursor(rawPosition)
+	if err != nil {
+		return nil, err
+	}
+
+	return &models.SearchCursor{
+		Rank:          float32(rank),
+		MessageCursor: *position,
+	}, nil
+}
+
+func searchCursorOf(res *models.SearchResult) *string {
+	cursor := EncodeSearchCursor(models.SearchCursor{
+		Rank: res.Rank,
+		MessageCursor: models.MessageCursor{
+			SendingTime: res.SendingTime,
+			MessageID:   res.MessageID,
+		},
+	})
+	return &cursor
+}
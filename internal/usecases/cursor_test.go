@@ -0,0 +1,60 @@
+package usecases
+
+import (
+	"github.com/practice-sem-2/user-service/internal/models"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestCursor_EncodeDecode(t *testing.T) {
+	expected := models.MessageCursor{
+		SendingTime: time.Date(2023, 4, 23, 12, 30, 15, 123456000, time.UTC),
+		MessageID:   "67f85047-09d0-42a2-a5ee-9ce8db28cb07",
+	}
+
+	actual, err := DecodeCursor(EncodeCursor(expected))
+	require.NoError(t, err, "encoded cursor should be decoded")
+	assert.Equal(t, expected, *actual)
+}
+
+func TestCursor_DecodeInvalid(t *testing.T) {
+	cursors := []string{
+		"",
+		"not base64!",
+		EncodeCursor(models.MessageCursor{MessageID: "not uuid"}),
+	}
+
+	for _, cursor := range cursors {
+		_, err := DecodeCursor(cursor)
+		assert.ErrorIs(t, err, ErrInvalidCursor, "cursor %q should be invalid", cursor)
+	}
+}
+
+func TestSearchCursor_EncodeDecode(t *testing.T) {
+	expected := models.SearchCursor{
+		Rank: 0.0607927,
+		MessageCursor: models.MessageCursor{
+			SendingTime: time.Date(2023, 4, 23, 12, 30, 15, 123456000, time.UTC),
+			MessageID:   "67f85047-09d0-42a2-a5ee-9ce8db28cb07",
+		},
+	}
+
+	actual, err := DecodeSearchCursor(EncodeSearchCursor(expected))
+	require.NoError(t, err, "encoded cursor should be decoded")
+	assert.Equal(t, expected, *actual)
+}
+
+func TestSearchCursor_DecodeInvalid(t *testing.T) {
+	cursors := []string{
+		"",
+		"not base64!",
+		EncodeCursor(models.MessageCursor{MessageID: "67f85047-09d0-42a2-a5ee-9ce8db28cb07"}),
+	}
+
+	for _, cursor := range cursors {
+		_, err := DecodeSearchCursor(cursor)
+		assert.ErrorIs(t, err, ErrInvalidCursor, "cursor %q should be invalid", cursor)
+	}
+}
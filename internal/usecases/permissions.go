@@ -0,0 +1,137 @@
+package usecases
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/practice-sem-2/user-service/internal/models"
+	storage "github.com/practice-sem-2/user-service/internal/storages"
+)
+
+var (
+	ErrInsufficientRole = fmt.Errorf("%w: User's role doesn't allow this action", ErrPermissionDenied)
+)
+
+type Permission int
+
+const (
+	PermAddMembers Permission = iota
+	PermRemoveMembers
+	PermEditChatInfo
+	PermDeleteOthersMessages
+	PermPinMessages
+	PermManageRoles
+	PermDeleteChat
+)
+
+// permissions is a matrix of actions allowed to every chat role
+var permissions = map[models.ChatRole]map[Permission]bool{
+	models.RoleOwner: {
+		PermAddMembers:           true,
+		PermRemoveMembers:        true,
+		PermEditChatInfo:         true,
+		PermDeleteOthersMessages: true,
+		PermPinMessages:          true,
+		PermManageRoles:          true,
+		PermDeleteChat:           true,
+	},
+	models.RoleAdmin: {
+		PermAddMembers:           true,
+		PermRemoveMembers:        true,
+		PermEditChatInfo:         true,
+		PermDeleteOthersMessages: true,
+		PermPinMessages:          true,
+	},
+	models.RoleMember: {
+		PermAddMembers: true,
+	},
+}
+
+// roleRanks orders roles, a member can act on other members
+// only if their rank is lower
+var roleRanks = map[models.ChatRole]int{
+	models.RoleOwner:  2,
+	models.RoleAdmin:  1,
+	models.RoleMember: 0,
+}
+
+func HasPermission(role models.ChatRole, perm Permission) bool {
+	return permissions[role][perm]
+}
+
+// Outranks reports whether actor's role is higher than target's one
+func Outranks(actor models.ChatRole, target models.ChatRole) bool {
+	return roleRanks[actor] > roleRanks[target]
+}
+
+// Successor returns the highest ranked member except the leaving one,
+// members of the same rank are taken in the listed order. Returns nil
+// if there are no other members
+func Successor(members []models.ChatMember, leaving string) *models.ChatMember {
+	var successor *models.ChatMember
+	for i := range members {
+		member := &members[i]
+		if member.UserID == leaving {
+			continue
+		}
+		if successor == nil || Outranks(member.Role, successor.Role) {
+			successor = member
+		}
+	}
+	return successor
+}
+
+// checkPermission returns user's role if the user is a chat member
+// and the role has the permission
+func (u *ChatsUsecase) checkPermission(ctx context.Context, store *storage.ChatsStorage, chatId string, username string, perm Permission) (models.ChatRole, error) {
+	role, err := u.getRole(ctx, store, chatId, username)
+	if err != nil {
+		return "", err
+	}
+
+	if !HasPermission(role, perm) {
+		return "", ErrInsufficientRole
+	}
+
+	return role, nil
+}
+
+// getRole returns ErrUserIsNotAChatMember if user is not a chat member
+func (u *ChatsUsecase) getRole(ctx context.Context, store *storage.ChatsStorage, chatId string, username string) (models.ChatRole, error) {
+	// Check if chat exists
+	if _, err := store.GetChat(ctx, chatId); err != nil {
+		return "", err
+	}
+
+	role, err := store.GetMemberRole(ctx, chatId, username)
+	if errors.Is(err, storage.ErrNotMember) {
+		return "", ErrUserIsNotAChatMember
+	} else if err != nil {
+		return "", err
+	}
+
+	return role, nil
+}
+
+// checkCanPin allows both participants of direct chat to manage pins,
+// in group chats PermPinMessages is required
+func (u *ChatsUsecase) checkCanPin(ctx context.Context, store *storage.ChatsStorage, chatId string, username string) error {
+	isMember, err := store.UserIsMember(ctx, chatId, username)
+	if err != nil {
+		return err
+	} else if !isMember {
+		return ErrUserIsNotAChatMember
+	}
+
+	chat, err := store.GetChat(ctx, chatId)
+	if err != nil {
+		return err
+	}
+
+	if chat.IsDirect {
+		return nil
+	}
+
+	_, err = u.checkPermission(ctx, store, chatId, username, PermPinMessages)
+	return err
+}
@@ -0,0 +1,45 @@
+package usecases
+
+import (
+	"github.com/practice-sem-2/user-service/internal/models"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestHasPermission(t *testing.T) {
+	assert.True(t, HasPermission(models.RoleOwner, PermManageRoles), "owner should manage roles")
+	assert.False(t, HasPermission(models.RoleAdmin, PermManageRoles), "admin should not manage roles")
+	assert.True(t, HasPermission(models.RoleAdmin, PermDeleteOthersMessages), "admin should delete others' messages")
+	assert.True(t, HasPermission(models.RoleMember, PermAddMembers), "member should add members")
+	assert.False(t, HasPermission(models.RoleMember, PermRemoveMembers), "member should not remove members")
+	assert.False(t, HasPermission(models.RoleMember, PermPinMessages), "member should not pin messages")
+	assert.False(t, HasPermission("unknown", PermAddMembers), "unknown role should have no permissions")
+}
+
+func TestOutranks(t *testing.T) {
+	assert.True(t, Outranks(models.RoleOwner, models.RoleAdmin))
+	assert.True(t, Outranks(models.RoleAdmin, models.RoleMember))
+	assert.False(t, Outranks(models.RoleAdmin, models.RoleAdmin), "equal roles should not outrank each other")
+	assert.False(t, Outranks(models.RoleAdmin, models.RoleOwner))
+}
+
+func TestSuccessor(t *testing.T) {
+	members := []models.ChatMember{
+		{UserID: "alice", Role: models.RoleMember},
+		{UserID: "bob", Role: models.RoleAdmin},
+		{UserID: "carol", Role: models.RoleOwner},
+		{UserID: "dave", Role: models.RoleAdmin},
+	}
+
+	successor := Successor(members, "carol")
+	if assert.NotNil(t, successor) {
+		assert.Equal(t, "bob", successor.UserID, "the first admin should become the owner")
+	}
+
+	successor = Successor(members[:1], "carol")
+	if assert.NotNil(t, successor) {
+		assert.Equal(t, "alice", successor.UserID, "member should become the owner if there are no admins")
+	}
+
+	assert.Nil(t, Successor(members[2:3], "carol"), "there is no successor for the last member")
+}
@@ -0,0 +1,6 @@
+BEGIN;
+
+ALTER TABLE attachments
+    DROP COLUMN mime_type;
+
+END;
\ No newline at end of file
@@ -0,0 +1,12 @@
+BEGIN;
+
+-- Attachments created before mime type was stored are counted as binary
+ALTER TABLE attachments
+    ADD COLUMN mime_type VARCHAR(255) NOT NULL DEFAULT 'application/octet-stream';
+
+
+-- Makes mime_type column required
+ALTER TABLE attachments
+    ALTER COLUMN mime_type DROP DEFAULT;
+
+COMMIT;
@@ -0,0 +1,8 @@
+BEGIN;
+
+DROP TABLE message_revisions;
+
+ALTER TABLE messages
+    DROP COLUMN edited_at;
+
+END;
\ No newline at end of file
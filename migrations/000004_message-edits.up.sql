@@ -0,0 +1,17 @@
+BEGIN;
+
+ALTER TABLE messages
+    ADD COLUMN edited_at TIMESTAMP NULL DEFAULT NULL;
+
+-- Keeps previous versions of edited messages
+CREATE TABLE message_revisions
+(
+    revision_id uuid          NOT NULL DEFAULT uuid_generate_v4() PRIMARY KEY,
+    message_id  uuid          NOT NULL REFERENCES messages ON DELETE CASCADE,
+    text        VARCHAR(2048) NULL     DEFAULT NULL,
+    revised_at  TIMESTAMP     NOT NULL DEFAULT (now() at time zone 'utc')
+);
+
+CREATE INDEX message_revisions_message_id_idx ON message_revisions (message_id, revised_at);
+
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,8 @@
+BEGIN;
+
+DROP TABLE hidden_messages;
+
+ALTER TABLE messages
+    DROP COLUMN deleted_at;
+
+END;
\ No newline at end of file
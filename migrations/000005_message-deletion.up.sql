@@ -0,0 +1,16 @@
+BEGIN;
+
+-- Messages deleted for everyone are kept as tombstones, so replies to them
+-- are still valid
+ALTER TABLE messages
+    ADD COLUMN deleted_at TIMESTAMP NULL DEFAULT NULL;
+
+-- Messages deleted only for a particular user
+CREATE TABLE hidden_messages
+(
+    message_id uuid        NOT NULL REFERENCES messages ON DELETE CASCADE,
+    user_id    varchar(64) NOT NULL,
+    PRIMARY KEY (user_id, message_id)
+);
+
+COMMIT;
\ No newline at end of file
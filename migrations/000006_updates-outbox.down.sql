@@ -0,0 +1,5 @@
+BEGIN;
+
+DROP TABLE updates_outbox;
+
+END;
\ No newline at end of file
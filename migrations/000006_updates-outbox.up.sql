@@ -0,0 +1,17 @@
+BEGIN;
+
+-- Updates are written in the same transaction as the data they describe
+-- and published to kafka by relay after commit
+CREATE TABLE updates_outbox
+(
+    update_id  BIGSERIAL    NOT NULL PRIMARY KEY,
+    topic      VARCHAR(255) NOT NULL,
+    key        VARCHAR(255) NOT NULL,
+    payload    BYTEA        NOT NULL,
+    created_at TIMESTAMP    NOT NULL DEFAULT (now() at time zone 'utc'),
+    sent_at    TIMESTAMP    NULL     DEFAULT NULL
+);
+
+CREATE INDEX updates_outbox_pending_idx ON updates_outbox (update_id) WHERE sent_at IS NULL;
+
+COMMIT;
\ No newline at end of file
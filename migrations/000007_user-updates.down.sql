@@ -0,0 +1,6 @@
+BEGIN;
+
+DROP TABLE user_updates;
+DROP TABLE user_update_state;
+
+END;
\ No newline at end of file
@@ -0,0 +1,19 @@
+BEGIN;
+
+-- Last update sequence number (pts) of every user
+CREATE TABLE user_update_state
+(
+    user_id varchar(64) NOT NULL PRIMARY KEY,
+    pts     BIGINT      NOT NULL
+);
+
+-- Updates fanned out to every audience member with per user pts
+CREATE TABLE user_updates
+(
+    user_id   varchar(64) NOT NULL,
+    pts       BIGINT      NOT NULL,
+    update_id BIGINT      NOT NULL REFERENCES updates_outbox ON DELETE CASCADE,
+    PRIMARY KEY (user_id, pts)
+);
+
+COMMIT;
\ No newline at end of file
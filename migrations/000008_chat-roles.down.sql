@@ -0,0 +1,6 @@
+BEGIN;
+
+ALTER TABLE chat_members
+    DROP COLUMN role;
+
+END;
\ No newline at end of file
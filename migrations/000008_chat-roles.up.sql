@@ -0,0 +1,20 @@
+BEGIN;
+
+ALTER TABLE chat_members
+    ADD COLUMN role VARCHAR(16) NOT NULL DEFAULT 'member'
+        CHECK (role IN ('owner', 'admin', 'member'));
+
+-- Existing members become regular members except one owner per group chat,
+-- otherwise nobody could manage chats created before roles. Participants
+-- of direct chats are equal, so direct chats have no owner
+UPDATE chat_members
+SET role = 'owner'
+FROM (SELECT chat_id, min(user_id) AS user_id
+      FROM chat_members
+               JOIN chats USING (chat_id)
+      WHERE NOT chats.is_direct
+      GROUP BY chat_id) AS owners
+WHERE chat_members.chat_id = owners.chat_id
+  AND chat_members.user_id = owners.user_id;
+
+COMMIT;
\ No newline at end of file
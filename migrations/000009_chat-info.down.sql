@@ -0,0 +1,11 @@
+BEGIN;
+
+ALTER TABLE chats
+    DROP CONSTRAINT chats_direct_title_check,
+    DROP COLUMN title,
+    DROP COLUMN description,
+    DROP COLUMN avatar_file_id,
+    DROP COLUMN created_at,
+    DROP COLUMN created_by;
+
+END;
\ No newline at end of file
@@ -0,0 +1,14 @@
+BEGIN;
+
+ALTER TABLE chats
+    ADD COLUMN title          VARCHAR(128)  NULL     DEFAULT NULL,
+    ADD COLUMN description    VARCHAR(1024) NULL     DEFAULT NULL,
+    ADD COLUMN avatar_file_id uuid          NULL     DEFAULT NULL,
+    ADD COLUMN created_at     TIMESTAMP     NOT NULL DEFAULT (now() at time zone 'utc'),
+    ADD COLUMN created_by     varchar(64)   NULL     DEFAULT NULL;
+
+-- Direct chats are named after the interlocutor
+ALTER TABLE chats
+    ADD CONSTRAINT chats_direct_title_check CHECK (NOT is_direct OR title IS NULL);
+
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,5 @@
+BEGIN;
+
+DROP TABLE direct_chats;
+
+END;
\ No newline at end of file
@@ -0,0 +1,25 @@
+BEGIN;
+
+-- Participants of direct chats, user_a is always less than user_b,
+-- so the pair is unique regardless of who created the chat
+CREATE TABLE direct_chats
+(
+    chat_id uuid        NOT NULL PRIMARY KEY REFERENCES chats ON DELETE CASCADE,
+    user_a  varchar(64) NOT NULL,
+    user_b  varchar(64) NOT NULL,
+    CONSTRAINT direct_chats_users_order_check CHECK (user_a < user_b),
+    CONSTRAINT direct_chats_users_key UNIQUE (user_a, user_b)
+);
+
+-- Links existing direct chats, the oldest one is kept for duplicated pairs
+INSERT INTO direct_chats (chat_id, user_a, user_b)
+SELECT DISTINCT ON (user_a, user_b) chat_id, user_a, user_b
+FROM (SELECT c.chat_id, c.created_at, min(m.user_id) AS user_a, max(m.user_id) AS user_b
+      FROM chats c
+               JOIN chat_members m USING (chat_id)
+      WHERE c.is_direct
+      GROUP BY c.chat_id
+      HAVING count(m.user_id) = 2) AS pairs
+ORDER BY user_a, user_b, created_at;
+
+COMMIT;
\ No newline at end of file
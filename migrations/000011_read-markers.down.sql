@@ -0,0 +1,7 @@
+BEGIN;
+
+ALTER TABLE chat_members
+    DROP COLUMN last_read_message_id,
+    DROP COLUMN last_read_at;
+
+END;
\ No newline at end of file
@@ -0,0 +1,9 @@
+BEGIN;
+
+-- Read marker is a position of the last message read by the member,
+-- it is stored as (sending_time, message_id) like history cursors
+ALTER TABLE chat_members
+    ADD COLUMN last_read_message_id uuid REFERENCES messages ON DELETE SET NULL,
+    ADD COLUMN last_read_at         timestamp;
+
+COMMIT;
\ No newline at end of file
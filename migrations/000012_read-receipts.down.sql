@@ -0,0 +1,6 @@
+BEGIN;
+
+ALTER TABLE chats
+    DROP COLUMN read_receipts;
+
+END;
\ No newline at end of file
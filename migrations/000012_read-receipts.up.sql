@@ -0,0 +1,8 @@
+BEGIN;
+
+-- Read receipts may be turned off in large chats, read markers
+-- are still tracked for unread counters
+ALTER TABLE chats
+    ADD COLUMN read_receipts boolean NOT NULL DEFAULT true;
+
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,5 @@
+BEGIN;
+
+DROP TABLE message_reactions;
+
+END;
\ No newline at end of file
@@ -0,0 +1,12 @@
+BEGIN;
+
+CREATE TABLE message_reactions
+(
+    message_id uuid        NOT NULL REFERENCES messages ON DELETE CASCADE,
+    user_id    varchar(64) NOT NULL,
+    reaction   varchar(32) NOT NULL,
+    reacted_at timestamp   NOT NULL DEFAULT (now() at time zone 'utc'),
+    PRIMARY KEY (message_id, user_id, reaction)
+);
+
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,5 @@
+BEGIN;
+
+DROP TABLE chat_pins;
+
+END;
\ No newline at end of file
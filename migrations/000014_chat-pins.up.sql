@@ -0,0 +1,14 @@
+BEGIN;
+
+CREATE TABLE chat_pins
+(
+    chat_id    uuid        NOT NULL REFERENCES chats ON DELETE CASCADE,
+    message_id uuid        NOT NULL REFERENCES messages ON DELETE CASCADE,
+    pinned_by  varchar(64) NOT NULL,
+    pinned_at  timestamp   NOT NULL DEFAULT (now() at time zone 'utc'),
+    PRIMARY KEY (chat_id, message_id)
+);
+
+CREATE INDEX chat_pins_pinned_at_idx ON chat_pins (chat_id, pinned_at DESC);
+
+COMMIT;
\ No newline at end of file
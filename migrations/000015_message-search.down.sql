@@ -0,0 +1,6 @@
+BEGIN;
+
+ALTER TABLE messages
+    DROP COLUMN text_search;
+
+END;
\ No newline at end of file
@@ -0,0 +1,10 @@
+BEGIN;
+
+-- 'simple' configuration doesn't depend on language of messages
+ALTER TABLE messages
+    ADD COLUMN text_search tsvector NOT NULL
+        GENERATED ALWAYS AS (to_tsvector('simple', coalesce(text, ''))) STORED;
+
+CREATE INDEX messages_text_search_idx ON messages USING GIN (text_search);
+
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,9 @@
+BEGIN;
+
+ALTER TABLE messages
+    DROP COLUMN forwarded_from_chat,
+    DROP COLUMN forwarded_from_message,
+    DROP COLUMN forwarded_from_user,
+    DROP COLUMN forwarded_sending_time;
+
+END;
\ No newline at end of file
@@ -0,0 +1,11 @@
+BEGIN;
+
+-- Origin of forwarded messages. Author and sending time are kept
+-- even if the original message or chat is deleted
+ALTER TABLE messages
+    ADD COLUMN forwarded_from_chat    uuid        NULL REFERENCES chats ON DELETE SET NULL,
+    ADD COLUMN forwarded_from_message uuid        NULL REFERENCES messages ON DELETE SET NULL,
+    ADD COLUMN forwarded_from_user    varchar(64) NULL,
+    ADD COLUMN forwarded_sending_time timestamp   NULL;
+
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,6 @@
+BEGIN;
+
+ALTER TABLE messages
+    DROP COLUMN thread_root_id;
+
+END;
\ No newline at end of file
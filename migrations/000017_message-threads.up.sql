@@ -0,0 +1,23 @@
+BEGIN;
+
+-- Thread is a root message with all replies to it and to its replies
+ALTER TABLE messages
+    ADD COLUMN thread_root_id uuid NULL REFERENCES messages ON DELETE SET NULL;
+
+CREATE INDEX messages_thread_root_id_idx ON messages (thread_root_id, sending_time, message_id);
+
+-- Existing replies are put to the thread of the first message of the reply chain
+WITH RECURSIVE threads AS (SELECT message_id, message_id AS root_id
+                           FROM messages
+                           WHERE reply_to IS NULL
+                           UNION ALL
+                           SELECT m.message_id, t.root_id
+                           FROM messages m
+                                    JOIN threads t ON m.reply_to = t.message_id)
+UPDATE messages
+SET thread_root_id = threads.root_id
+FROM threads
+WHERE messages.message_id = threads.message_id
+  AND threads.root_id <> threads.message_id;
+
+COMMIT;
\ No newline at end of file
@@ -0,0 +1,29 @@
+BEGIN;
+
+ALTER TABLE message_reactions
+    ALTER COLUMN reacted_at TYPE timestamp USING reacted_at AT TIME ZONE 'utc',
+    ALTER COLUMN reacted_at SET DEFAULT (now() at time zone 'utc');
+
+ALTER TABLE chat_pins
+    ALTER COLUMN pinned_at TYPE timestamp USING pinned_at AT TIME ZONE 'utc',
+    ALTER COLUMN pinned_at SET DEFAULT (now() at time zone 'utc');
+
+ALTER TABLE chats
+    ALTER COLUMN created_at TYPE timestamp USING created_at AT TIME ZONE 'utc',
+    ALTER COLUMN created_at SET DEFAULT (now() at time zone 'utc');
+
+ALTER TABLE chat_members
+    ALTER COLUMN last_read_at TYPE timestamp USING last_read_at AT TIME ZONE 'utc';
+
+ALTER TABLE message_revisions
+    ALTER COLUMN revised_at TYPE timestamp USING revised_at AT TIME ZONE 'utc',
+    ALTER COLUMN revised_at SET DEFAULT (now() at time zone 'utc');
+
+ALTER TABLE messages
+    ALTER COLUMN sending_time TYPE timestamp USING sending_time AT TIME ZONE 'utc',
+    ALTER COLUMN sending_time SET DEFAULT (now() at time zone 'utc'),
+    ALTER COLUMN edited_at TYPE timestamp USING edited_at AT TIME ZONE 'utc',
+    ALTER COLUMN deleted_at TYPE timestamp USING deleted_at AT TIME ZONE 'utc',
+    ALTER COLUMN forwarded_sending_time TYPE timestamp USING forwarded_sending_time AT TIME ZONE 'utc';
+
+END;
\ No newline at end of file
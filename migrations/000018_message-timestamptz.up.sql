@@ -0,0 +1,31 @@
+BEGIN;
+
+-- Timestamps were stored in UTC without time zone
+ALTER TABLE messages
+    ALTER COLUMN sending_time TYPE timestamptz USING sending_time AT TIME ZONE 'utc',
+    ALTER COLUMN sending_time SET DEFAULT now(),
+    ALTER COLUMN edited_at TYPE timestamptz USING edited_at AT TIME ZONE 'utc',
+    ALTER COLUMN deleted_at TYPE timestamptz USING deleted_at AT TIME ZONE 'utc',
+    ALTER COLUMN forwarded_sending_time TYPE timestamptz USING forwarded_sending_time AT TIME ZONE 'utc';
+
+ALTER TABLE message_revisions
+    ALTER COLUMN revised_at TYPE timestamptz USING revised_at AT TIME ZONE 'utc',
+    ALTER COLUMN revised_at SET DEFAULT now();
+
+-- Read marker is compared with messages sending time
+ALTER TABLE chat_members
+    ALTER COLUMN last_read_at TYPE timestamptz USING last_read_at AT TIME ZONE 'utc';
+
+ALTER TABLE chats
+    ALTER COLUMN created_at TYPE timestamptz USING created_at AT TIME ZONE 'utc',
+    ALTER COLUMN created_at SET DEFAULT now();
+
+ALTER TABLE chat_pins
+    ALTER COLUMN pinned_at TYPE timestamptz USING pinned_at AT TIME ZONE 'utc',
+    ALTER COLUMN pinned_at SET DEFAULT now();
+
+ALTER TABLE message_reactions
+    ALTER COLUMN reacted_at TYPE timestamptz USING reacted_at AT TIME ZONE 'utc',
+    ALTER COLUMN reacted_at SET DEFAULT now();
+
+COMMIT;
\ No newline at end of file
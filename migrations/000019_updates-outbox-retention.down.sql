@@ -0,0 +1,6 @@
+BEGIN;
+
+DROP INDEX user_updates_update_id_idx;
+DROP INDEX updates_outbox_sent_at_idx;
+
+END;
\ No newline at end of file
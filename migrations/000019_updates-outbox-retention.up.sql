@@ -0,0 +1,9 @@
+BEGIN;
+
+-- Sent updates are deleted by relay after retention period
+CREATE INDEX updates_outbox_sent_at_idx ON updates_outbox (sent_at) WHERE sent_at IS NOT NULL;
+
+-- Used by cascade delete of pruned updates
+CREATE INDEX user_updates_update_id_idx ON user_updates (update_id);
+
+COMMIT;
\ No newline at end of file
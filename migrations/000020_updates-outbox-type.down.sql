@@ -0,0 +1,5 @@
+BEGIN;
+
+ALTER TABLE updates_outbox DROP COLUMN update_type;
+
+END;
\ No newline at end of file
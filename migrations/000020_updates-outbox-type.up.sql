@@ -0,0 +1,8 @@
+BEGIN;
+
+-- Type of update is kept to label relay metrics, type of
+-- already written updates is unknown
+ALTER TABLE updates_outbox ADD COLUMN update_type VARCHAR(64) NOT NULL DEFAULT 'unknown';
+ALTER TABLE updates_outbox ALTER COLUMN update_type DROP DEFAULT;
+
+COMMIT;
\ No newline at end of file